@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 
@@ -75,6 +76,33 @@ const (
 	CLIPodResourcesKubeletSocket  = "pod-resources-kubelet-socket"
 	CLIHPCJobMappingDir           = "hpc-job-mapping-dir"
 	CLINvidiaResourceNames        = "nvidia-resource-names"
+	CLIKubernetesPodLabels        = "kubernetes-pod-labels"
+	CLIKubernetesPodAnnotations   = "kubernetes-pod-annotations"
+	CLIKubernetesWorkloads        = "kubernetes-workloads"
+	CLIKubernetesSharedGPUs       = "kubernetes-shared-gpus"
+	CLIPodMetadataSource          = "kubernetes-pod-metadata-source"
+	CLIKubeletPodsURL             = "kubelet-pods-url"
+	CLIKubeletCAFile              = "kubelet-ca-file"
+	CLIKubeletInsecureSkipVerify  = "kubelet-insecure-skip-tls-verify"
+	CLINativeCollectors           = "native-collectors"
+	CLIEnableOpenMetrics          = "enable-openmetrics"
+	CLIEmitTimestamps             = "emit-timestamps"
+	CLIStaleIntervals             = "stale-intervals"
+	CLICountersReloadInterval     = "counters-reload-interval"
+	CLIRemoteWriteURL             = "remote-write-url"
+	CLIRemoteWriteConfigFile      = "remote-write-config-file"
+	CLIRemoteWriteQueueSize       = "remote-write-queue-size"
+	CLIOTLPEndpoint               = "otlp-endpoint"
+	CLIOTLPProtocol               = "otlp-protocol"
+	CLIOTLPInsecure               = "otlp-insecure"
+	CLIOTLPHeaders                = "otlp-headers"
+	CLIOTLPQueueSize              = "otlp-queue-size"
+	CLIDisablePrometheusEndpoint  = "disable-prometheus-endpoint"
+	CLIStatsDAddress              = "statsd-address"
+	CLITopologyFormat             = "format"
+	CLIHealthStaleIntervals       = "health-stale-intervals"
+	CLIRemoteHETargets            = "remote-hostengine-targets"
+	CLIProbe                      = "probe"
 )
 
 func NewApp(buildVersion ...string) *cli.App {
@@ -244,6 +272,160 @@ func NewApp(buildVersion ...string) *cli.App {
 			Usage:   "Nvidia resource names for specified GPU type like nvidia.com/a100, nvidia.com/a10.",
 			EnvVars: []string{"NVIDIA_RESOURCE_NAMES"},
 		},
+		&cli.StringSliceFlag{
+			Name:    CLIKubernetesPodLabels,
+			Value:   cli.NewStringSlice(),
+			Usage:   "Labels of the pods added to the metrics of their GPUs, like team or app.kubernetes.io/name. Added as 'label_<name>', with the invalid characters replaced by '_'.",
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_POD_LABELS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    CLIKubernetesPodAnnotations,
+			Value:   cli.NewStringSlice(),
+			Usage:   "Annotations of the pods added to the metrics of their GPUs. Added as 'annotation_<name>', with the invalid characters replaced by '_'.",
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_POD_ANNOTATIONS"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIKubernetesWorkloads,
+			Value:   false,
+			Usage:   "Add the kind and name of the workload owning the pods, like a Deployment, a CronJob or a PyTorchJob, to the metrics of their GPUs as workload_kind and workload_name.",
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_WORKLOADS"},
+		},
+		&cli.StringFlag{
+			Name:    CLIKubernetesSharedGPUs,
+			Value:   dcgmexporter.SharedGPUsSeries,
+			Usage:   "How to attribute the GPUs shared by several pods through time-slicing or MPS. Possible values: series (the metrics of the GPU are emitted once per pod) and info (the metrics of the GPU are emitted without pod, and the pods by the DCGM_EXP_GPU_SHARED_PODS metric).",
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_SHARED_GPUS"},
+		},
+		&cli.StringFlag{
+			Name:    CLIPodMetadataSource,
+			Value:   dcgmexporter.PodMetadataSourceAPIServer,
+			Usage:   "Where to get the pod labels and annotations from. Possible values: apiserver (watches the pods of the node given by NODE_NAME) and kubelet (lists the pods from the /pods endpoint of the kubelet).",
+			EnvVars: []string{"DCGM_EXPORTER_KUBERNETES_POD_METADATA_SOURCE"},
+		},
+		&cli.StringFlag{
+			Name:    CLIKubeletPodsURL,
+			Value:   "https://localhost:10250/pods",
+			Usage:   "URL of the /pods endpoint of the kubelet, with the kubelet pod metadata source.",
+			EnvVars: []string{"DCGM_EXPORTER_KUBELET_PODS_URL"},
+		},
+		&cli.StringFlag{
+			Name:    CLIKubeletCAFile,
+			Value:   "",
+			Usage:   "CA certificate file verifying the serving certificate of the kubelet, with the kubelet pod metadata source. The cluster CA when empty.",
+			EnvVars: []string{"DCGM_EXPORTER_KUBELET_CA_FILE"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIKubeletInsecureSkipVerify,
+			Value:   false,
+			Usage:   "Don't verify the serving certificate of the kubelet, with the kubelet pod metadata source.",
+			EnvVars: []string{"DCGM_EXPORTER_KUBELET_INSECURE_SKIP_TLS_VERIFY"},
+		},
+		&cli.BoolFlag{
+			Name:    CLINativeCollectors,
+			Value:   false,
+			Usage:   "Collect metrics on every scrape through a Prometheus registry, instead of serving the metrics cached every collect interval. Exposes the Go runtime and process metrics too.",
+			EnvVars: []string{"DCGM_EXPORTER_NATIVE_COLLECTORS"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIEnableOpenMetrics,
+			Value:   false,
+			Usage:   "Serve the OpenMetrics format to the scrapers asking for it. The names of the counters get a _total suffix, and the names of the metrics with a unit get the unit as suffix.",
+			EnvVars: []string{"DCGM_EXPORTER_ENABLE_OPENMETRICS"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIEmitTimestamps,
+			Value:   false,
+			Usage:   "Expose the time at which DCGM sampled each value as the timestamp of the sample.",
+			EnvVars: []string{"DCGM_EXPORTER_EMIT_TIMESTAMPS"},
+		},
+		&cli.IntFlag{
+			Name:    CLIStaleIntervals,
+			Value:   0,
+			Usage:   "Drop samples taken by DCGM more than this number of collect intervals ago. Zero disables the check.",
+			EnvVars: []string{"DCGM_EXPORTER_STALE_INTERVALS"},
+		},
+		&cli.IntFlag{
+			Name:    CLICountersReloadInterval,
+			Value:   30000,
+			Usage:   "Interval of time at which the counters file is checked for changes, which are applied without a restart. Unit is milliseconds (ms). Zero disables the check; a SIGHUP still triggers it. The ConfigMap given by --configmap-data is watched instead.",
+			EnvVars: []string{"DCGM_EXPORTER_COUNTERS_RELOAD_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:    CLIRemoteWriteURL,
+			Value:   "",
+			Usage:   "URL of a Prometheus remote-write endpoint the metrics are pushed to every collect interval. Pushing is disabled when empty.",
+			EnvVars: []string{"DCGM_EXPORTER_REMOTE_WRITE_URL"},
+		},
+		&cli.StringFlag{
+			Name:    CLIRemoteWriteConfigFile,
+			Value:   "",
+			Usage:   "HTTP client config file of the remote-write endpoint, with the TLS and basic auth options, following the Prometheus http_config spec.",
+			EnvVars: []string{"DCGM_EXPORTER_REMOTE_WRITE_CONFIG_FILE"},
+		},
+		&cli.IntFlag{
+			Name:    CLIRemoteWriteQueueSize,
+			Value:   100,
+			Usage:   "Maximum number of remote-write requests kept in memory while the endpoint is unavailable. The oldest requests are dropped first.",
+			EnvVars: []string{"DCGM_EXPORTER_REMOTE_WRITE_QUEUE_SIZE"},
+		},
+		&cli.StringFlag{
+			Name:    CLIOTLPEndpoint,
+			Value:   "",
+			Usage:   "OTLP endpoint the metrics are pushed to every collect interval: host:port for gRPC, the base URL for HTTP. Pushing is disabled when empty.",
+			EnvVars: []string{"DCGM_EXPORTER_OTLP_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    CLIOTLPProtocol,
+			Value:   dcgmexporter.OTLPProtocolGRPC,
+			Usage:   "Protocol of the OTLP endpoint: grpc or http/protobuf.",
+			EnvVars: []string{"DCGM_EXPORTER_OTLP_PROTOCOL"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIOTLPInsecure,
+			Value:   false,
+			Usage:   "Connect to the OTLP gRPC endpoint without TLS.",
+			EnvVars: []string{"DCGM_EXPORTER_OTLP_INSECURE"},
+		},
+		&cli.StringSliceFlag{
+			Name:    CLIOTLPHeaders,
+			Usage:   "Headers sent with the OTLP requests, as key=value, e.g. for authentication.",
+			EnvVars: []string{"DCGM_EXPORTER_OTLP_HEADERS"},
+		},
+		&cli.IntFlag{
+			Name:    CLIOTLPQueueSize,
+			Value:   100,
+			Usage:   "Maximum number of OTLP requests kept in memory while the endpoint is unavailable. The oldest requests are dropped first.",
+			EnvVars: []string{"DCGM_EXPORTER_OTLP_QUEUE_SIZE"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIDisablePrometheusEndpoint,
+			Value:   false,
+			Usage:   "Don't serve the metrics on /metrics, when they are only pushed with OTLP, remote-write or StatsD.",
+			EnvVars: []string{"DCGM_EXPORTER_DISABLE_PROMETHEUS_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    CLIStatsDAddress,
+			Value:   "",
+			Usage:   "Address of a DogStatsD agent the metrics are written to every collect interval: host:port, udp://host:port or unixgram:///path/to/socket. Writing is disabled when empty.",
+			EnvVars: []string{"DCGM_EXPORTER_STATSD_ADDRESS"},
+		},
+		&cli.IntFlag{
+			Name:    CLIHealthStaleIntervals,
+			Value:   3,
+			Usage:   "Report the exporter as not ready on /healthz/ready when no collection succeeded within this number of collect intervals, and as not live on /healthz/live when no collection completed within it. Zero disables the check.",
+			EnvVars: []string{"DCGM_EXPORTER_HEALTH_STALE_INTERVALS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    CLIRemoteHETargets,
+			Usage:   "Remote hostengines to collect every collect interval, as a comma-separated list of host:port. Enables the multi-target mode, where the exporter doesn't connect to a local hostengine.",
+			EnvVars: []string{"DCGM_EXPORTER_REMOTE_HOSTENGINE_TARGETS"},
+		},
+		&cli.BoolFlag{
+			Name:    CLIProbe,
+			Value:   false,
+			Usage:   "Serve the metrics of any remote hostengine under /probe?target=host:port. Enables the multi-target mode, where the exporter doesn't connect to a local hostengine.",
+			EnvVars: []string{"DCGM_EXPORTER_PROBE"},
+		},
 	}
 
 	if runtime.GOOS == "linux" {
@@ -263,9 +445,54 @@ func NewApp(buildVersion ...string) *cli.App {
 		return action(c)
 	}
 
+	c.Commands = []*cli.Command{
+		{
+			Name:  "topology",
+			Usage: "Print the GPUs, GPU instances, NvSwitches, NvLinks and CPUs discovered by DCGM, and exit",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  CLITopologyFormat,
+					Value: "tree",
+					Usage: "Output format: json or tree",
+				},
+			},
+			Action: topologyAction,
+		},
+	}
+
 	return c
 }
 
+// topologyAction prints the discovered topology, using the flags of the main command to reach DCGM.
+func topologyAction(c *cli.Context) error {
+	format := c.String(CLITopologyFormat)
+	if format != "json" && format != "tree" {
+		return fmt.Errorf("invalid topology format '%s'; expected json or tree", format)
+	}
+
+	config, err := contextToConfig(c)
+	if err != nil {
+		return err
+	}
+
+	enableDebugLogging(config)
+
+	cleanupDCGM, err := initDCGM(config)
+	if err != nil {
+		return err
+	}
+	defer cleanupDCGM()
+
+	topology, err := dcgmexporter.DiscoverTopology(config)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		return topology.WriteJSON(c.App.Writer)
+	}
+	return topology.WriteTree(c.App.Writer)
+}
+
 func newOSWatcher(sigs ...os.Signal) chan os.Signal {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, sigs...)
@@ -289,8 +516,6 @@ func action(c *cli.Context) (err error) {
 }
 
 func startDCGMExporter(c *cli.Context, cancel context.CancelFunc) error {
-restart:
-
 	logrus.Info("Starting dcgm-exporter")
 
 	config, err := contextToConfig(c)
@@ -300,13 +525,26 @@ restart:
 
 	enableDebugLogging(config)
 
-	cleanupDCGM := initDCGM(config)
-	defer cleanupDCGM()
+	dcgmexporter.SetBuildVersion(c.App.Version)
 
-	logrus.Info("DCGM successfully initialized!")
+	if len(config.RemoteHETargets) > 0 || config.Probe {
+		return startMultiTargetExporter(config)
+	}
 
-	dcgm.FieldsInit()
-	defer dcgm.FieldsTerm()
+	// The exporter can start before a remote hostengine, until a signal stops it
+	connectCtx, stopConnecting := signal.NotifyContext(context.Background(),
+		syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	supervisor := dcgmexporter.NewHostengineSupervisor(config, func() (func(), error) {
+		return initDCGM(config)
+	})
+	err = supervisor.Connect(connectCtx)
+	stopConnecting()
+	if err != nil {
+		return err
+	}
+	defer supervisor.Close()
+
+	logrus.Info("DCGM successfully initialized!")
 
 	fillConfigMetricGroups(config)
 
@@ -330,36 +568,147 @@ restart:
 		logrus.Fatal(err)
 	}
 
-	cRegistry := dcgmexporter.NewRegistry()
+	defer dcgmexporter.CloseKubernetesCaches()
 
-	enableDCGMExpXIDErrorsCountCollector(cs, fieldEntityGroupTypeSystemInfo, hostname, config, cRegistry)
+	cRegistry := dcgmexporter.NewRegistry()
 
-	enableDCGMExpClockEventsCount(cs, fieldEntityGroupTypeSystemInfo, hostname, config, cRegistry)
+	err = registerExporterCollectors(cs, fieldEntityGroupTypeSystemInfo, hostname, config, cRegistry)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
 	defer func() {
 		cRegistry.Cleanup()
 	}()
 
-	ch := make(chan string, 10)
-
 	var wg sync.WaitGroup
 	stop := make(chan interface{})
 
-	wg.Add(1)
-	go pipeline.Run(ch, stop, &wg)
+	// The sinks get the DCGM_EXP metrics too, which are otherwise only served by the Prometheus endpoint
+	pipeline.SetSinkRegistry(cRegistry)
 
-	wg.Add(1)
+	var otlpExporter *dcgmexporter.OTLPExporter
+	if config.OTLPEndpoint != "" {
+		otlpExporter, err = dcgmexporter.NewOTLPExporter(config)
+		if err != nil {
+			return err
+		}
+		pipeline.AddSink(otlpExporter)
+	}
+
+	var statsdSink *dcgmexporter.StatsDSink
+	if config.StatsDAddress != "" {
+		statsdSink, err = dcgmexporter.NewStatsDSink(config.StatsDAddress)
+		if err != nil {
+			return err
+		}
+		pipeline.AddSink(statsdSink)
+	}
+
+	var server *dcgmexporter.MetricsServer
+	if config.NativeCollectors {
+		promRegistry, err := dcgmexporter.NewPrometheusRegistry(pipeline, cRegistry)
+		if err != nil {
+			return err
+		}
+
+		// Scrapes don't write to the sinks, which are written to every collect interval instead
+		if otlpExporter != nil || statsdSink != nil {
+			wg.Add(1)
+			go pipeline.Run(nil, stop, &wg)
+		}
+
+		server, cleanup, err = dcgmexporter.NewNativeMetricsServer(config, promRegistry)
+	} else {
+		ch := make(chan []*dto.MetricFamily, 10)
 
-	server, cleanup, err := dcgmexporter.NewMetricsServer(config, ch, cRegistry)
+		wg.Add(1)
+		go pipeline.Run(ch, stop, &wg)
+
+		server, cleanup, err = dcgmexporter.NewMetricsServer(config, ch, cRegistry)
+	}
 	defer cleanup()
 	if err != nil {
 		return err
 	}
 
+	server.RegisterAPI(pipeline)
+	server.RegisterHealthChecks(pipeline, config)
+
+	var writer *dcgmexporter.RemoteWriter
+	if config.RemoteWriteURL != "" {
+		writer, err = dcgmexporter.NewRemoteWriter(config, server, server.Collections())
+		if err != nil {
+			return err
+		}
+	}
+
+	wg.Add(1)
 	go server.Run(stop, &wg)
 
+	if writer != nil {
+		wg.Add(1)
+		go writer.Run(stop, &wg)
+	}
+
+	if otlpExporter != nil {
+		wg.Add(1)
+		go otlpExporter.Run(stop, &wg)
+	}
+
+	if statsdSink != nil {
+		wg.Add(1)
+		go statsdSink.Run(stop, &wg)
+	}
+
+	// The counters are reloaded when they change, and when the hostengine is reconnected to, which rebuilds
+	// the DCGM groups and field watches. Both are applied while the server keeps serving.
+	var countersMtx sync.Mutex
+	reload := func(next *dcgmexporter.CounterSet) error {
+		countersMtx.Lock()
+		defer countersMtx.Unlock()
+
+		if next == nil {
+			next = cs
+		}
+		err := dcgmexporter.WithDCGMConnection(func() error {
+			return reloadCounters(next, hostname, config, pipeline, cRegistry)
+		})
+		if err != nil {
+			return err
+		}
+		cs = next
+		return nil
+	}
+
+	watcher := dcgmexporter.NewCountersWatcher(config,
+		time.Duration(config.CountersReloadInterval)*time.Millisecond,
+		func(next *dcgmexporter.CounterSet) error {
+			appendLabelCounters(next)
+			return reload(next)
+		})
+
+	wg.Add(1)
+	go watcher.Run(stop, &wg)
+
+	if config.UseRemoteHE {
+		supervisor.OnReconnect(func() {
+			pipeline.Discard()
+			cRegistry.Discard()
+		}, func() error {
+			return reload(nil)
+		})
+
+		wg.Add(1)
+		go supervisor.Run(stop, &wg)
+	}
+
 	sigs := newOSWatcher(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
-	sig := <-sigs
+	for sig := <-sigs; sig == syscall.SIGHUP; sig = <-sigs {
+		logrus.Info("Received SIGHUP, checking the counters for changes")
+		watcher.Reload()
+	}
+
 	close(stop)
 	cancel()
 	err = dcgmexporter.WaitWithTimeout(&wg, time.Second*2)
@@ -367,47 +716,190 @@ restart:
 		logrus.Fatal(err)
 	}
 
-	if sig == syscall.SIGHUP {
-		goto restart
+	return nil
+}
+
+// startMultiTargetExporter serves the metrics of remote hostengines: the listed targets under /metrics, and any
+// target under /probe. The hostengines are connected to in turn, for each collection.
+func startMultiTargetExporter(config *dcgmexporter.Config) error {
+	logrus.Infof("Starting in multi-target mode; targets: %v, probe: %t", config.RemoteHETargets, config.Probe)
+
+	collector, err := dcgmexporter.NewTargetCollector(config)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan interface{})
+
+	ch := make(chan []*dto.MetricFamily, 10)
+	if len(config.RemoteHETargets) > 0 {
+		wg.Add(1)
+		go collector.Run(ch, stop, &wg)
+	}
+
+	server, cleanup, err := dcgmexporter.NewMetricsServer(config, ch, dcgmexporter.NewRegistry())
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+
+	if config.Probe {
+		server.RegisterProbe(collector)
+	}
+
+	wg.Add(1)
+	go server.Run(stop, &wg)
+
+	sigs := newOSWatcher(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	<-sigs
+
+	close(stop)
+	err = dcgmexporter.WaitWithTimeout(&wg, time.Second*2)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	return nil
+}
+
+// reloadCounters replaces the collectors of the pipeline and the registry with collectors of the new counter set.
+func reloadCounters(cs *dcgmexporter.CounterSet,
+	hostname string,
+	config *dcgmexporter.Config,
+	pipeline *dcgmexporter.MetricsPipeline,
+	cRegistry *dcgmexporter.Registry,
+) error {
+	fieldEntityGroupTypeSystemInfo := getFieldEntityGroupTypeSystemInfo(cs, config)
+
+	registry := dcgmexporter.NewRegistry()
+	err := registerExporterCollectors(cs, fieldEntityGroupTypeSystemInfo, hostname, config, registry)
+	if err != nil {
+		registry.Cleanup()
+		return err
+	}
+
+	err = pipeline.Reload(cs.DCGMCounters, dcgmexporter.NewDCGMCollector, fieldEntityGroupTypeSystemInfo)
+	if err != nil {
+		registry.Cleanup()
+		return err
+	}
+	cRegistry.Replace(registry)
+
+	return nil
+}
+
+// registerExporterCollectors registers the collectors of the enabled DCGM_EXP metrics.
+func registerExporterCollectors(cs *dcgmexporter.CounterSet,
+	fieldEntityGroupTypeSystemInfo *dcgmexporter.FieldEntityGroupTypeSystemInfo,
+	hostname string,
+	config *dcgmexporter.Config,
+	cRegistry *dcgmexporter.Registry,
+) error {
+	err := enableDCGMExpXIDErrorsCountCollector(cs, fieldEntityGroupTypeSystemInfo, hostname, config, cRegistry)
+	if err != nil {
+		return err
 	}
 
+	err = enableDCGMExpClockEventsCount(cs, fieldEntityGroupTypeSystemInfo, hostname, config, cRegistry)
+	if err != nil {
+		return err
+	}
+
+	err = enableDCGMExpTopologyInfoCollector(cs, hostname, config, cRegistry)
+	if err != nil {
+		return err
+	}
+
+	return enableDCGMExpGPUSharedPodsCollector(cs, fieldEntityGroupTypeSystemInfo, hostname, config, cRegistry)
+}
+
+func enableDCGMExpGPUSharedPodsCollector(cs *dcgmexporter.CounterSet, fieldEntityGroupTypeSystemInfo *dcgmexporter.FieldEntityGroupTypeSystemInfo, hostname string, config *dcgmexporter.Config, cRegistry *dcgmexporter.Registry) error {
+	if !dcgmexporter.IsDCGMExpGPUSharedPodsEnabled(cs.ExporterCounters) {
+		// Without the counter, the pods sharing a GPU wouldn't be exported at all
+		if config.Kubernetes && config.KubernetesSharedGPUs == dcgmexporter.SharedGPUsInfo {
+			return fmt.Errorf("%s=%s requires the %s counter", CLIKubernetesSharedGPUs,
+				dcgmexporter.SharedGPUsInfo, dcgmexporter.DCGMGPUSharedPods.String())
+		}
+		return nil
+	}
+
+	if !config.Kubernetes {
+		logrus.Warnf("The %s counter requires the Kubernetes mode; ignoring", dcgmexporter.DCGMGPUSharedPods.String())
+		return nil
+	}
+
+	item, exists := fieldEntityGroupTypeSystemInfo.Get(dcgm.FE_GPU)
+	if !exists {
+		return fmt.Errorf("%s collector cannot be initialized", dcgmexporter.DCGMGPUSharedPods.String())
+	}
+
+	sharedPodsCollector, err := dcgmexporter.NewSharedPodsCollector(cs.ExporterCounters, hostname, config, item)
+	if err != nil {
+		return err
+	}
+
+	cRegistry.Register(sharedPodsCollector)
+
+	logrus.Infof("%s collector initialized", dcgmexporter.DCGMGPUSharedPods.String())
 	return nil
 }
 
-func enableDCGMExpClockEventsCount(cs *dcgmexporter.CounterSet, fieldEntityGroupTypeSystemInfo *dcgmexporter.FieldEntityGroupTypeSystemInfo, hostname string, config *dcgmexporter.Config, cRegistry *dcgmexporter.Registry) {
+func enableDCGMExpTopologyInfoCollector(cs *dcgmexporter.CounterSet, hostname string, config *dcgmexporter.Config, cRegistry *dcgmexporter.Registry) error {
+	if dcgmexporter.IsDCGMExpTopologyInfoEnabled(cs.ExporterCounters) {
+		topology, err := dcgmexporter.DiscoverTopology(config)
+		if err != nil {
+			return err
+		}
+		topologyInfoCollector, err := dcgmexporter.NewTopologyInfoCollector(cs.ExporterCounters, hostname, config,
+			topology)
+		if err != nil {
+			return err
+		}
+
+		cRegistry.Register(topologyInfoCollector)
+
+		logrus.Info("Topology info collector initialized")
+	}
+	return nil
+}
+
+func enableDCGMExpClockEventsCount(cs *dcgmexporter.CounterSet, fieldEntityGroupTypeSystemInfo *dcgmexporter.FieldEntityGroupTypeSystemInfo, hostname string, config *dcgmexporter.Config, cRegistry *dcgmexporter.Registry) error {
 	if dcgmexporter.IsDCGMExpClockEventsCountEnabled(cs.ExporterCounters) {
 		item, exists := fieldEntityGroupTypeSystemInfo.Get(dcgm.FE_GPU)
 		if !exists {
-			logrus.Fatalf("%s collector cannot be initialized", dcgmexporter.DCGMClockEventsCount.String())
+			return fmt.Errorf("%s collector cannot be initialized", dcgmexporter.DCGMClockEventsCount.String())
 		}
 		clocksThrottleReasonsCollector, err := dcgmexporter.NewClockEventsCollector(
 			cs.ExporterCounters, hostname, config, item)
 		if err != nil {
-			logrus.Fatal(err)
+			return err
 		}
 
 		cRegistry.Register(clocksThrottleReasonsCollector)
 
 		logrus.Infof("%s collector initialized", dcgmexporter.DCGMClockEventsCount.String())
 	}
+	return nil
 }
 
-func enableDCGMExpXIDErrorsCountCollector(cs *dcgmexporter.CounterSet, fieldEntityGroupTypeSystemInfo *dcgmexporter.FieldEntityGroupTypeSystemInfo, hostname string, config *dcgmexporter.Config, cRegistry *dcgmexporter.Registry) {
+func enableDCGMExpXIDErrorsCountCollector(cs *dcgmexporter.CounterSet, fieldEntityGroupTypeSystemInfo *dcgmexporter.FieldEntityGroupTypeSystemInfo, hostname string, config *dcgmexporter.Config, cRegistry *dcgmexporter.Registry) error {
 	if dcgmexporter.IsDCGMExpXIDErrorsCountEnabled(cs.ExporterCounters) {
 		item, exists := fieldEntityGroupTypeSystemInfo.Get(dcgm.FE_GPU)
 		if !exists {
-			logrus.Fatalf("%s collector cannot be initialized", dcgmexporter.DCGMXIDErrorsCount.String())
+			return fmt.Errorf("%s collector cannot be initialized", dcgmexporter.DCGMXIDErrorsCount.String())
 		}
 
 		xidCollector, err := dcgmexporter.NewXIDCollector(cs.ExporterCounters, hostname, config, item)
 		if err != nil {
-			logrus.Fatal(err)
+			return err
 		}
 
 		cRegistry.Register(xidCollector)
 
 		logrus.Infof("%s collector initialized", dcgmexporter.DCGMXIDErrorsCount.String())
 	}
+	return nil
 }
 
 func getFieldEntityGroupTypeSystemInfo(cs *dcgmexporter.CounterSet, config *dcgmexporter.Config) *dcgmexporter.FieldEntityGroupTypeSystemInfo {
@@ -469,13 +961,18 @@ func getCounters(config *dcgmexporter.Config) *dcgmexporter.CounterSet {
 		logrus.Fatal(err)
 	}
 
-	// Copy labels from DCGM Counters to ExporterCounters
+	appendLabelCounters(cs)
+
+	return cs
+}
+
+// appendLabelCounters copies labels from DCGM Counters to ExporterCounters
+func appendLabelCounters(cs *dcgmexporter.CounterSet) {
 	for i := range cs.DCGMCounters {
 		if cs.DCGMCounters[i].PromType == "label" {
 			cs.ExporterCounters = append(cs.ExporterCounters, cs.DCGMCounters[i])
 		}
 	}
-	return cs
 }
 
 func fillConfigMetricGroups(config *dcgmexporter.Config) {
@@ -502,30 +999,19 @@ func enableDebugLogging(config *dcgmexporter.Config) {
 	logrus.WithField(dcgmexporter.LoggerDumpKey, fmt.Sprintf("%+v", config)).Debug("Loaded configuration")
 }
 
-func initDCGM(config *dcgmexporter.Config) func() {
+// initDCGM initializes DCGM, connected to the remote hostengine or to an embedded one.
+func initDCGM(config *dcgmexporter.Config) (func(), error) {
 	if config.UseRemoteHE {
 		logrus.Info("Attemping to connect to remote hostengine at ", config.RemoteHEInfo)
-		cleanup, err := dcgm.Init(dcgm.Standalone, config.RemoteHEInfo, "0")
-		if err != nil {
-			cleanup()
-			logrus.Fatal(err)
-		}
-		return cleanup
-	} else {
-
-		if config.EnableDCGMLog {
-			os.Setenv("__DCGM_DBG_FILE", "-")
-			os.Setenv("__DCGM_DBG_LVL", config.DCGMLogLevel)
-		}
-
-		cleanup, err := dcgm.Init(dcgm.Embedded)
-		if err != nil {
-			cleanup()
-			logrus.Fatal(err)
-		}
+		return dcgm.Init(dcgm.Standalone, config.RemoteHEInfo, "0")
+	}
 
-		return cleanup
+	if config.EnableDCGMLog {
+		os.Setenv("__DCGM_DBG_FILE", "-")
+		os.Setenv("__DCGM_DBG_LVL", config.DCGMLogLevel)
 	}
+
+	return dcgm.Init(dcgm.Embedded)
 }
 
 func parseDeviceOptions(devices string) (dcgmexporter.DeviceOptions, error) {
@@ -612,6 +1098,21 @@ func contextToConfig(c *cli.Context) (*dcgmexporter.Config, error) {
 		return nil, fmt.Errorf("invalid %s parameter value: %s", CLIDCGMLogLevel, dcgmLogLevel)
 	}
 
+	podMetadataSource := c.String(CLIPodMetadataSource)
+	if podMetadataSource != dcgmexporter.PodMetadataSourceAPIServer &&
+		podMetadataSource != dcgmexporter.PodMetadataSourceKubelet {
+		return nil, fmt.Errorf("invalid %s parameter value: %s", CLIPodMetadataSource, podMetadataSource)
+	}
+
+	sharedGPUs := c.String(CLIKubernetesSharedGPUs)
+	if sharedGPUs != dcgmexporter.SharedGPUsSeries && sharedGPUs != dcgmexporter.SharedGPUsInfo {
+		return nil, fmt.Errorf("invalid %s parameter value: %s", CLIKubernetesSharedGPUs, sharedGPUs)
+	}
+
+	if c.IsSet(CLIRemoteHEInfo) && (len(c.StringSlice(CLIRemoteHETargets)) > 0 || c.Bool(CLIProbe)) {
+		return nil, fmt.Errorf("%s cannot be used with %s or %s", CLIRemoteHEInfo, CLIRemoteHETargets, CLIProbe)
+	}
+
 	return &dcgmexporter.Config{
 		CollectorsFile:             c.String(CLIFieldsFile),
 		Address:                    c.String(CLIAddress),
@@ -639,5 +1140,31 @@ func contextToConfig(c *cli.Context) (*dcgmexporter.Config, error) {
 		PodResourcesKubeletSocket:  c.String(CLIPodResourcesKubeletSocket),
 		HPCJobMappingDir:           c.String(CLIHPCJobMappingDir),
 		NvidiaResourceNames:        c.StringSlice(CLINvidiaResourceNames),
+		KubernetesPodLabels:        c.StringSlice(CLIKubernetesPodLabels),
+		KubernetesPodAnnotations:   c.StringSlice(CLIKubernetesPodAnnotations),
+		KubernetesWorkloads:        c.Bool(CLIKubernetesWorkloads),
+		KubernetesSharedGPUs:       sharedGPUs,
+		PodMetadataSource:          podMetadataSource,
+		KubeletPodsURL:             c.String(CLIKubeletPodsURL),
+		KubeletCAFile:              c.String(CLIKubeletCAFile),
+		KubeletSkipTLSVerify:       c.Bool(CLIKubeletInsecureSkipVerify),
+		NativeCollectors:           c.Bool(CLINativeCollectors),
+		EnableOpenMetrics:          c.Bool(CLIEnableOpenMetrics),
+		EmitTimestamps:             c.Bool(CLIEmitTimestamps),
+		StaleIntervals:             c.Int(CLIStaleIntervals),
+		CountersReloadInterval:     c.Int(CLICountersReloadInterval),
+		RemoteWriteURL:             c.String(CLIRemoteWriteURL),
+		RemoteWriteConfigFile:      c.String(CLIRemoteWriteConfigFile),
+		RemoteWriteQueueSize:       c.Int(CLIRemoteWriteQueueSize),
+		OTLPEndpoint:               c.String(CLIOTLPEndpoint),
+		OTLPProtocol:               c.String(CLIOTLPProtocol),
+		OTLPInsecure:               c.Bool(CLIOTLPInsecure),
+		OTLPHeaders:                c.StringSlice(CLIOTLPHeaders),
+		OTLPQueueSize:              c.Int(CLIOTLPQueueSize),
+		DisablePrometheusEndpoint:  c.Bool(CLIDisablePrometheusEndpoint),
+		StatsDAddress:              c.String(CLIStatsDAddress),
+		HealthStaleIntervals:       c.Int(CLIHealthStaleIntervals),
+		RemoteHETargets:            c.StringSlice(CLIRemoteHETargets),
+		Probe:                      c.Bool(CLIProbe),
 	}, nil
 }
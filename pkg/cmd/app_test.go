@@ -180,7 +180,8 @@ func Test_getFieldEntityGroupTypeSystemInfo(t *testing.T) {
 		},
 	}
 
-	cleanupDCGM := initDCGM(config)
+	cleanupDCGM, err := initDCGM(config)
+	require.NoError(t, err)
 	defer cleanupDCGM()
 
 	for _, tt := range tests {
@@ -193,3 +194,19 @@ func Test_getFieldEntityGroupTypeSystemInfo(t *testing.T) {
 		})
 	}
 }
+
+func Test_enableDCGMExpGPUSharedPodsCollector(t *testing.T) {
+	cs := &dcgmexporter.CounterSet{}
+
+	err := enableDCGMExpGPUSharedPodsCollector(cs, nil, "", &dcgmexporter.Config{
+		Kubernetes:           true,
+		KubernetesSharedGPUs: dcgmexporter.SharedGPUsInfo,
+	}, dcgmexporter.NewRegistry())
+	assert.ErrorContains(t, err, "DCGM_EXP_GPU_SHARED_PODS")
+
+	err = enableDCGMExpGPUSharedPodsCollector(cs, nil, "", &dcgmexporter.Config{
+		Kubernetes:           true,
+		KubernetesSharedGPUs: dcgmexporter.SharedGPUsSeries,
+	}, dcgmexporter.NewRegistry())
+	assert.NoError(t, err)
+}
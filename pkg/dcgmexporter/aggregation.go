@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+)
+
+// watchedFieldGroup is a field group watched for the entities of a group.
+type watchedFieldGroup struct {
+	group      dcgm.GroupHandle
+	fieldGroup dcgm.FieldHandle
+}
+
+// sampleKey identifies the samples of a field of an entity.
+type sampleKey struct {
+	entity  dcgm.GroupEntityPair
+	fieldID uint
+}
+
+// windowSample is a numeric sample retained by DCGM.
+type windowSample struct {
+	ts    int64 // In microseconds
+	value float64
+}
+
+// windowSamples holds the numeric samples retained by DCGM over a window, by entity and field.
+type windowSamples map[sampleKey][]windowSample
+
+func (s windowSamples) values(key sampleKey) []float64 {
+	values := make([]float64, len(s[key]))
+	for i, sample := range s[key] {
+		values[i] = sample.value
+	}
+	return values
+}
+
+// getWindowSamples returns the samples of the field groups taken since the given time.
+func getWindowSamples(sources []watchedFieldGroup, since time.Time) (windowSamples, error) {
+	samples := windowSamples{}
+
+	for _, source := range sources {
+		values, _, err := dcgm.GetValuesSince(source.group, source.fieldGroup, since)
+		if err != nil {
+			return nil, fmt.Errorf("could not retrieve the samples since %s; err: %w", since, err)
+		}
+		samples.add(values)
+	}
+
+	return samples, nil
+}
+
+// add appends the numeric values to the samples. Blank values and values in error are skipped.
+func (s windowSamples) add(values []dcgm.FieldValue_v2) {
+	for _, val := range values {
+		if val.Status != 0 || (val.FieldType != dcgm.DCGM_FT_INT64 && val.FieldType != dcgm.DCGM_FT_DOUBLE) {
+			continue
+		}
+
+		v := ToString(dcgm.FieldValue_v1{
+			FieldId:   val.FieldId,
+			FieldType: val.FieldType,
+			Status:    val.Status,
+			Ts:        val.Ts,
+			Value:     val.Value,
+		})
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			// SkipDCGMValue
+			continue
+		}
+
+		key := sampleKey{
+			entity:  dcgm.GroupEntityPair{EntityGroupId: val.EntityGroupId, EntityId: val.EntityId},
+			fieldID: val.FieldId,
+		}
+		s[key] = append(s[key], windowSample{ts: val.Ts, value: f})
+	}
+}
+
+// aggregations are the statistics exported for an aggregated counter, next to its last value.
+var aggregations = []struct {
+	suffix string
+	help   string
+	value  func(samples []float64) float64
+}{
+	{suffix: "min", help: "minimum", value: func(samples []float64) float64 { return slices.Min(samples) }},
+	{suffix: "max", help: "maximum", value: func(samples []float64) float64 { return slices.Max(samples) }},
+	{suffix: "avg", help: "average", value: func(samples []float64) float64 {
+		var sum float64
+		for _, v := range samples {
+			sum += v
+		}
+		return sum / float64(len(samples))
+	}},
+}
+
+// aggregationCounter returns the counter of an aggregation of the counter.
+func aggregationCounter(counter Counter, suffix, help string) Counter {
+	counter.MetricName = counter.Name() + "_" + suffix
+	counter.Help = fmt.Sprintf("%s (%s over the collect interval)", counter.Help, help)
+	counter.Aggregate = false
+	return counter
+}
+
+// appendAggregations adds the min, max and average of the samples of the aggregated counters of an entity
+// to its metrics. When no sample was retained over the window, the aggregations are the last value.
+func appendAggregations(metrics MetricsByCounter, entity dcgm.GroupEntityPair, samples windowSamples) {
+	for counter, values := range metrics {
+		if !counter.Aggregate {
+			continue
+		}
+
+		entitySamples := samples.values(sampleKey{entity: entity, fieldID: uint(counter.FieldID)})
+
+		for _, aggregation := range aggregations {
+			aggregated := aggregationCounter(counter, aggregation.suffix, aggregation.help)
+			for _, m := range values {
+				if len(entitySamples) > 0 {
+					m.Value = strconv.FormatFloat(aggregation.value(entitySamples), 'f', -1, 64)
+				}
+				metrics[aggregated] = append(metrics[aggregated], m)
+			}
+		}
+	}
+}
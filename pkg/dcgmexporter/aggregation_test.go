@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func doubleFieldValue(entity dcgm.GroupEntityPair, fieldID uint, v float64) dcgm.FieldValue_v2 {
+	fv := dcgm.FieldValue_v2{
+		EntityGroupId: entity.EntityGroupId,
+		EntityId:      entity.EntityId,
+		FieldId:       fieldID,
+		FieldType:     dcgm.DCGM_FT_DOUBLE,
+	}
+	binary.NativeEndian.PutUint64(fv.Value[:], math.Float64bits(v))
+	return fv
+}
+
+func TestAppendAggregations(t *testing.T) {
+	gpu0 := dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU, EntityId: 0}
+	gpu1 := dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU, EntityId: 1}
+
+	power := Counter{FieldID: 155, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "gauge", Help: "Power draw.", Aggregate: true}
+	temp := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+
+	samples := windowSamples{}
+	samples.add([]dcgm.FieldValue_v2{
+		doubleFieldValue(gpu0, 155, 100),
+		doubleFieldValue(gpu0, 155, 300),
+		doubleFieldValue(gpu0, 155, 200),
+		doubleFieldValue(gpu1, 155, 999),
+		doubleFieldValue(gpu0, 155, dcgm.DCGM_FT_FP64_BLANK),
+	})
+
+	metrics := MetricsByCounter{
+		power: {{Counter: power, Value: "200.000000", GPU: "0"}},
+		temp:  {{Counter: temp, Value: "42", GPU: "0"}},
+	}
+	appendAggregations(metrics, gpu0, samples)
+
+	values := map[string]string{}
+	for counter, metrics := range metrics {
+		require.Len(t, metrics, 1)
+		values[counter.Name()] = metrics[0].Value
+	}
+	assert.Equal(t, map[string]string{
+		"DCGM_FI_DEV_POWER_USAGE":     "200.000000",
+		"DCGM_FI_DEV_POWER_USAGE_min": "100",
+		"DCGM_FI_DEV_POWER_USAGE_max": "300",
+		"DCGM_FI_DEV_POWER_USAGE_avg": "200",
+		"DCGM_FI_DEV_GPU_TEMP":        "42",
+	}, values)
+
+	assert.Contains(t, metrics, aggregationCounter(power, "max", "maximum"))
+	assert.Equal(t, "Power draw. (maximum over the collect interval)", aggregationCounter(power, "max", "maximum").Help)
+
+	// Without samples over the window, the aggregations are the last value
+	metrics = MetricsByCounter{
+		power: {{Counter: power, Value: "200", GPU: "2"}},
+	}
+	appendAggregations(metrics, dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU, EntityId: 2}, samples)
+	require.Len(t, metrics, 4)
+	for _, metrics := range metrics {
+		assert.Equal(t, "200", metrics[0].Value)
+	}
+}
@@ -0,0 +1,341 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// apiField is the latest value of a field of an entity. Numeric values are numbers, others strings.
+type apiField struct {
+	Value     any        `json:"value"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// apiValues are the latest field values of an entity, and the workloads they are attributed to.
+type apiValues struct {
+	Fields       map[string]apiField `json:"fields"`
+	Attributions []map[string]string `json:"attributions,omitempty"`
+}
+
+type apiGPUInstance struct {
+	TopologyGPUInstance
+	apiValues
+}
+
+type apiGPU struct {
+	GPU          uint             `json:"gpu"`
+	UUID         string           `json:"uuid"`
+	PCIBusID     string           `json:"pciBusId"`
+	Device       string           `json:"device"`
+	ModelName    string           `json:"modelName"`
+	MigEnabled   bool             `json:"migEnabled"`
+	GPUInstances []apiGPUInstance `json:"gpuInstances"`
+	apiValues
+}
+
+type apiLink struct {
+	TopologyNvLink
+	apiValues
+}
+
+type apiSwitch struct {
+	Switch uint      `json:"nvswitch"`
+	Links  []apiLink `json:"nvlinks"`
+	apiValues
+}
+
+type apiCore struct {
+	Core uint `json:"core"`
+	apiValues
+}
+
+type apiCPU struct {
+	CPU   uint      `json:"cpu"`
+	Cores []apiCore `json:"cores"`
+	apiValues
+}
+
+// entitySnapshot is the system info and the last collected metrics of an entity type.
+type entitySnapshot struct {
+	sysInfo SystemInfo
+	metrics MetricsByCounter
+}
+
+// snapshot returns the system info and the last good metrics of the entity types of the pipeline.
+func (m *MetricsPipeline) snapshot() map[string]entitySnapshot {
+	m.collectorsMtx.RLock()
+	collectors := m.entityCollectors()
+	m.collectorsMtx.RUnlock()
+
+	m.lastGoodMtx.Lock()
+	defer m.lastGoodMtx.Unlock()
+
+	res := map[string]entitySnapshot{}
+	for _, c := range collectors {
+		res[c.entity] = entitySnapshot{sysInfo: c.sysInfo, metrics: m.lastGood[c.entity]}
+	}
+	return res
+}
+
+// entityValues indexes the field values of the metrics of an entity type by entity.
+func entityValues(metrics MetricsByCounter, key func(m Metric) string) map[string]*apiValues {
+	res := map[string]*apiValues{}
+	for _, counter := range sortedCounters(metrics) {
+		if counter.isDistribution() {
+			continue
+		}
+
+		for _, m := range metrics[counter] {
+			values, exists := res[key(m)]
+			if !exists {
+				values = &apiValues{Fields: map[string]apiField{}}
+				res[key(m)] = values
+			}
+
+			if len(m.Attributes) > 0 && !containsAttributes(values.Attributions, m.Attributes) {
+				values.Attributions = append(values.Attributions, maps.Clone(m.Attributes))
+			}
+
+			// Metrics duplicated per workload have the same value
+			if _, exists := values.Fields[counter.Name()]; exists {
+				continue
+			}
+
+			field := apiField{Value: m.Value}
+			if value, err := strconv.ParseFloat(m.Value, 64); err == nil && counter.PromType != "label" {
+				if counter.Scale != 0 {
+					value *= counter.Scale
+				}
+				field.Value = value
+			}
+			if !m.Timestamp.IsZero() {
+				field.Timestamp = &m.Timestamp
+			}
+			values.Fields[counter.Name()] = field
+		}
+	}
+	return res
+}
+
+func containsAttributes(attributions []map[string]string, attributes map[string]string) bool {
+	for _, a := range attributions {
+		if reflect.DeepEqual(a, attributes) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedCounters returns the counters of the metrics in a stable order, so that the attributions are too.
+func sortedCounters(metrics MetricsByCounter) []Counter {
+	byName := map[string]Counter{}
+	for counter := range metrics {
+		byName[counter.Name()] = counter
+	}
+
+	var res []Counter
+	for _, name := range sortedKeys(byName) {
+		res = append(res, byName[name])
+	}
+	return res
+}
+
+// valuesOf returns the values of the entity, or empty values when none were collected.
+func valuesOf(values map[string]*apiValues, key string) apiValues {
+	if v, exists := values[key]; exists {
+		return *v
+	}
+	return apiValues{Fields: map[string]apiField{}}
+}
+
+// snapshotTopology returns the topology of the entity types of the pipeline. The NvSwitches are the ones of
+// the switch or the link collector, the CPUs the ones of the CPU or the core collector.
+func snapshotTopology(snapshots map[string]entitySnapshot) Topology {
+	sysInfo := func(entities ...string) *SystemInfo {
+		for _, entity := range entities {
+			if snapshot, exists := snapshots[entity]; exists {
+				return &snapshot.sysInfo
+			}
+		}
+		return nil
+	}
+
+	return NewTopology(sysInfo("gpu"), sysInfo("switch", "link"), sysInfo("cpu", "cpu_core"))
+}
+
+func apiGPUs(snapshots map[string]entitySnapshot) []apiGPU {
+	values := entityValues(snapshots["gpu"].metrics, func(m Metric) string {
+		return m.GPU + "/" + m.GPUInstanceID
+	})
+
+	res := []apiGPU{}
+	for _, gpu := range snapshotTopology(snapshots).GPUs {
+		g := apiGPU{
+			GPU:          gpu.GPU,
+			UUID:         gpu.UUID,
+			PCIBusID:     gpu.PCIBusID,
+			Device:       gpu.Device,
+			ModelName:    gpu.ModelName,
+			MigEnabled:   gpu.MigEnabled,
+			GPUInstances: []apiGPUInstance{},
+			apiValues:    valuesOf(values, fmt.Sprintf("%d/", gpu.GPU)),
+		}
+		for _, gi := range gpu.GPUInstances {
+			g.GPUInstances = append(g.GPUInstances, apiGPUInstance{
+				TopologyGPUInstance: gi,
+				apiValues:           valuesOf(values, fmt.Sprintf("%d/%d", gpu.GPU, gi.ID)),
+			})
+		}
+		res = append(res, g)
+	}
+	return res
+}
+
+func apiSwitches(snapshots map[string]entitySnapshot) []apiSwitch {
+	switchValues := entityValues(snapshots["switch"].metrics, func(m Metric) string { return m.GPU })
+	linkValues := entityValues(snapshots["link"].metrics, func(m Metric) string {
+		return m.GPUDevice + "/" + m.GPU
+	})
+
+	res := []apiSwitch{}
+	for _, sw := range snapshotTopology(snapshots).Switches {
+		s := apiSwitch{
+			Switch:    sw.Switch,
+			Links:     []apiLink{},
+			apiValues: valuesOf(switchValues, fmt.Sprint(sw.Switch)),
+		}
+		for _, link := range sw.NvLinks {
+			s.Links = append(s.Links, apiLink{
+				TopologyNvLink: link,
+				apiValues:      valuesOf(linkValues, fmt.Sprintf("nvswitch%d/%d", sw.Switch, link.Link)),
+			})
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+func apiCPUs(snapshots map[string]entitySnapshot) []apiCPU {
+	cpuValues := entityValues(snapshots["cpu"].metrics, func(m Metric) string { return m.GPU })
+	coreValues := entityValues(snapshots["cpu_core"].metrics, func(m Metric) string {
+		return m.GPUDevice + "/" + m.GPU
+	})
+
+	res := []apiCPU{}
+	for _, cpu := range snapshotTopology(snapshots).CPUs {
+		c := apiCPU{
+			CPU:       cpu.CPU,
+			Cores:     []apiCore{},
+			apiValues: valuesOf(cpuValues, fmt.Sprint(cpu.CPU)),
+		}
+		for _, core := range cpu.Cores {
+			c.Cores = append(c.Cores, apiCore{
+				Core:      core,
+				apiValues: valuesOf(coreValues, fmt.Sprintf("%d/%d", cpu.CPU, core)),
+			})
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// apiHandler serves the topology of the entities and their latest field values as JSON.
+type apiHandler struct {
+	pipeline *MetricsPipeline
+}
+
+// RegisterAPI serves the JSON API of the pipeline under /api/v1.
+func (s *MetricsServer) RegisterAPI(pipeline *MetricsPipeline) {
+	h := &apiHandler{pipeline: pipeline}
+
+	api := s.router.PathPrefix("/api/v1").Methods(http.MethodGet).Subrouter()
+	api.HandleFunc("/gpus", h.gpus)
+	api.HandleFunc("/gpus/{id}", h.gpu)
+	api.HandleFunc("/switches", h.switches)
+	api.HandleFunc("/switches/{id}", h.nvswitch)
+	api.HandleFunc("/cpus", h.cpus)
+	api.HandleFunc("/cpus/{id}", h.cpu)
+}
+
+func (h *apiHandler) gpus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, apiGPUs(h.pipeline.snapshot()))
+}
+
+// gpu serves a GPU given by index or UUID.
+func (h *apiHandler) gpu(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for _, gpu := range apiGPUs(h.pipeline.snapshot()) {
+		if fmt.Sprint(gpu.GPU) == id || gpu.UUID == id {
+			writeJSON(w, http.StatusOK, gpu)
+			return
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, fmt.Sprintf("GPU '%s' not found", id))
+}
+
+func (h *apiHandler) switches(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, apiSwitches(h.pipeline.snapshot()))
+}
+
+func (h *apiHandler) nvswitch(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for _, s := range apiSwitches(h.pipeline.snapshot()) {
+		if fmt.Sprint(s.Switch) == id {
+			writeJSON(w, http.StatusOK, s)
+			return
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, fmt.Sprintf("NvSwitch '%s' not found", id))
+}
+
+func (h *apiHandler) cpus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, apiCPUs(h.pipeline.snapshot()))
+}
+
+func (h *apiHandler) cpu(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	for _, c := range apiCPUs(h.pipeline.snapshot()) {
+		if fmt.Sprint(c.CPU) == id {
+			writeJSON(w, http.StatusOK, c)
+			return
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, fmt.Sprintf("CPU '%s' not found", id))
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Error("Failed to write response.")
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAPIServer(t *testing.T) *MetricsServer {
+	t.Helper()
+
+	gpuSysInfo := SystemInfo{GPUCount: 2, InfoType: dcgm.FE_GPU}
+	gpuSysInfo.GPUs[0] = GPUInfo{
+		DeviceInfo: dcgm.Device{GPU: 0, UUID: "GPU-0", PCI: dcgm.PCIInfo{BusID: "00000000:01:00.0"},
+			Identifiers: dcgm.DeviceIdentifiers{Model: "NVIDIA H100"}},
+	}
+	gpuSysInfo.GPUs[1] = GPUInfo{
+		DeviceInfo: dcgm.Device{GPU: 1, UUID: "GPU-1", Identifiers: dcgm.DeviceIdentifiers{Model: "NVIDIA H100"}},
+		MigEnabled: true,
+		GPUInstances: []GPUInstanceInfo{{
+			Info:        dcgm.MigEntityInfo{NvmlInstanceId: 3},
+			ProfileName: "1g.10gb",
+			EntityId:    12,
+			ComputeInstances: []ComputeInstanceInfo{
+				{InstanceInfo: dcgm.MigEntityInfo{NvmlComputeInstanceId: 0}, ProfileName: "1c.1g.10gb", EntityId: 20},
+			},
+		}},
+	}
+	switchSysInfo := SystemInfo{InfoType: dcgm.FE_SWITCH, Switches: []SwitchInfo{{
+		EntityId: 0,
+		NvLinks:  []dcgm.NvLinkStatus{{ParentId: 0, ParentType: dcgm.FE_SWITCH, State: dcgm.LS_UP, Index: 5}},
+	}}}
+
+	p := &MetricsPipeline{
+		config:          &Config{},
+		gpuCollector:    &DCGMCollector{SysInfo: gpuSysInfo},
+		switchCollector: &DCGMCollector{SysInfo: switchSysInfo},
+	}
+
+	temp := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	driver := Counter{FieldID: 1, FieldName: "DCGM_FI_DRIVER_VERSION", PromType: "label"}
+	util := Counter{FieldID: 1001, FieldName: "DCGM_FI_PROF_GR_ENGINE_ACTIVE", PromType: "gauge"}
+	switchTemp := Counter{FieldID: 701, FieldName: "DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT", PromType: "gauge"}
+
+	sampled := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	p.setLastGoodMetrics("gpu", MetricsByCounter{
+		temp: {
+			{Counter: temp, Value: "45", GPU: "0", Timestamp: sampled,
+				Attributes: map[string]string{"pod": "trainer", "namespace": "ml", "container": "main"}},
+			{Counter: temp, Value: "50", GPU: "1"},
+		},
+		driver: {{Counter: driver, Value: "550.54.15", GPU: "0"}},
+		util: {
+			{Counter: util, Value: "0.5", GPU: "1", GPUInstanceID: "3",
+				Attributes: map[string]string{"hpc_job": "1"}},
+			{Counter: util, Value: "0.5", GPU: "1", GPUInstanceID: "3",
+				Attributes: map[string]string{"hpc_job": "2"}},
+		},
+	})
+	p.setLastGoodMetrics("switch", MetricsByCounter{
+		switchTemp: {{Counter: switchTemp, Value: "60", GPU: "0"}},
+	})
+
+	s, _, err := NewMetricsServer(&Config{}, nil, NewRegistry())
+	require.NoError(t, err)
+	s.RegisterAPI(p)
+	return s
+}
+
+func getAPI(t *testing.T, s *MetricsServer, path string, v any) int {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	return rec.Code
+}
+
+func TestAPI_GPUs(t *testing.T) {
+	s := testAPIServer(t)
+
+	var gpus []apiGPU
+	require.Equal(t, http.StatusOK, getAPI(t, s, "/api/v1/gpus", &gpus))
+	require.Len(t, gpus, 2)
+
+	gpu0 := gpus[0]
+	assert.Equal(t, "GPU-0", gpu0.UUID)
+	assert.Equal(t, "00000000:01:00.0", gpu0.PCIBusID)
+	assert.Equal(t, "nvidia0", gpu0.Device)
+	assert.Equal(t, "NVIDIA H100", gpu0.ModelName)
+	assert.Equal(t, float64(45), gpu0.Fields["DCGM_FI_DEV_GPU_TEMP"].Value)
+	require.NotNil(t, gpu0.Fields["DCGM_FI_DEV_GPU_TEMP"].Timestamp)
+	assert.True(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Equal(*gpu0.Fields["DCGM_FI_DEV_GPU_TEMP"].Timestamp))
+	assert.Equal(t, "550.54.15", gpu0.Fields["DCGM_FI_DRIVER_VERSION"].Value)
+	assert.Equal(t, []map[string]string{{"pod": "trainer", "namespace": "ml", "container": "main"}},
+		gpu0.Attributions)
+	assert.Empty(t, gpu0.GPUInstances)
+
+	gpu1 := gpus[1]
+	assert.True(t, gpu1.MigEnabled)
+	assert.Equal(t, float64(50), gpu1.Fields["DCGM_FI_DEV_GPU_TEMP"].Value)
+	require.Len(t, gpu1.GPUInstances, 1)
+	gi := gpu1.GPUInstances[0]
+	assert.Equal(t, uint(3), gi.ID)
+	assert.Equal(t, uint(12), gi.EntityID)
+	assert.Equal(t, "1g.10gb", gi.Profile)
+	assert.Equal(t, []TopologyComputeInstance{{ID: 0, EntityID: 20, Profile: "1c.1g.10gb"}}, gi.ComputeInstances)
+	assert.Equal(t, float64(0.5), gi.Fields["DCGM_FI_PROF_GR_ENGINE_ACTIVE"].Value)
+	assert.Equal(t, []map[string]string{{"hpc_job": "1"}, {"hpc_job": "2"}}, gi.Attributions)
+}
+
+func TestAPI_GPU(t *testing.T) {
+	s := testAPIServer(t)
+
+	var gpu apiGPU
+	require.Equal(t, http.StatusOK, getAPI(t, s, "/api/v1/gpus/GPU-1", &gpu))
+	assert.Equal(t, uint(1), gpu.GPU)
+
+	require.Equal(t, http.StatusOK, getAPI(t, s, "/api/v1/gpus/0", &gpu))
+	assert.Equal(t, "GPU-0", gpu.UUID)
+
+	var apiErr map[string]string
+	require.Equal(t, http.StatusNotFound, getAPI(t, s, "/api/v1/gpus/7", &apiErr))
+	assert.Equal(t, "GPU '7' not found", apiErr["error"])
+}
+
+func TestAPI_Switches(t *testing.T) {
+	s := testAPIServer(t)
+
+	var switches []apiSwitch
+	require.Equal(t, http.StatusOK, getAPI(t, s, "/api/v1/switches", &switches))
+	require.Len(t, switches, 1)
+	assert.Equal(t, float64(60), switches[0].Fields["DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT"].Value)
+	require.Len(t, switches[0].Links, 1)
+	assert.Equal(t, uint(5), switches[0].Links[0].Link)
+	assert.Equal(t, "up", switches[0].Links[0].State)
+	assert.Empty(t, switches[0].Links[0].Fields)
+
+	// No CPU is monitored
+	var cpus []apiCPU
+	require.Equal(t, http.StatusOK, getAPI(t, s, "/api/v1/cpus", &cpus))
+	assert.Empty(t, cpus)
+}
@@ -59,4 +59,30 @@ type Config struct {
 	PodResourcesKubeletSocket  string
 	HPCJobMappingDir           string
 	NvidiaResourceNames        []string
+	KubernetesPodLabels        []string
+	KubernetesPodAnnotations   []string
+	KubernetesWorkloads        bool
+	KubernetesSharedGPUs       string
+	PodMetadataSource          string
+	KubeletPodsURL             string
+	KubeletCAFile              string
+	KubeletSkipTLSVerify       bool
+	NativeCollectors           bool
+	EnableOpenMetrics          bool
+	EmitTimestamps             bool
+	StaleIntervals             int
+	CountersReloadInterval     int
+	RemoteWriteURL             string
+	RemoteWriteConfigFile      string
+	RemoteWriteQueueSize       int
+	OTLPEndpoint               string
+	OTLPProtocol               string
+	OTLPInsecure               bool
+	OTLPHeaders                []string
+	OTLPQueueSize              int
+	DisablePrometheusEndpoint  bool
+	StatsDAddress              string
+	HealthStaleIntervals       int
+	RemoteHETargets            []string
+	Probe                      bool
 }
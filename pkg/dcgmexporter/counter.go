@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+)
+
+// EntityTypes is a set of DCGM entity types.
+type EntityTypes uint32
+
+// entityTypeNames are the names of the entity types in the counters file.
+var entityTypeNames = map[string]dcgm.Field_Entity_Group{
+	"gpu":      dcgm.FE_GPU,
+	"switch":   dcgm.FE_SWITCH,
+	"link":     dcgm.FE_LINK,
+	"cpu":      dcgm.FE_CPU,
+	"cpu_core": dcgm.FE_CPU_CORE,
+}
+
+func NewEntityTypes(entityTypes ...dcgm.Field_Entity_Group) EntityTypes {
+	var res EntityTypes
+	for _, entityType := range entityTypes {
+		res |= 1 << entityType
+	}
+	return res
+}
+
+func parseEntityTypes(names []string) (EntityTypes, error) {
+	var res EntityTypes
+	for _, name := range names {
+		entityType, ok := entityTypeNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown entity type '%s'", name)
+		}
+		res |= NewEntityTypes(entityType)
+	}
+	return res, nil
+}
+
+func (e EntityTypes) Contains(entityType dcgm.Field_Entity_Group) bool {
+	return e&NewEntityTypes(entityType) != 0
+}
+
+// AppliesTo returns true when the counter is collected for the entity type.
+func (c Counter) AppliesTo(entityType dcgm.Field_Entity_Group) bool {
+	return c.EntityTypes == 0 || c.EntityTypes.Contains(entityType)
+}
+
+// Name returns the name of the metric exposed for the counter.
+func (c Counter) Name() string {
+	if c.MetricName != "" {
+		return c.MetricName
+	}
+	return c.FieldName
+}
+
+// decodedStaticLabels and decodedFloats map the encoded static labels, buckets and quantiles
+// of the counters to their decoded value. They are filled when the counters are loaded, so
+// the metrics don't decode them on every collection, and cleared when the counters are reloaded.
+var (
+	decodedStaticLabels sync.Map // map[string]map[string]string
+	decodedFloats       sync.Map // map[string][]float64
+)
+
+// clearDecodedOptions forgets the decoded options, so that the options of the counters removed by a reload
+// aren't kept forever. The options of the remaining counters are decoded again the next time they are read.
+func clearDecodedOptions() {
+	for _, decoded := range []*sync.Map{&decodedStaticLabels, &decodedFloats} {
+		decoded.Range(func(key, _ any) bool {
+			decoded.Delete(key)
+			return true
+		})
+	}
+}
+
+// StaticLabels returns the static labels added to the metrics of the counter. The returned map
+// is shared by the counters with the same labels and must not be modified.
+func (c Counter) StaticLabels() map[string]string {
+	if c.staticLabels == "" {
+		return nil
+	}
+
+	if labels, ok := decodedStaticLabels.Load(c.staticLabels); ok {
+		return labels.(map[string]string)
+	}
+
+	var labels map[string]string
+	// The labels were encoded by encodeStaticLabels, decoding them can't fail
+	_ = json.Unmarshal([]byte(c.staticLabels), &labels)
+	decodedStaticLabels.Store(c.staticLabels, labels)
+	return labels
+}
+
+// WithStaticLabels returns a copy of the counter with the given static labels.
+func (c Counter) WithStaticLabels(labels map[string]string) Counter {
+	c.staticLabels = encodeStaticLabels(labels)
+	if c.staticLabels != "" {
+		decodedStaticLabels.LoadOrStore(c.staticLabels, maps.Clone(labels))
+	}
+	return c
+}
+
+// Buckets returns the bucket upper bounds of a histogram counter.
+func (c Counter) Buckets() []float64 {
+	return loadFloats(c.buckets)
+}
+
+// WithBuckets returns a copy of the counter with the given histogram bucket upper bounds.
+func (c Counter) WithBuckets(buckets []float64) Counter {
+	c.buckets = storeFloats(buckets)
+	return c
+}
+
+// Quantiles returns the quantiles of a summary counter.
+func (c Counter) Quantiles() []float64 {
+	return loadFloats(c.quantiles)
+}
+
+// WithQuantiles returns a copy of the counter with the given summary quantiles.
+func (c Counter) WithQuantiles(quantiles []float64) Counter {
+	c.quantiles = storeFloats(quantiles)
+	return c
+}
+
+// isDistribution returns true when the samples of the counter are exported as a histogram or a summary.
+func (c Counter) isDistribution() bool {
+	return c.PromType == "histogram" || c.PromType == "summary"
+}
+
+// retainsSamples returns true when the counter is computed from the samples over the collect interval.
+func (c Counter) retainsSamples() bool {
+	return c.Aggregate || c.isDistribution()
+}
+
+// storeFloats encodes the values and records them in decodedFloats.
+func storeFloats(values []float64) string {
+	s := encodeFloats(values)
+	if s != "" {
+		decodedFloats.LoadOrStore(s, slices.Clone(values))
+	}
+	return s
+}
+
+// loadFloats returns the decoded values, with their capacity clipped so that appending to them
+// doesn't modify the shared slice.
+func loadFloats(s string) []float64 {
+	if s == "" {
+		return nil
+	}
+
+	if values, ok := decodedFloats.Load(s); ok {
+		return slices.Clip(values.([]float64))
+	}
+
+	values := decodeFloats(s)
+	decodedFloats.Store(s, values)
+	return slices.Clip(values)
+}
+
+func encodeFloats(values []float64) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+func decodeFloats(s string) []float64 {
+	if s == "" {
+		return nil
+	}
+
+	var values []float64
+	for _, v := range strings.Split(s, ",") {
+		// The values were encoded by encodeFloats, parsing them can't fail
+		f, _ := strconv.ParseFloat(v, 64)
+		values = append(values, f)
+	}
+	return values
+}
+
+// encodeStaticLabels encodes the labels as a JSON object. Keys are sorted, so equal
+// label sets are encoded identically.
+func encodeStaticLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	// A map of strings always marshals
+	b, _ := json.Marshal(labels)
+	return string(b)
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter_DecodedOptions(t *testing.T) {
+	labels := map[string]string{"team": "ml"}
+	counter := Counter{FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "histogram"}.
+		WithStaticLabels(labels).
+		WithBuckets([]float64{100, 200}).
+		WithQuantiles([]float64{0.5, 0.9})
+
+	// Modifying the options given to the counter doesn't modify the counter
+	labels["team"] = "infra"
+
+	assert.Equal(t, map[string]string{"team": "ml"}, counter.StaticLabels())
+	assert.Equal(t, []float64{100, 200}, counter.Buckets())
+	assert.Equal(t, []float64{0.5, 0.9}, counter.Quantiles())
+
+	// The options are decoded when the counter is loaded, not when they are read
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = counter.StaticLabels()
+		_ = counter.Buckets()
+		_ = counter.Quantiles()
+	})
+	assert.Zero(t, allocs)
+
+	// Appending to the returned buckets doesn't modify the buckets of the counter
+	buckets := append(counter.Buckets(), 300)
+	assert.Equal(t, []float64{100, 200, 300}, buckets)
+	assert.Equal(t, []float64{100, 200}, counter.Buckets())
+
+	// Equal options give equal counters
+	other := Counter{FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "histogram"}.
+		WithStaticLabels(map[string]string{"team": "ml"}).
+		WithBuckets([]float64{100, 200}).
+		WithQuantiles([]float64{0.5, 0.9})
+	assert.Equal(t, counter, other)
+
+	// The decoded options are cleared on reloads, and decoded again when read
+	clearDecodedOptions()
+	_, exists := decodedFloats.Load("100,200")
+	assert.False(t, exists)
+	assert.Equal(t, map[string]string{"team": "ml"}, counter.StaticLabels())
+	assert.Equal(t, []float64{100, 200}, counter.Buckets())
+	_, exists = decodedFloats.Load("100,200")
+	assert.True(t, exists)
+}
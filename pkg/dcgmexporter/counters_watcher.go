@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// CountersWatcher watches the source of the counters, and calls onChange with the new counter set when
+// its contents change. The ConfigMap is watched through the Kubernetes API, the counters file is polled.
+type CountersWatcher struct {
+	config   *Config
+	interval time.Duration
+	onChange func(*CounterSet) error
+	trigger  chan struct{}
+	source   counterSource // Contents of the source when it was last read
+}
+
+func NewCountersWatcher(c *Config, interval time.Duration, onChange func(*CounterSet) error) *CountersWatcher {
+	source, err := readCounterSource(c)
+	if err != nil {
+		logrus.WithError(err).Warn("Cannot read the counters to watch")
+	} else {
+		configReloadSuccess.Set(1)
+	}
+
+	return &CountersWatcher{
+		config:   c,
+		interval: interval,
+		onChange: onChange,
+		trigger:  make(chan struct{}, 1),
+		source:   source,
+	}
+}
+
+// Reload makes the watcher check the counters file immediately. Changes of the ConfigMap are always
+// applied as soon as they are observed.
+func (w *CountersWatcher) Reload() {
+	select {
+	case w.trigger <- struct{}{}:
+	default:
+		// A check is already pending
+	}
+}
+
+func (w *CountersWatcher) Run(stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if w.config.ConfigMapData != undefinedConfigMapData {
+		client, err := getKubeClient()
+		if err != nil {
+			logrus.WithError(err).Error("Cannot watch the counters ConfigMap")
+			return
+		}
+		w.watchConfigMap(client, stop)
+		return
+	}
+
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		t := time.NewTicker(w.interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick:
+			w.poll()
+		case <-w.trigger:
+			w.poll()
+		}
+	}
+}
+
+func (w *CountersWatcher) poll() {
+	source, err := readCounterSource(w.config)
+	if err != nil {
+		logrus.WithError(err).Warn("Cannot read the counters; keeping the current counters")
+		return
+	}
+
+	w.apply(source)
+}
+
+// watchConfigMap applies the changes of the ConfigMap until stop is closed.
+func (w *CountersWatcher) watchConfigMap(client kubernetes.Interface, stop chan interface{}) {
+	namespace, name, err := parseConfigMapData(w.config.ConfigMapData)
+	if err != nil {
+		logrus.WithError(err).Error("Cannot watch the counters ConfigMap")
+		return
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+
+	onConfigMap := func(obj interface{}) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok || cm.Name != name {
+			return
+		}
+
+		records, err := configMapRecords(cm, w.config.ConfigMapData)
+		if err != nil {
+			logrus.WithError(err).Error("Invalid counters ConfigMap; keeping the current counters")
+			configReloadSuccess.Set(0)
+			return
+		}
+
+		w.apply(counterSource{records: records})
+	}
+
+	_, err = factory.Core().V1().ConfigMaps().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: onConfigMap,
+		UpdateFunc: func(_, obj interface{}) {
+			onConfigMap(obj)
+		},
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Cannot watch the counters ConfigMap")
+		return
+	}
+
+	done := make(chan struct{})
+	factory.Start(done)
+
+	logrus.Infof("Watching the counters ConfigMap '%s'", w.config.ConfigMapData)
+
+	<-stop
+	close(done)
+	factory.Shutdown()
+}
+
+// apply reloads the counters when the source differs from the current one. Invalid counters are ignored.
+func (w *CountersWatcher) apply(source counterSource) {
+	if reflect.DeepEqual(source, w.source) {
+		return
+	}
+	w.source = source
+
+	logrus.Info("Counters changed, reloading")
+
+	cs, err := source.extract(w.config)
+	if err != nil {
+		logrus.WithError(err).Error("Invalid counters; keeping the current counters")
+		configReloadSuccess.Set(0)
+		return
+	}
+
+	if err := w.onChange(cs); err != nil {
+		logrus.WithError(err).Error("Failed to reload the counters")
+		configReloadSuccess.Set(0)
+		return
+	}
+
+	configReloadSuccess.Set(1)
+	logrus.Info("Counters reloaded")
+}
+
+func cloneRecords(records [][]string) [][]string {
+	res := make([][]string, len(records))
+	for i, record := range records {
+		res[i] = slices.Clone(record)
+	}
+	return res
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCountersWatcher_Poll(t *testing.T) {
+	f, err := os.CreateTemp("", "counters.*.csv")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	writeCounters := func(content string) {
+		require.NoError(t, f.Truncate(0))
+		_, err := f.WriteAt([]byte(content), 0)
+		require.NoError(t, err)
+	}
+
+	writeCounters("DCGM_FI_DEV_GPU_TEMP, gauge, GPU temperature (in C).\n")
+
+	var reloaded []*CounterSet
+	onChangeErr := error(nil)
+	config := &Config{ConfigMapData: undefinedConfigMapData, CollectorsFile: f.Name()}
+	watcher := NewCountersWatcher(config, 0, func(cs *CounterSet) error {
+		reloaded = append(reloaded, cs)
+		return onChangeErr
+	})
+
+	// Unchanged counters aren't reloaded
+	watcher.poll()
+	require.Empty(t, reloaded)
+
+	writeCounters("DCGM_FI_DEV_GPU_TEMP, gauge, GPU temperature (in C).\n" +
+		"DCGM_FI_DEV_POWER_USAGE, gauge, Power draw (in W).\n")
+	watcher.poll()
+	require.Len(t, reloaded, 1)
+	require.Len(t, reloaded[0].DCGMCounters, 2)
+	assert.Equal(t, "DCGM_FI_DEV_POWER_USAGE", reloaded[0].DCGMCounters[1].FieldName)
+
+	// The records are compared as read, not as trimmed by extractCounters
+	watcher.poll()
+	require.Len(t, reloaded, 1)
+
+	// Invalid counters are ignored
+	writeCounters("DCGM_FI_DEV_GPU_TEMP, not-a-type, GPU temperature (in C).\n")
+	watcher.poll()
+	require.Len(t, reloaded, 1)
+
+	// A failed reload is logged
+	onChangeErr = errors.New("boom")
+	writeCounters("DCGM_FI_DEV_POWER_USAGE, gauge, Power draw (in W).\n")
+	watcher.poll()
+	require.Len(t, reloaded, 2)
+	require.Len(t, reloaded[1].DCGMCounters, 1)
+}
+
+func TestCountersWatcher_WatchConfigMap(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "configmap1",
+			Namespace: "default",
+		},
+		Data: map[string]string{"metrics": "DCGM_FI_DEV_GPU_TEMP, gauge, GPU temperature (in C).\n"},
+	}
+	clientset := fake.NewSimpleClientset(cm)
+
+	config := &Config{ConfigMapData: "default:configmap1"}
+	records, err := readConfigMap(clientset, config)
+	require.NoError(t, err)
+
+	configReloadSuccess.Set(1)
+
+	reloaded := make(chan *CounterSet, 10)
+	watcher := &CountersWatcher{
+		config: config,
+		onChange: func(cs *CounterSet) error {
+			reloaded <- cs
+			return nil
+		},
+		source: counterSource{records: records},
+	}
+
+	stop := make(chan interface{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watcher.watchConfigMap(clientset, stop)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	updateMetrics := func(metrics string) {
+		cm = cm.DeepCopy()
+		cm.Data["metrics"] = metrics
+		_, err := clientset.CoreV1().ConfigMaps("default").Update(context.Background(), cm, metav1.UpdateOptions{})
+		require.NoError(t, err)
+	}
+
+	// Invalid contents keep the current counters
+	updateMetrics("DCGM_FI_DEV_GPU_TEMP, not-a-type, GPU temperature (in C).\n")
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(configReloadSuccess) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, reloaded)
+
+	updateMetrics("DCGM_FI_DEV_POWER_USAGE, gauge, Power draw (in W).\n")
+	select {
+	case cs := <-reloaded:
+		require.Len(t, cs.DCGMCounters, 1)
+		assert.Equal(t, "DCGM_FI_DEV_POWER_USAGE", cs.DCGMCounters[0].FieldName)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the counters weren't reloaded")
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(configReloadSuccess))
+}
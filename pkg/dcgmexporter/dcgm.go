@@ -19,6 +19,8 @@ package dcgmexporter
 import (
 	"fmt"
 	"math/rand"
+	"slices"
+	"time"
 
 	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
 	"github.com/sirupsen/logrus"
@@ -41,6 +43,10 @@ func NewGroup() (dcgm.GroupHandle, func(), error) {
 func NewDeviceFields(counters []Counter, entityType dcgm.Field_Entity_Group) []dcgm.Short {
 	var deviceFields []dcgm.Short
 	for _, f := range counters {
+		if !f.AppliesTo(entityType) {
+			continue
+		}
+
 		meta := dcgm.FieldGetById(f.FieldID)
 
 		if meta.EntityLevel == entityType || meta.EntityLevel == dcgm.FE_NONE {
@@ -81,12 +87,81 @@ func WatchFieldGroup(
 	return nil
 }
 
+// FieldWatch is a set of fields watched with the same frequency and retention.
+type FieldWatch struct {
+	Fields         []dcgm.Short
+	UpdateFreqUsec int64
+	MaxKeepAge     float64 // In seconds, no limit when 0
+	MaxKeepSamples int32   // No limit when 0
+}
+
+// NewFieldWatches groups the device fields by the watch interval and the retention of their counters.
+// Fields whose counter has no watch interval are watched every collectIntervalUsec, and only their
+// latest sample is kept unless their counter has a retention. The samples of aggregated, histogram and
+// summary counters are kept for at least the collect interval.
+func NewFieldWatches(deviceFields []dcgm.Short, counters []Counter, collectIntervalUsec int64) []FieldWatch {
+	var watches []FieldWatch
+
+	for _, field := range deviceFields {
+		watch := FieldWatch{
+			UpdateFreqUsec: collectIntervalUsec,
+			MaxKeepSamples: 1,
+		}
+		if counter, err := FindCounterField(counters, uint(field)); err == nil {
+			if counter.WatchInterval > 0 {
+				watch.UpdateFreqUsec = counter.WatchInterval.Microseconds()
+			}
+			keepAge := counter.KeepAge
+			if counter.retainsSamples() {
+				keepAge = max(keepAge, time.Duration(collectIntervalUsec)*time.Microsecond)
+			}
+			if keepAge > 0 {
+				watch.MaxKeepAge = keepAge.Seconds()
+				watch.MaxKeepSamples = 0
+			}
+		}
+
+		i := slices.IndexFunc(watches, func(w FieldWatch) bool {
+			return w.UpdateFreqUsec == watch.UpdateFreqUsec && w.MaxKeepAge == watch.MaxKeepAge &&
+				w.MaxKeepSamples == watch.MaxKeepSamples
+		})
+		if i < 0 {
+			watches = append(watches, watch)
+			i = len(watches) - 1
+		}
+		watches[i].Fields = append(watches[i].Fields, field)
+	}
+
+	return watches
+}
+
 func SetupDcgmFieldsWatch(deviceFields []dcgm.Short, sysInfo SystemInfo, collectIntervalUsec int64) ([]dcgm.GroupHandle, dcgm.FieldHandle, []func(), error) {
+	groups, fieldGroups, cleanups, err := SetupDcgmFieldWatches([]FieldWatch{{
+		Fields:         deviceFields,
+		UpdateFreqUsec: collectIntervalUsec,
+		MaxKeepSamples: 1,
+	}}, sysInfo)
+	if err != nil {
+		return nil, dcgm.FieldHandle{}, nil, err
+	}
+
+	var fieldGroup dcgm.FieldHandle
+	if len(fieldGroups) > 0 {
+		fieldGroup = fieldGroups[len(fieldGroups)-1]
+	}
+
+	return groups, fieldGroup, cleanups, nil
+}
+
+// SetupDcgmFieldWatches creates the entity groups of sysInfo, and a field group per group and watch,
+// watched with the frequency and the retention of the watch.
+func SetupDcgmFieldWatches(watches []FieldWatch, sysInfo SystemInfo) ([]dcgm.GroupHandle, []dcgm.FieldHandle, []func(), error) {
 	var err error
 	var cleanups []func()
 	var cleanup func()
 	var groups []dcgm.GroupHandle
 	var fieldGroup dcgm.FieldHandle
+	var fieldGroups []dcgm.FieldHandle
 
 	if sysInfo.InfoType == dcgm.FE_LINK {
 		/* one group per-nvswitch is created for nvlinks */
@@ -107,25 +182,28 @@ func SetupDcgmFieldsWatch(deviceFields []dcgm.Short, sysInfo SystemInfo, collect
 	}
 
 	for _, gr := range groups {
-		fieldGroup, cleanup, err = NewFieldGroup(deviceFields)
-		if err != nil {
-			goto fail
-		}
+		for _, watch := range watches {
+			fieldGroup, cleanup, err = NewFieldGroup(watch.Fields)
+			if err != nil {
+				goto fail
+			}
 
-		cleanups = append(cleanups, cleanup)
+			cleanups = append(cleanups, cleanup)
+			fieldGroups = append(fieldGroups, fieldGroup)
 
-		err = WatchFieldGroup(gr, fieldGroup, collectIntervalUsec, 0.0, 1)
-		if err != nil {
-			goto fail
+			err = WatchFieldGroup(gr, fieldGroup, watch.UpdateFreqUsec, watch.MaxKeepAge, watch.MaxKeepSamples)
+			if err != nil {
+				goto fail
+			}
 		}
 	}
 
-	return groups, fieldGroup, cleanups, nil
+	return groups, fieldGroups, cleanups, nil
 
 fail:
 	for _, f := range cleanups {
 		f()
 	}
 
-	return nil, dcgm.FieldHandle{}, nil, err
+	return nil, nil, nil, err
 }
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFieldWatches(t *testing.T) {
+	counters := []Counter{
+		{FieldID: 1002, FieldName: "DCGM_FI_PROF_SM_ACTIVE", PromType: "gauge", WatchInterval: time.Second},
+		{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"},
+		{FieldID: 312, FieldName: "DCGM_FI_DEV_ECC_DBE_VOL_TOTAL", PromType: "counter", WatchInterval: 5 * time.Minute},
+		{FieldID: 390, FieldName: "DCGM_FI_DEV_RETIRED_DBE", PromType: "counter", WatchInterval: 5 * time.Minute},
+		{FieldID: 155, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "gauge", KeepAge: 30 * time.Second},
+		// The samples of aggregated counters are kept for the collect interval
+		{FieldID: 203, FieldName: "DCGM_FI_DEV_GPU_UTIL", PromType: "gauge", Aggregate: true},
+	}
+
+	watches := NewFieldWatches([]dcgm.Short{1002, 150, 312, 390, 155, 1, 203}, counters, 30000000)
+
+	assert.Equal(t, []FieldWatch{
+		{Fields: []dcgm.Short{1002}, UpdateFreqUsec: 1000000, MaxKeepSamples: 1},
+		// Fields without a counter are watched with the collect interval
+		{Fields: []dcgm.Short{150, 1}, UpdateFreqUsec: 30000000, MaxKeepSamples: 1},
+		{Fields: []dcgm.Short{312, 390}, UpdateFreqUsec: 300000000, MaxKeepSamples: 1},
+		{Fields: []dcgm.Short{155, 203}, UpdateFreqUsec: 30000000, MaxKeepAge: 30},
+	}, watches)
+}
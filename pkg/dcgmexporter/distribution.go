@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultQuantiles are the quantiles of summary counters that don't set any.
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// distributionKey identifies the distribution of the samples of a counter for an entity.
+type distributionKey struct {
+	counter Counter
+	entity  dcgm.GroupEntityPair
+}
+
+// distribution accumulates the samples of a histogram or a summary counter of an entity, across collections.
+type distribution struct {
+	observer interface {
+		prometheus.Metric
+		prometheus.Observer
+	}
+	lastTs int64 // Timestamp of the last observed sample, so that samples retained across windows are observed once
+}
+
+func newDistribution(counter Counter) *distribution {
+	if counter.PromType == "summary" {
+		quantiles := counter.Quantiles()
+		if len(quantiles) == 0 {
+			quantiles = defaultQuantiles
+		}
+
+		objectives := map[float64]float64{}
+		for _, q := range quantiles {
+			objectives[q] = (1 - q) / 10
+		}
+
+		return &distribution{observer: prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:       counter.Name(),
+			Help:       counter.Help,
+			Objectives: objectives,
+		})}
+	}
+
+	buckets := counter.Buckets()
+	if len(buckets) == 0 && counter.NativeHistogramBucketFactor == 0 {
+		buckets = prometheus.DefBuckets
+	}
+
+	return &distribution{observer: prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:                        counter.Name(),
+		Help:                        counter.Help,
+		Buckets:                     buckets,
+		NativeHistogramBucketFactor: counter.NativeHistogramBucketFactor,
+	})}
+}
+
+// observe adds the samples taken after the last observed one to the distribution.
+func (d *distribution) observe(samples []windowSample, scale float64) {
+	lastTs := d.lastTs
+	for _, sample := range samples {
+		if sample.ts <= d.lastTs {
+			continue
+		}
+
+		value := sample.value
+		if scale != 0 {
+			value *= scale
+		}
+		d.observer.Observe(value)
+		lastTs = max(lastTs, sample.ts)
+	}
+	d.lastTs = lastTs
+}
+
+// observeDistributions observes the samples of the histogram and summary counters of an entity, and sets
+// the distributions of their metrics.
+func (c *DCGMCollector) observeDistributions(metrics MetricsByCounter, entity dcgm.GroupEntityPair, samples windowSamples) {
+	c.distributionsMtx.Lock()
+	defer c.distributionsMtx.Unlock()
+
+	for counter, values := range metrics {
+		if !counter.isDistribution() {
+			continue
+		}
+
+		key := distributionKey{counter: counter, entity: entity}
+		d, exists := c.distributions[key]
+		if !exists {
+			if c.distributions == nil {
+				c.distributions = map[distributionKey]*distribution{}
+			}
+			d = newDistribution(counter)
+			c.distributions[key] = d
+		}
+
+		d.observe(samples[sampleKey{entity: entity, fieldID: uint(counter.FieldID)}], counter.Scale)
+
+		var pm dto.Metric
+		if err := d.observer.Write(&pm); err != nil {
+			logrus.WithError(err).Warnf("Cannot write the distribution of the '%s' metric", counter.Name())
+			delete(metrics, counter)
+			continue
+		}
+
+		for i := range values {
+			values[i].Histogram = pm.Histogram
+			values[i].Summary = pm.Summary
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveDistributions_Histogram(t *testing.T) {
+	gpu0 := dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU, EntityId: 0}
+	temp := Counter{
+		FieldID:   150,
+		FieldName: "DCGM_FI_DEV_GPU_TEMP",
+		PromType:  "histogram",
+		Help:      "GPU temperature (in C).",
+	}.WithBuckets([]float64{40, 60, 80})
+
+	samples := windowSamples{
+		{entity: gpu0, fieldID: 150}: {{ts: 1, value: 35}, {ts: 2, value: 55}, {ts: 3, value: 85}},
+	}
+
+	c := &DCGMCollector{}
+	metrics := MetricsByCounter{temp: {{Counter: temp, Value: "85", GPU: "0"}}}
+	c.observeDistributions(metrics, gpu0, samples)
+
+	h := metrics[temp][0].Histogram
+	require.NotNil(t, h)
+	assert.Equal(t, uint64(3), h.GetSampleCount())
+	assert.Equal(t, float64(175), h.GetSampleSum())
+	require.Len(t, h.Bucket, 3)
+	assert.Equal(t, []uint64{1, 2, 2}, []uint64{
+		h.Bucket[0].GetCumulativeCount(), h.Bucket[1].GetCumulativeCount(), h.Bucket[2].GetCumulativeCount(),
+	})
+
+	// Samples still retained by DCGM in the next window are only observed once
+	samples[sampleKey{entity: gpu0, fieldID: 150}] = append(samples[sampleKey{entity: gpu0, fieldID: 150}],
+		windowSample{ts: 4, value: 65})
+	metrics = MetricsByCounter{temp: {{Counter: temp, Value: "65", GPU: "0"}}}
+	c.observeDistributions(metrics, gpu0, samples)
+
+	h = metrics[temp][0].Histogram
+	assert.Equal(t, uint64(4), h.GetSampleCount())
+	assert.Equal(t, float64(240), h.GetSampleSum())
+
+	var b bytes.Buffer
+	builder := newMetricFamilyBuilder()
+	builder.add(metrics, gpuMetricLabels)
+	require.NoError(t, encodeMetricFamilies(&b, expfmt.NewFormat(expfmt.TypeTextPlain), builder.build()))
+	out := b.String()
+	assert.Contains(t, out, "# TYPE DCGM_FI_DEV_GPU_TEMP histogram\n")
+	assert.Contains(t, out, `gpu="0",`)
+	assert.Contains(t, out, `le="60"} 2`)
+	assert.Contains(t, out, `le="+Inf"} 4`)
+	assert.Contains(t, out, "DCGM_FI_DEV_GPU_TEMP_sum{")
+	assert.Contains(t, out, "DCGM_FI_DEV_GPU_TEMP_count{")
+}
+
+func TestObserveDistributions_Summary(t *testing.T) {
+	gpu0 := dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU, EntityId: 0}
+	power := Counter{
+		FieldID:   155,
+		FieldName: "DCGM_FI_DEV_POWER_USAGE",
+		PromType:  "summary",
+		Scale:     2,
+	}.WithQuantiles([]float64{0.5})
+
+	samples := windowSamples{
+		{entity: gpu0, fieldID: 155}: {{ts: 1, value: 100}, {ts: 2, value: 200}, {ts: 3, value: 300}},
+	}
+
+	c := &DCGMCollector{}
+	metrics := MetricsByCounter{power: {{Counter: power, Value: "300", GPU: "0"}}}
+	c.observeDistributions(metrics, gpu0, samples)
+
+	s := metrics[power][0].Summary
+	require.NotNil(t, s)
+	assert.Equal(t, uint64(3), s.GetSampleCount())
+	assert.Equal(t, float64(1200), s.GetSampleSum())
+	require.Len(t, s.Quantile, 1)
+	assert.Equal(t, 0.5, s.Quantile[0].GetQuantile())
+	assert.Equal(t, float64(400), s.Quantile[0].GetValue())
+}
+
+func TestObserveDistributions_NativeHistogram(t *testing.T) {
+	gpu0 := dcgm.GroupEntityPair{EntityGroupId: dcgm.FE_GPU, EntityId: 0}
+	clock := Counter{
+		FieldID:                     100,
+		FieldName:                   "DCGM_FI_DEV_SM_CLOCK",
+		PromType:                    "histogram",
+		NativeHistogramBucketFactor: 1.1,
+	}
+
+	samples := windowSamples{
+		{entity: gpu0, fieldID: 100}: {{ts: 1, value: 1410}, {ts: 2, value: 1980}},
+	}
+
+	c := &DCGMCollector{}
+	metrics := MetricsByCounter{clock: {{Counter: clock, Value: "1980", GPU: "0"}}}
+	c.observeDistributions(metrics, gpu0, samples)
+
+	h := metrics[clock][0].Histogram
+	require.NotNil(t, h)
+	assert.Empty(t, h.Bucket)
+	assert.NotNil(t, h.Schema)
+	assert.NotEmpty(t, h.PositiveSpan)
+}
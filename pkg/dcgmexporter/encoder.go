@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"io"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+	"k8s.io/utils/ptr"
+)
+
+// metricLabelsFunc returns the identity labels of a metric, in exposition order.
+// Each entity type (GPU, NvSwitch, NvLink, CPU and CPU core) has its own set of identity labels.
+type metricLabelsFunc func(m Metric) []*dto.LabelPair
+
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: ptr.To(name), Value: ptr.To(value)}
+}
+
+func gpuMetricLabels(m Metric) []*dto.LabelPair {
+	labels := []*dto.LabelPair{
+		labelPair("gpu", m.GPU),
+		labelPair(m.UUID, m.GPUUUID),
+		labelPair("pci_bus_id", m.GPUPCIBusID),
+		labelPair("device", m.GPUDevice),
+		labelPair("modelName", m.GPUModelName),
+	}
+	if m.MigProfile != "" {
+		labels = append(labels,
+			labelPair("GPU_I_PROFILE", m.MigProfile),
+			labelPair("GPU_I_ID", m.GPUInstanceID))
+	}
+	return appendHostnameLabel(labels, m)
+}
+
+func switchMetricLabels(m Metric) []*dto.LabelPair {
+	return appendHostnameLabel([]*dto.LabelPair{labelPair("nvswitch", m.GPU)}, m)
+}
+
+func linkMetricLabels(m Metric) []*dto.LabelPair {
+	return appendHostnameLabel([]*dto.LabelPair{
+		labelPair("nvlink", m.GPU),
+		labelPair("nvswitch", m.GPUDevice),
+	}, m)
+}
+
+func cpuMetricLabels(m Metric) []*dto.LabelPair {
+	return appendHostnameLabel([]*dto.LabelPair{labelPair("cpu", m.GPU)}, m)
+}
+
+func cpuCoreMetricLabels(m Metric) []*dto.LabelPair {
+	return appendHostnameLabel([]*dto.LabelPair{
+		labelPair("cpucore", m.GPU),
+		labelPair("cpu", m.GPUDevice),
+	}, m)
+}
+
+// exporterMetricLabels returns the identity labels of the metrics of the exporter collectors, which are
+// GPU metrics, except for the NvLink info.
+func exporterMetricLabels(m Metric) []*dto.LabelPair {
+	if m.Counter.FieldName == dcgmExpNvLinkInfo {
+		return linkMetricLabels(m)
+	}
+	return gpuMetricLabels(m)
+}
+
+// noIdentityLabels is used for the metrics of the exporter itself, that aren't tied to an entity.
+func noIdentityLabels(m Metric) []*dto.LabelPair {
+	return nil
+}
+
+func appendHostnameLabel(labels []*dto.LabelPair, m Metric) []*dto.LabelPair {
+	if m.Hostname != "" {
+		labels = append(labels, labelPair("Hostname", m.Hostname))
+	}
+	return labels
+}
+
+// metricLabelPairs returns the identity labels of the metric, the static labels of its counter, its Labels
+// and its Attributes, sorted by name like the labels of the client_golang metrics. An attribute overrides a
+// label with the same name, which overrides a static label. Those colliding with an identity label are
+// prefixed with "exported_", as Prometheus does for the labels of the scraped metrics colliding with the
+// target labels, and dropped when the prefixed name collides as well.
+func metricLabelPairs(m Metric, staticLabels map[string]string, identity metricLabelsFunc) []*dto.LabelPair {
+	labels := identity(m)
+
+	extra := maps.Clone(staticLabels)
+	if extra == nil {
+		extra = map[string]string{}
+	}
+	maps.Copy(extra, m.Labels)
+	maps.Copy(extra, m.Attributes)
+
+	names := map[string]bool{}
+	for _, l := range labels {
+		names[l.GetName()] = true
+	}
+	for _, name := range sortedKeys(extra) {
+		if !names[name] {
+			continue
+		}
+		exported := "exported_" + name
+		if _, exists := extra[exported]; !exists && !names[exported] {
+			extra[exported] = extra[name]
+		}
+		delete(extra, name)
+	}
+
+	for name, value := range extra {
+		labels = append(labels, labelPair(name, value))
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+
+	return labels
+}
+
+func toPromMetricType(promType string) dto.MetricType {
+	switch promType {
+	case "gauge":
+		return dto.MetricType_GAUGE
+	case "counter":
+		return dto.MetricType_COUNTER
+	case "histogram":
+		return dto.MetricType_HISTOGRAM
+	case "summary":
+		return dto.MetricType_SUMMARY
+	default:
+		return dto.MetricType_UNTYPED
+	}
+}
+
+// metricFamilyBuilder converts MetricsByCounter into Prometheus metric families.
+// Metrics of the same counter collected for different entity types are merged into a single family.
+type metricFamilyBuilder struct {
+	families       map[string]*dto.MetricFamily
+	withTimestamps bool // Expose the DCGM sample timestamps of the metrics
+}
+
+func newMetricFamilyBuilder() *metricFamilyBuilder {
+	return &metricFamilyBuilder{
+		families: map[string]*dto.MetricFamily{},
+	}
+}
+
+// add appends metrics to the builder, using identity to produce the entity labels of each metric.
+func (b *metricFamilyBuilder) add(metrics MetricsByCounter, identity metricLabelsFunc) {
+	for counter, values := range metrics {
+		if counter.PromType == "label" {
+			continue
+		}
+
+		name := counter.Name()
+		mf, exists := b.families[name]
+		if !exists {
+			mf = &dto.MetricFamily{
+				Name: ptr.To(name),
+				Help: ptr.To(counter.Help),
+				Type: toPromMetricType(counter.PromType).Enum(),
+			}
+			if counter.Unit != "" {
+				mf.Unit = ptr.To(counter.Unit)
+			}
+			b.families[name] = mf
+		}
+
+		staticLabels := counter.StaticLabels()
+		for _, m := range values {
+			switch mf.GetType() {
+			case dto.MetricType_HISTOGRAM, dto.MetricType_SUMMARY:
+				if m.Histogram == nil && m.Summary == nil {
+					logrus.Debugf("Skipping the '%s' metric without distribution", counter.Name())
+					continue
+				}
+
+				pm := &dto.Metric{
+					Label:     metricLabelPairs(m, staticLabels, identity),
+					Histogram: m.Histogram,
+					Summary:   m.Summary,
+				}
+				mf.Metric = append(mf.Metric, pm)
+				continue
+			}
+
+			value, err := strconv.ParseFloat(m.Value, 64)
+			if err != nil {
+				logrus.WithError(err).Debugf("Skipping non-numeric value '%s' of the '%s' metric", m.Value,
+					counter.FieldName)
+				continue
+			}
+			if counter.Scale != 0 {
+				value *= counter.Scale
+			}
+
+			pm := &dto.Metric{Label: metricLabelPairs(m, staticLabels, identity)}
+			if b.withTimestamps && !m.Timestamp.IsZero() {
+				pm.TimestampMs = ptr.To(m.Timestamp.UnixMilli())
+			}
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				pm.Gauge = &dto.Gauge{Value: ptr.To(value)}
+			case dto.MetricType_COUNTER:
+				pm.Counter = &dto.Counter{Value: ptr.To(value)}
+			default:
+				pm.Untyped = &dto.Untyped{Value: ptr.To(value)}
+			}
+			mf.Metric = append(mf.Metric, pm)
+		}
+	}
+}
+
+// build returns the metric families sorted by name. Families without samples are omitted.
+func (b *metricFamilyBuilder) build() []*dto.MetricFamily {
+	var res []*dto.MetricFamily
+	for _, name := range sortedKeys(b.families) {
+		if mf := b.families[name]; len(mf.Metric) > 0 {
+			res = append(res, mf)
+		}
+	}
+	return res
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// encodeMetricFamilies writes the metric families to w in the given exposition format.
+func encodeMetricFamilies(w io.Writer, format expfmt.Format, families []*dto.MetricFamily) error {
+	if format.FormatType() == expfmt.TypeOpenMetrics {
+		families = toOpenMetricsFamilies(families)
+	}
+
+	enc := expfmt.NewEncoder(w, format, expfmt.WithUnit())
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	// The OpenMetrics encoder writes the mandatory "# EOF" line on Close.
+	if closer, ok := enc.(expfmt.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// toOpenMetricsFamilies adds the "_total" suffix, that OpenMetrics requires, to the names of counters.
+// Without the suffix the OpenMetrics encoder would expose counters as "unknown".
+func toOpenMetricsFamilies(families []*dto.MetricFamily) []*dto.MetricFamily {
+	res := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		if mf.GetType() != dto.MetricType_COUNTER || strings.HasSuffix(mf.GetName(), "_total") {
+			res = append(res, mf)
+			continue
+		}
+		res = append(res, &dto.MetricFamily{
+			Name:   ptr.To(mf.GetName() + "_total"),
+			Help:   mf.Help,
+			Type:   mf.Type,
+			Unit:   mf.Unit,
+			Metric: mf.Metric,
+		})
+	}
+	return res
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func labelNames(labels []*dto.LabelPair) []string {
+	var names []string
+	for _, l := range labels {
+		names = append(names, l.GetName())
+	}
+	return names
+}
+
+func TestMetricFamilyBuilder(t *testing.T) {
+	gpuCounter := Counter{
+		FieldID:   155,
+		FieldName: "DCGM_FI_DEV_POWER_USAGE",
+		PromType:  "gauge",
+		Help:      "Power draw (in W).",
+	}
+	energyCounter := Counter{
+		FieldID:   156,
+		FieldName: "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION",
+		PromType:  "counter",
+		Help:      "Total energy consumption since boot (in mJ).",
+	}
+	labelCounter := Counter{
+		FieldID:   1,
+		FieldName: "DCGM_FI_DRIVER_VERSION",
+		PromType:  "label",
+	}
+
+	gpuMetrics := MetricsByCounter{
+		gpuCounter: {
+			{
+				Counter:      gpuCounter,
+				Value:        "42.000000",
+				GPU:          "0",
+				UUID:         "UUID",
+				GPUUUID:      "GPU-00000000-0000-0000-0000-000000000000",
+				GPUDevice:    "nvidia0",
+				GPUModelName: "NVIDIA \"H100\"\n80GB",
+				GPUPCIBusID:  "00000000:00:00.0",
+				Hostname:     "node-1",
+				Labels:       map[string]string{"DCGM_FI_DRIVER_VERSION": "550.54.15"},
+				Attributes:   map[string]string{"pod": "pod-\"a\"", "container": "main"},
+			},
+			{
+				Counter: gpuCounter,
+				Value:   SkipDCGMValue,
+				GPU:     "1",
+				UUID:    "UUID",
+			},
+		},
+		energyCounter: {
+			{
+				Counter: energyCounter,
+				Value:   "1234",
+				GPU:     "0",
+				UUID:    "UUID",
+			},
+		},
+		labelCounter: {
+			{
+				Counter: labelCounter,
+				Value:   "550.54.15",
+				GPU:     "0",
+				UUID:    "UUID",
+			},
+		},
+	}
+
+	switchMetrics := MetricsByCounter{
+		gpuCounter: {
+			{
+				Counter: gpuCounter,
+				Value:   "7",
+				GPU:     "3",
+			},
+		},
+	}
+
+	builder := newMetricFamilyBuilder()
+	builder.add(gpuMetrics, gpuMetricLabels)
+	builder.add(switchMetrics, switchMetricLabels)
+	families := builder.build()
+
+	require.Len(t, families, 2)
+	assert.Equal(t, "DCGM_FI_DEV_POWER_USAGE", families[0].GetName())
+	assert.Equal(t, dto.MetricType_GAUGE, families[0].GetType())
+	assert.Equal(t, "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", families[1].GetName())
+	assert.Equal(t, dto.MetricType_COUNTER, families[1].GetType())
+
+	// The skipped value is dropped and the switch sample is merged into the GPU family
+	require.Len(t, families[0].Metric, 2)
+	assert.Equal(t, []string{
+		"DCGM_FI_DRIVER_VERSION", "Hostname", "UUID", "container", "device", "gpu", "modelName", "pci_bus_id",
+		"pod",
+	}, labelNames(families[0].Metric[0].Label))
+	assert.Equal(t, 42.0, families[0].Metric[0].GetGauge().GetValue())
+	assert.Equal(t, []string{"nvswitch"}, labelNames(families[0].Metric[1].Label))
+	assert.Equal(t, 1234.0, families[1].Metric[0].GetCounter().GetValue())
+
+	var b bytes.Buffer
+	require.NoError(t, encodeMetricFamilies(&b, expfmt.NewFormat(expfmt.TypeTextPlain), families))
+
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(&b)
+	require.NoError(t, err)
+	require.Contains(t, parsed, "DCGM_FI_DEV_POWER_USAGE")
+
+	labels := map[string]string{}
+	for _, l := range parsed["DCGM_FI_DEV_POWER_USAGE"].Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	assert.Equal(t, "NVIDIA \"H100\"\n80GB", labels["modelName"])
+	assert.Equal(t, "pod-\"a\"", labels["pod"])
+}
+
+func TestMetricLabelPairs(t *testing.T) {
+	m := Metric{
+		GPU:           "0",
+		UUID:          "uuid",
+		GPUUUID:       "GPU-1",
+		MigProfile:    "1g.10gb",
+		GPUInstanceID: "3",
+		Labels:        map[string]string{"b": "label", "a": "label"},
+		Attributes:    map[string]string{"b": "attribute"},
+	}
+
+	// The labels are sorted by name, the identity labels included
+	labels := metricLabelPairs(m, nil, gpuMetricLabels)
+	assert.Equal(t, []string{
+		"GPU_I_ID", "GPU_I_PROFILE", "a", "b", "device", "gpu", "modelName", "pci_bus_id", "uuid",
+	}, labelNames(labels))
+	assert.Equal(t, "attribute", labels[3].GetValue())
+
+	assert.Equal(t, []string{"cpu", "cpucore"}, labelNames(metricLabelPairs(Metric{}, nil, cpuCoreMetricLabels)))
+	assert.Equal(t, []string{"nvlink", "nvswitch"}, labelNames(metricLabelPairs(Metric{}, nil, linkMetricLabels)))
+}
+
+func TestMetricLabelPairs_IdentityCollision(t *testing.T) {
+	m := Metric{
+		GPU:        "0",
+		UUID:       "UUID",
+		Hostname:   "node",
+		Labels:     map[string]string{"gpu": "label", "Hostname": "label", "modelName": "label"},
+		Attributes: map[string]string{"exported_modelName": "attribute"},
+	}
+
+	labels := metricLabelPairs(m, map[string]string{"device": "static"}, gpuMetricLabels)
+	assert.Equal(t, []string{
+		"Hostname", "UUID", "device", "exported_Hostname", "exported_device", "exported_gpu",
+		"exported_modelName", "gpu", "modelName", "pci_bus_id",
+	}, labelNames(labels))
+
+	values := map[string]string{}
+	for _, l := range labels {
+		values[l.GetName()] = l.GetValue()
+	}
+	assert.Equal(t, "0", values["gpu"])
+	assert.Equal(t, "node", values["Hostname"])
+	assert.Equal(t, "label", values["exported_gpu"])
+	assert.Equal(t, "label", values["exported_Hostname"])
+	assert.Equal(t, "static", values["exported_device"])
+	// The label colliding with both the identity label and its prefixed name is dropped
+	assert.Equal(t, "attribute", values["exported_modelName"])
+}
+
+func TestMetricFamilyBuilder_Timestamps(t *testing.T) {
+	counter := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	sampled := time.UnixMilli(1700000000123)
+	metrics := MetricsByCounter{
+		counter: {
+			{Counter: counter, Value: "42", GPU: "0", Timestamp: sampled},
+			{Counter: counter, Value: "43", GPU: "1"},
+		},
+	}
+
+	builder := newMetricFamilyBuilder()
+	builder.add(metrics, gpuMetricLabels)
+	families := builder.build()
+	require.Len(t, families, 1)
+	assert.Nil(t, families[0].Metric[0].TimestampMs)
+
+	builder = newMetricFamilyBuilder()
+	builder.withTimestamps = true
+	builder.add(metrics, gpuMetricLabels)
+	families = builder.build()
+	require.Len(t, families, 1)
+	require.Len(t, families[0].Metric, 2)
+	assert.Equal(t, sampled.UnixMilli(), families[0].Metric[0].GetTimestampMs())
+	assert.Nil(t, families[0].Metric[1].TimestampMs)
+}
+
+func TestMetricFamilyBuilder_CounterOptions(t *testing.T) {
+	counter := Counter{
+		FieldID:    156,
+		FieldName:  "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION",
+		PromType:   "counter",
+		MetricName: "gpu_energy_joules",
+		Scale:      0.001,
+	}.WithStaticLabels(map[string]string{"team": "ml", "pod": "static"})
+
+	builder := newMetricFamilyBuilder()
+	builder.add(MetricsByCounter{
+		counter: {
+			{Counter: counter, Value: "1500", GPU: "0", Labels: map[string]string{"pod": "pod-a"}},
+		},
+	}, gpuMetricLabels)
+	families := builder.build()
+	require.Len(t, families, 1)
+
+	mf := families[0]
+	assert.Equal(t, "gpu_energy_joules", mf.GetName())
+	require.Len(t, mf.Metric, 1)
+	assert.Equal(t, 1.5, mf.Metric[0].GetCounter().GetValue())
+
+	labels := map[string]string{}
+	for _, l := range mf.Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	assert.Equal(t, "ml", labels["team"])
+	// Labels of the metric override the static labels
+	assert.Equal(t, "pod-a", labels["pod"])
+}
@@ -20,47 +20,25 @@ import (
 	"fmt"
 	"io"
 	"maps"
-	"sync"
 	"sync/atomic"
-	"text/template"
 	"time"
 
 	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
-	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
 )
 
-var expMetricsFormat = `
-
-{{- range $counter, $metrics := . -}}
-# HELP {{ $counter.FieldName }} {{ $counter.Help }}
-# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
-{{- range $metric := $metrics }}
-{{ $counter.FieldName }}{gpu="{{ $metric.GPU }}",{{ $metric.UUID }}="{{ $metric.GPUUUID }}",pci_bus_id="{{ $metric.GPUPCIBusID }}",device="{{ $metric.GPUDevice }}",modelName="{{ $metric.GPUModelName }}"{{if $metric.MigProfile}},GPU_I_PROFILE="{{ $metric.MigProfile }}",GPU_I_ID="{{ $metric.GPUInstanceID }}"{{end}}{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
-
-{{- range $k, $v := $metric.Labels -}}
-	,{{ $k }}="{{ $v }}"
-{{- end -}}
-{{- range $k, $v := $metric.Attributes -}}
-	,{{ $k }}="{{ $v }}"
-{{- end -}}
-
-} {{ $metric.Value -}}
-{{- end }}
-{{ end }}`
-
 // Collector interface
 type Collector interface {
+	prometheus.Collector
 	GetMetrics() (MetricsByCounter, error)
 	Cleanup()
 }
 
-var getExpMetricTemplate = sync.OnceValue(func() *template.Template {
-	return template.Must(template.New("expMetrics").Parse(expMetricsFormat))
-})
-
 func encodeExpMetrics(w io.Writer, metrics MetricsByCounter) error {
-	tmpl := getExpMetricTemplate()
-	return tmpl.Execute(w, metrics)
+	families := newMetricFamilyBuilder()
+	families.add(metrics, gpuMetricLabels)
+	return encodeMetricFamilies(w, expfmt.NewFormat(expfmt.TypeTextPlain), families.build())
 }
 
 var expCollectorFieldGroupIdx atomic.Uint32
@@ -220,7 +198,7 @@ func newExpCollector(
 	counterDeviceFields []dcgm.Short,
 	config *Config,
 	fieldEntityGroupTypeSystemInfo FieldEntityGroupTypeSystemInfoItem,
-) expCollector {
+) (expCollector, error) {
 	var labelsCounters []Counter
 	for i := 0; i < len(counters); i++ {
 		if counters[i].PromType == "label" {
@@ -253,8 +231,8 @@ func newExpCollector(
 		collector.sysInfo,
 		int64(config.CollectInterval)*1000)
 	if err != nil {
-		logrus.Fatal("Failed to watch metrics: ", err)
+		return collector, fmt.Errorf("failed to watch metrics; err: %w", err)
 	}
 
-	return collector
+	return collector, nil
 }
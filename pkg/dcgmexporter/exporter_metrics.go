@@ -21,6 +21,9 @@ import "fmt"
 const (
 	dcgmExpClockEventsCount = "DCGM_EXP_CLOCK_EVENTS_COUNT"
 	dcgmExpXIDErrorsCount   = "DCGM_EXP_XID_ERRORS_COUNT"
+	dcgmExpGPUInstanceInfo  = "DCGM_EXP_GPU_INSTANCE_INFO"
+	dcgmExpNvLinkInfo       = "DCGM_EXP_NVLINK_INFO"
+	dcgmExpGPUSharedPods    = "DCGM_EXP_GPU_SHARED_PODS"
 )
 
 type ExporterCounter uint16
@@ -29,6 +32,9 @@ const (
 	DCGMFIUnknown        ExporterCounter = 0
 	DCGMXIDErrorsCount   ExporterCounter = iota + 9000
 	DCGMClockEventsCount ExporterCounter = iota + 9000
+	DCGMGPUInstanceInfo  ExporterCounter = iota + 9000
+	DCGMNvLinkInfo       ExporterCounter = iota + 9000
+	DCGMGPUSharedPods    ExporterCounter = iota + 9000
 )
 
 // String method to convert the enum value to a string
@@ -38,6 +44,12 @@ func (enm ExporterCounter) String() string {
 		return dcgmExpXIDErrorsCount
 	case DCGMClockEventsCount:
 		return dcgmExpClockEventsCount
+	case DCGMGPUInstanceInfo:
+		return dcgmExpGPUInstanceInfo
+	case DCGMNvLinkInfo:
+		return dcgmExpNvLinkInfo
+	case DCGMGPUSharedPods:
+		return dcgmExpGPUSharedPods
 	default:
 		return "DCGM_FI_UNKNOWN"
 	}
@@ -47,6 +59,9 @@ func (enm ExporterCounter) String() string {
 var DCGMFields = map[string]ExporterCounter{
 	DCGMXIDErrorsCount.String():   DCGMXIDErrorsCount,
 	DCGMClockEventsCount.String(): DCGMClockEventsCount,
+	DCGMGPUInstanceInfo.String():  DCGMGPUInstanceInfo,
+	DCGMNvLinkInfo.String():       DCGMNvLinkInfo,
+	DCGMGPUSharedPods.String():    DCGMGPUSharedPods,
 	DCGMFIUnknown.String():        DCGMFIUnknown,
 }
 
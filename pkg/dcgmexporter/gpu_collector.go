@@ -19,8 +19,10 @@ package dcgmexporter
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
 	"github.com/sirupsen/logrus"
@@ -56,14 +58,15 @@ func NewDCGMCollector(
 	collector.UseOldNamespace = config.UseOldNamespace
 	collector.ReplaceBlanksInModelName = config.ReplaceBlanksInModelName
 
-	_, _, cleanups, err := SetupDcgmFieldsWatch(collector.DeviceFields,
-		fieldEntityGroupTypeSystemInfo.SystemInfo,
-		int64(config.CollectInterval)*1000)
+	watches := NewFieldWatches(collector.DeviceFields, c, int64(config.CollectInterval)*1000)
+	groups, fieldGroups, cleanups, err := SetupDcgmFieldWatches(watches, fieldEntityGroupTypeSystemInfo.SystemInfo)
 	if err != nil {
-		logrus.Fatal("Failed to watch metrics: ", err)
+		return nil, func() {}, fmt.Errorf("failed to watch metrics; err: %w", err)
 	}
 
 	collector.Cleanups = cleanups
+	collector.sampleSources = sampleSources(groups, fieldGroups, watches, c)
+	collector.collectInterval = time.Duration(config.CollectInterval) * time.Millisecond
 
 	return collector, func() { collector.Cleanup() }, nil
 }
@@ -101,11 +104,42 @@ func (c *DCGMCollector) Cleanup() {
 	}
 }
 
+// sampleSources returns the field groups that watch the fields of the counters computed from the samples
+// over the collect interval. Field groups are created per group, in the order of the watches.
+func sampleSources(
+	groups []dcgm.GroupHandle, fieldGroups []dcgm.FieldHandle, watches []FieldWatch, c []Counter,
+) []watchedFieldGroup {
+	var sources []watchedFieldGroup
+	for i, watch := range watches {
+		retained := slices.ContainsFunc(watch.Fields, func(field dcgm.Short) bool {
+			counter, err := FindCounterField(c, uint(field))
+			return err == nil && counter.retainsSamples()
+		})
+		if !retained {
+			continue
+		}
+
+		for j, group := range groups {
+			sources = append(sources, watchedFieldGroup{group: group, fieldGroup: fieldGroups[j*len(watches)+i]})
+		}
+	}
+	return sources
+}
+
 func (c *DCGMCollector) GetMetrics() (MetricsByCounter, error) {
 	monitoringInfo := GetMonitoredEntities(c.SysInfo)
 
 	metrics := make(MetricsByCounter)
 
+	var samples windowSamples
+	if len(c.sampleSources) > 0 {
+		var err error
+		samples, err = getWindowSamples(c.sampleSources, time.Now().Add(-c.collectInterval))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	for _, mi := range monitoringInfo {
 		var vals []dcgm.FieldValue_v1
 		var err error
@@ -116,21 +150,22 @@ func (c *DCGMCollector) GetMetrics() (MetricsByCounter, error) {
 		}
 
 		if err != nil {
-			if derr, ok := err.(*dcgm.DcgmError); ok {
-				if derr.Code == dcgm.DCGM_ST_CONNECTION_NOT_VALID {
-					logrus.Fatal("Could not retrieve metrics: ", err)
-				}
-			}
-			return nil, err
+			// A lost connection to the hostengine is reported like any failure; HostengineSupervisor reconnects
+			return nil, fmt.Errorf("failed to retrieve metrics; err: %w", err)
+		}
+
+		entityMetrics := metrics
+		if samples != nil {
+			entityMetrics = make(MetricsByCounter)
 		}
 
 		// InstanceInfo will be nil for GPUs
 		if c.SysInfo.InfoType == dcgm.FE_SWITCH || c.SysInfo.InfoType == dcgm.FE_LINK {
-			ToSwitchMetric(metrics, vals, c.Counters, mi, c.UseOldNamespace, c.Hostname)
+			ToSwitchMetric(entityMetrics, vals, c.Counters, mi, c.UseOldNamespace, c.Hostname)
 		} else if c.SysInfo.InfoType == dcgm.FE_CPU || c.SysInfo.InfoType == dcgm.FE_CPU_CORE {
-			ToCPUMetric(metrics, vals, c.Counters, mi, c.UseOldNamespace, c.Hostname)
+			ToCPUMetric(entityMetrics, vals, c.Counters, mi, c.UseOldNamespace, c.Hostname)
 		} else {
-			ToMetric(metrics,
+			ToMetric(entityMetrics,
 				vals,
 				c.Counters,
 				mi.DeviceInfo,
@@ -139,6 +174,14 @@ func (c *DCGMCollector) GetMetrics() (MetricsByCounter, error) {
 				c.Hostname,
 				c.ReplaceBlanksInModelName)
 		}
+
+		if samples != nil {
+			appendAggregations(entityMetrics, mi.Entity, samples)
+			c.observeDistributions(entityMetrics, mi.Entity, samples)
+			for counter, values := range entityMetrics {
+				metrics[counter] = append(metrics[counter], values...)
+			}
+		}
 	}
 
 	return metrics, nil
@@ -196,6 +239,7 @@ func ToSwitchMetric(
 			m = Metric{
 				Counter:      counter,
 				Value:        v,
+				Timestamp:    sampleTime(val),
 				UUID:         uuid,
 				GPU:          fmt.Sprintf("%d", mi.Entity.EntityId),
 				GPUUUID:      "",
@@ -242,6 +286,7 @@ func ToCPUMetric(
 			m = Metric{
 				Counter:      counter,
 				Value:        v,
+				Timestamp:    sampleTime(val),
 				UUID:         uuid,
 				GPU:          fmt.Sprintf("%d", mi.Entity.EntityId),
 				GPUUUID:      "",
@@ -305,8 +350,9 @@ func ToMetric(
 		}
 
 		m := Metric{
-			Counter: counter,
-			Value:   v,
+			Counter:   counter,
+			Value:     v,
+			Timestamp: sampleTime(val),
 
 			UUID:         uuid,
 			GPU:          fmt.Sprintf("%d", d.GPU),
@@ -332,8 +378,10 @@ func ToMetric(
 }
 
 func getGPUModel(d dcgm.Device, replaceBlanksInModelName bool) string {
-	gpuModel := d.Identifiers.Model
+	return normalizeModelName(d.Identifiers.Model, replaceBlanksInModelName)
+}
 
+func normalizeModelName(gpuModel string, replaceBlanksInModelName bool) string {
 	if replaceBlanksInModelName {
 		parts := strings.Fields(gpuModel)
 		gpuModel = strings.Join(parts, " ")
@@ -342,6 +390,14 @@ func getGPUModel(d dcgm.Device, replaceBlanksInModelName bool) string {
 	return gpuModel
 }
 
+// sampleTime returns the time at which DCGM sampled the value. DCGM timestamps are in microseconds.
+func sampleTime(value dcgm.FieldValue_v1) time.Time {
+	if value.Ts <= 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(value.Ts)
+}
+
 func ToString(value dcgm.FieldValue_v1) string {
 	switch value.FieldType {
 	case dcgm.DCGM_FT_INT64:
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
 	"github.com/stretchr/testify/assert"
@@ -27,27 +28,17 @@ import (
 )
 
 var sampleCounters = []Counter{
-	{dcgm.DCGM_FI_DEV_GPU_TEMP, "DCGM_FI_DEV_GPU_TEMP", "gauge", "Temperature Help info"},
-	{dcgm.DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION, "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", "gauge", "Energy help info"},
-	{dcgm.DCGM_FI_DEV_POWER_USAGE, "DCGM_FI_DEV_POWER_USAGE", "gauge", "Power help info"},
-	{dcgm.DCGM_FI_DRIVER_VERSION, "DCGM_FI_DRIVER_VERSION", "label", "Driver version"},
+	{FieldID: dcgm.DCGM_FI_DEV_GPU_TEMP, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge", Help: "Temperature Help info"},
+	{FieldID: dcgm.DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION, FieldName: "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", PromType: "gauge", Help: "Energy help info"},
+	{FieldID: dcgm.DCGM_FI_DEV_POWER_USAGE, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "gauge", Help: "Power help info"},
+	{FieldID: dcgm.DCGM_FI_DRIVER_VERSION, FieldName: "DCGM_FI_DRIVER_VERSION", PromType: "label", Help: "Driver version"},
 	/* test that switch and link metrics are filtered out automatically when devices are not detected */
-	{
-		dcgm.DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT,
-		"DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT",
-		"gauge",
-		"switch temperature",
-	},
-	{
-		dcgm.DCGM_FI_DEV_NVSWITCH_LINK_FLIT_ERRORS,
-		"DCGM_FI_DEV_NVSWITCH_LINK_FLIT_ERRORS",
-		"gauge",
-		"per-link flit errors",
-	},
+	{FieldID: dcgm.DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT, FieldName: "DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT", PromType: "gauge", Help: "switch temperature"},
+	{FieldID: dcgm.DCGM_FI_DEV_NVSWITCH_LINK_FLIT_ERRORS, FieldName: "DCGM_FI_DEV_NVSWITCH_LINK_FLIT_ERRORS", PromType: "gauge", Help: "per-link flit errors"},
 	/* test that vgpu metrics are not filtered out */
-	{dcgm.DCGM_FI_DEV_VGPU_LICENSE_STATUS, "DCGM_FI_DEV_VGPU_LICENSE_STATUS", "gauge", "vgpu license status"},
+	{FieldID: dcgm.DCGM_FI_DEV_VGPU_LICENSE_STATUS, FieldName: "DCGM_FI_DEV_VGPU_LICENSE_STATUS", PromType: "gauge", Help: "vgpu license status"},
 	/* test that cpu and cpu core metrics are filtered out automatically when devices are not detected */
-	{dcgm.DCGM_FI_DEV_CPU_UTIL_TOTAL, "DCGM_FI_DEV_CPU_UTIL_TOTAL", "gauge", "Total CPU utilization"},
+	{FieldID: dcgm.DCGM_FI_DEV_CPU_UTIL_TOTAL, FieldName: "DCGM_FI_DEV_CPU_UTIL_TOTAL", PromType: "gauge", Help: "Total CPU utilization"},
 }
 
 var expectedMetrics = map[string]bool{
@@ -285,6 +276,7 @@ func TestToMetric(t *testing.T) {
 		{
 			FieldId:   150,
 			FieldType: dcgm.DCGM_FT_INT64,
+			Ts:        1700000000123456,
 			Value:     fieldValue,
 		},
 	}
@@ -338,6 +330,7 @@ func TestToMetric(t *testing.T) {
 
 			assert.Equal(t, d.UUID, metricValues[0].GPUUUID)
 			assert.Equal(t, d.PCI.BusID, metricValues[0].GPUPCIBusID)
+			assert.Equal(t, time.UnixMicro(1700000000123456), metricValues[0].Timestamp)
 		})
 	}
 }
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const kubeletDialTimeout = time.Second
+
+// healthCheck is a named check of /healthz/live or /healthz/ready. check returns an error when the checked
+// component is unhealthy.
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+type healthCheckStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthStatus struct {
+	Status string              `json:"status"`
+	Checks []healthCheckStatus `json:"checks"`
+}
+
+// RegisterHealthChecks serves the liveness and the readiness of the exporter under /healthz/live and
+// /healthz/ready.
+//
+// The exporter is live as long as the pipeline completes its collections, even failed ones. It is ready when
+// the collection of an entity type succeeded recently, the hostengine answers, the kubelet socket is reachable
+// with --kubernetes, and counters are loaded. The state of each entity type is reported by
+// dcgm_exporter_collector_up.
+func (s *MetricsServer) RegisterHealthChecks(pipeline *MetricsPipeline, c *Config) {
+	intervals := c.HealthStaleIntervals
+
+	live := []healthCheck{
+		{name: "pipeline", check: func() error { return pipeline.checkRunning(intervals) }},
+	}
+
+	ready := []healthCheck{
+		{name: "collection", check: func() error { return pipeline.checkCollection(intervals) }},
+		{name: "hostengine", check: checkHostengine},
+	}
+	if c.Kubernetes {
+		ready = append(ready, healthCheck{name: "kubelet", check: func() error {
+			return checkKubeletSocket(c.PodResourcesKubeletSocket)
+		}})
+	}
+	ready = append(ready, healthCheck{name: "counters", check: pipeline.checkCounters})
+
+	s.router.HandleFunc("/healthz/live", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, live)
+	}).Methods(http.MethodGet)
+	s.router.HandleFunc("/healthz/ready", func(w http.ResponseWriter, r *http.Request) {
+		serveHealth(w, ready)
+	}).Methods(http.MethodGet)
+}
+
+// serveHealth runs all the checks, and responds with 503 Service Unavailable when any of them fails.
+func serveHealth(w http.ResponseWriter, checks []healthCheck) {
+	status := healthStatus{Status: "ok", Checks: []healthCheckStatus{}}
+	code := http.StatusOK
+
+	for _, c := range checks {
+		checkStatus := healthCheckStatus{Name: c.name, Status: "ok"}
+		if err := c.check(); err != nil {
+			checkStatus.Status = "failed"
+			checkStatus.Error = err.Error()
+			status.Status = "failed"
+			code = http.StatusServiceUnavailable
+		}
+		status.Checks = append(status.Checks, checkStatus)
+	}
+
+	writeJSON(w, code, status)
+}
+
+// checkHostengine checks that the hostengine answers, with a query that doesn't depend on the counters.
+func checkHostengine() error {
+	dcgmConnection.RLock()
+	defer dcgmConnection.RUnlock()
+
+	if _, err := dcgmGetAllDeviceCount(); err != nil {
+		return fmt.Errorf("the hostengine doesn't answer; err: %w", err)
+	}
+	return nil
+}
+
+func checkKubeletSocket(socketPath string) error {
+	conn, err := net.DialTimeout("unix", socketPath, kubeletDialTimeout)
+	if err != nil {
+		return fmt.Errorf("the kubelet socket '%s' is unreachable; err: %w", socketPath, err)
+	}
+	return conn.Close()
+}
+
+// recordCollection records the end of a collection, for the health checks. A collection succeeds when an
+// entity type is collected: the failures of the others are reported by dcgm_exporter_collector_up, and
+// don't stop the scrapes of the metrics that are collected.
+func (m *MetricsPipeline) recordCollection(families []*dto.MetricFamily) {
+	m.healthMtx.Lock()
+	defer m.healthMtx.Unlock()
+
+	m.lastCollection = time.Now()
+	if collectorsUp(families) {
+		m.lastSuccess = m.lastCollection
+	}
+}
+
+// setPeriodic records whether Run collects the metrics every collect interval. Otherwise the metrics are only
+// collected on scrapes, which can be infrequent, so the time of the last collection says nothing.
+func (m *MetricsPipeline) setPeriodic(periodic bool) {
+	m.healthMtx.Lock()
+	defer m.healthMtx.Unlock()
+
+	m.periodic = periodic
+	m.runStart = time.Now()
+}
+
+// healthWindow returns the duration of the given number of collect intervals.
+func (m *MetricsPipeline) healthWindow(intervals int) time.Duration {
+	return time.Duration(intervals) * time.Duration(m.config.CollectInterval) * time.Millisecond
+}
+
+// checkRunning checks that the periodic collections don't hang.
+func (m *MetricsPipeline) checkRunning(intervals int) error {
+	m.healthMtx.Lock()
+	defer m.healthMtx.Unlock()
+
+	if !m.periodic || intervals <= 0 {
+		return nil
+	}
+
+	window := m.healthWindow(intervals)
+	last := m.lastCollection
+	if last.IsZero() {
+		last = m.runStart
+	}
+	if since := time.Since(last); since > window {
+		return fmt.Errorf("no collection completed for %s", since.Truncate(time.Second))
+	}
+	return nil
+}
+
+// checkCollection checks that a collection succeeded within the last collect intervals. When the metrics are
+// only collected on scrapes, it checks that the last collection succeeded instead.
+func (m *MetricsPipeline) checkCollection(intervals int) error {
+	m.healthMtx.Lock()
+	defer m.healthMtx.Unlock()
+
+	if !m.periodic {
+		if m.lastCollection.After(m.lastSuccess) {
+			return errors.New("the last collection failed")
+		}
+		return nil
+	}
+
+	if intervals <= 0 {
+		return nil
+	}
+	if m.lastSuccess.IsZero() {
+		return errors.New("no collection succeeded yet")
+	}
+	if since := time.Since(m.lastSuccess); since > m.healthWindow(intervals) {
+		return fmt.Errorf("no collection succeeded for %s", since.Truncate(time.Second))
+	}
+	return nil
+}
+
+func (m *MetricsPipeline) checkCounters() error {
+	m.collectorsMtx.RLock()
+	defer m.collectorsMtx.RUnlock()
+
+	if len(m.counters) == 0 {
+		return errors.New("no counters are loaded")
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getHealth(t *testing.T, s *MetricsServer, path string) (int, healthStatus) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var status healthStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	return rec.Code, status
+}
+
+func TestHealthChecks(t *testing.T) {
+	deviceCountErr := error(nil)
+	dcgmGetAllDeviceCount = func() (uint, error) {
+		return 1, deviceCountErr
+	}
+	defer func() {
+		dcgmGetAllDeviceCount = dcgm.GetAllDeviceCount
+	}()
+
+	socket := filepath.Join(t.TempDir(), "kubelet.sock")
+	config := &Config{
+		CollectInterval:           1000,
+		HealthStaleIntervals:      3,
+		Kubernetes:                true,
+		PodResourcesKubeletSocket: socket,
+	}
+	p := &MetricsPipeline{
+		config:   config,
+		counters: []Counter{{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}},
+	}
+	p.setPeriodic(true)
+
+	s, _, err := NewMetricsServer(config, nil, NewRegistry())
+	require.NoError(t, err)
+	s.RegisterHealthChecks(p, config)
+
+	// No collection yet, and no kubelet
+	code, status := getHealth(t, s, "/healthz/live")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthStatus{Status: "ok", Checks: []healthCheckStatus{{Name: "pipeline", Status: "ok"}}}, status)
+
+	code, status = getHealth(t, s, "/healthz/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "failed", status.Status)
+	require.Len(t, status.Checks, 4)
+	assert.Equal(t, healthCheckStatus{Name: "collection", Status: "failed", Error: "no collection succeeded yet"},
+		status.Checks[0])
+	assert.Equal(t, healthCheckStatus{Name: "hostengine", Status: "ok"}, status.Checks[1])
+	assert.Equal(t, "kubelet", status.Checks[2].Name)
+	assert.Equal(t, "failed", status.Checks[2].Status)
+	assert.Equal(t, healthCheckStatus{Name: "counters", Status: "ok"}, status.Checks[3])
+
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	p.recordCollection(testCollectorUpFamilies("1"))
+
+	code, status = getHealth(t, s, "/healthz/ready")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", status.Status)
+
+	// A failing hostengine makes the exporter unready, but still live
+	deviceCountErr = errors.New("connection lost")
+	code, status = getHealth(t, s, "/healthz/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "failed", status.Checks[1].Status)
+	assert.Contains(t, status.Checks[1].Error, "connection lost")
+	code, _ = getHealth(t, s, "/healthz/live")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestMetricsPipeline_CheckCollection(t *testing.T) {
+	p := &MetricsPipeline{config: &Config{CollectInterval: 1000}}
+
+	t.Run("Collections on scrapes only", func(t *testing.T) {
+		assert.NoError(t, p.checkCollection(3))
+
+		p.recordCollection(testCollectorUpFamilies("0"))
+		assert.EqualError(t, p.checkCollection(3), "the last collection failed")
+
+		p.recordCollection(testCollectorUpFamilies("1"))
+		assert.NoError(t, p.checkCollection(3))
+	})
+
+	t.Run("Periodic collections", func(t *testing.T) {
+		p.setPeriodic(true)
+		defer p.setPeriodic(false)
+
+		p.recordCollection(testCollectorUpFamilies("0"))
+		assert.NoError(t, p.checkCollection(3), "a collection succeeded within 3 intervals")
+
+		p.lastSuccess = time.Now().Add(-5 * time.Second)
+		assert.ErrorContains(t, p.checkCollection(3), "no collection succeeded for 5s")
+		assert.NoError(t, p.checkCollection(0), "zero disables the check of the last success time")
+	})
+}
+
+func TestMetricsPipeline_CheckCollection_EntityFailure(t *testing.T) {
+	tempCounter := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	gpu := &fakeMetricsGetter{metrics: MetricsByCounter{
+		tempCounter: {{Counter: tempCounter, GPU: "0", Value: "42"}},
+	}}
+	nvswitch := &fakeMetricsGetter{err: errors.New("nvswitch failure")}
+
+	p := &MetricsPipeline{config: &Config{CollectInterval: 1000}}
+	collectors := []entityCollector{
+		{entity: "gpu", collector: gpu, labels: gpuMetricLabels, transform: true},
+		{entity: "switch", collector: nvswitch, labels: switchMetricLabels},
+	}
+
+	// A failing entity type doesn't make the exporter unready while the GPUs are collected
+	families, err := p.runCollectors(collectors, nil)
+	require.Error(t, err)
+	p.recordCollection(families)
+	assert.NoError(t, p.checkCollection(3))
+
+	gpu.err = errors.New("gpu failure")
+	families, err = p.runCollectors(collectors, nil)
+	require.Error(t, err)
+	p.recordCollection(families)
+	assert.EqualError(t, p.checkCollection(3), "the last collection failed")
+}
+
+func TestMetricsPipeline_CheckRunning(t *testing.T) {
+	p := &MetricsPipeline{config: &Config{CollectInterval: 1000}}
+	assert.NoError(t, p.checkRunning(3), "only periodic collections are checked")
+
+	p.setPeriodic(true)
+	assert.NoError(t, p.checkRunning(3))
+
+	p.runStart = time.Now().Add(-5 * time.Second)
+	assert.ErrorContains(t, p.checkRunning(3), "no collection completed for 5s")
+
+	p.recordCollection(testCollectorUpFamilies("0"))
+	assert.NoError(t, p.checkRunning(3), "failed collections complete")
+
+	p.lastCollection = time.Now().Add(-5 * time.Second)
+	assert.Error(t, p.checkRunning(3))
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hostengineMinBackoff = time.Second
+	hostengineMaxBackoff = time.Minute
+)
+
+var (
+	dcgmFieldsInit = dcgm.FieldsInit
+	dcgmFieldsTerm = dcgm.FieldsTerm
+)
+
+// dcgmConnection guards the DCGM calls against the reconnection to the hostengine, which shuts DCGM down
+// and initializes it again. DCGM calls hold it for reading, the reconnection for writing. It is taken before the
+// lock of the registry, which the reconnection and the reload take while holding it.
+var dcgmConnection sync.RWMutex
+
+// WithDCGMConnection calls f, which calls DCGM, while no reconnection to the hostengine is in progress.
+// f must not call functions that hold the connection themselves.
+func WithDCGMConnection(f func() error) error {
+	dcgmConnection.RLock()
+	defer dcgmConnection.RUnlock()
+
+	return f()
+}
+
+// isConnectionError returns whether err reports that the connection to the hostengine is gone.
+func isConnectionError(err error) bool {
+	var derr *dcgm.DcgmError
+	return errors.As(err, &derr) && derr.Code == dcgm.DCGM_ST_CONNECTION_NOT_VALID
+}
+
+// HostengineSupervisor connects to DCGM, and reconnects to a standalone hostengine when the connection is lost,
+// e.g. when nv-hostengine restarts during a driver upgrade.
+type HostengineSupervisor struct {
+	init       func() (func(), error) // Initializes DCGM, and returns the function that shuts it down
+	standalone bool
+	interval   time.Duration // Interval of the checks of the connection
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// onDisconnect drops what lives in the hostengine, before reconnecting; onReconnect rebuilds it.
+	onDisconnect func()
+	onReconnect  func() error
+
+	mtx       sync.Mutex
+	connected bool
+	cleanup   func()
+}
+
+func NewHostengineSupervisor(c *Config, init func() (func(), error)) *HostengineSupervisor {
+	return &HostengineSupervisor{
+		init:       init,
+		standalone: c.UseRemoteHE,
+		interval:   time.Duration(c.CollectInterval) * time.Millisecond,
+		minBackoff: hostengineMinBackoff,
+		maxBackoff: hostengineMaxBackoff,
+	}
+}
+
+// OnReconnect sets the functions called around a reconnection: onDisconnect before DCGM is shut down,
+// and onReconnect once it is initialized again. It must be called before Run.
+func (s *HostengineSupervisor) OnReconnect(onDisconnect func(), onReconnect func() error) {
+	s.onDisconnect = onDisconnect
+	s.onReconnect = onReconnect
+}
+
+// Connect initializes DCGM. A standalone hostengine is retried with backoff until it answers or ctx is done,
+// which lets the exporter start before the hostengine.
+func (s *HostengineSupervisor) Connect(ctx context.Context) error {
+	backoff := s.minBackoff
+	for {
+		err := s.connect()
+		if err == nil {
+			return nil
+		}
+		if !s.standalone {
+			return err
+		}
+
+		logrus.WithError(err).Warnf("Cannot connect to the hostengine; retrying in %s", backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped connecting to the hostengine; err: %w", err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.maxBackoff)
+	}
+}
+
+// connect shuts down the previous DCGM connection, if any, and initializes DCGM.
+func (s *HostengineSupervisor) connect() error {
+	dcgmConnection.Lock()
+	defer dcgmConnection.Unlock()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.connected = false
+	if s.cleanup != nil {
+		dcgmFieldsTerm()
+		s.cleanup()
+		s.cleanup = nil
+	}
+
+	cleanup, err := s.init()
+	if err != nil {
+		return err
+	}
+	dcgmFieldsInit()
+
+	s.cleanup = cleanup
+	s.connected = true
+
+	return nil
+}
+
+// Connected returns whether DCGM is connected to the hostengine, as of the last check.
+func (s *HostengineSupervisor) Connected() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.connected
+}
+
+// Run checks the connection to a standalone hostengine every collect interval until stop is closed.
+// When the connection is lost, it reconnects with backoff, and rebuilds the DCGM groups and field watches
+// with onReconnect.
+func (s *HostengineSupervisor) Run(stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	delay := s.interval
+	backoff := s.minBackoff
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+
+		if s.Connected() {
+			err := checkHostengine()
+			if !isConnectionError(err) {
+				delay = s.interval
+				continue
+			}
+
+			logrus.WithError(err).Warn("Lost the connection to the hostengine; reconnecting")
+			s.mtx.Lock()
+			s.connected = false
+			s.mtx.Unlock()
+			backoff = s.minBackoff
+		}
+
+		if err := s.reconnect(); err != nil {
+			logrus.WithError(err).Warnf("Failed to reconnect to the hostengine; retrying in %s", backoff)
+			delay = backoff
+			backoff = min(backoff*2, s.maxBackoff)
+			continue
+		}
+
+		logrus.Info("Reconnected to the hostengine")
+		delay = s.interval
+	}
+}
+
+func (s *HostengineSupervisor) reconnect() error {
+	// The groups and field watches of the collectors are gone with the previous hostengine. Their IDs may be
+	// reused by the new one, so they must be dropped instead of being destroyed.
+	if s.onDisconnect != nil {
+		s.onDisconnect()
+	}
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	if s.onReconnect != nil {
+		if err := s.onReconnect(); err != nil {
+			// The next attempt starts over from a new connection
+			s.mtx.Lock()
+			s.connected = false
+			s.mtx.Unlock()
+			return fmt.Errorf("failed to rebuild the DCGM watches; err: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Close shuts DCGM down.
+func (s *HostengineSupervisor) Close() {
+	dcgmConnection.Lock()
+	defer dcgmConnection.Unlock()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.cleanup != nil {
+		dcgmFieldsTerm()
+		s.cleanup()
+		s.cleanup = nil
+	}
+	s.connected = false
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHostengine counts the initializations and the shutdowns of DCGM. init fails while failures is positive.
+type fakeHostengine struct {
+	mtx       sync.Mutex
+	failures  int
+	inits     int
+	shutdowns int
+}
+
+func (h *fakeHostengine) init() (func(), error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.failures > 0 {
+		h.failures--
+		return nil, errors.New("connection refused")
+	}
+	h.inits++
+	return func() {
+		h.mtx.Lock()
+		defer h.mtx.Unlock()
+		h.shutdowns++
+	}, nil
+}
+
+func (h *fakeHostengine) counts() (int, int) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.inits, h.shutdowns
+}
+
+func newTestHostengineSupervisor(t *testing.T, standalone bool, h *fakeHostengine) *HostengineSupervisor {
+	t.Helper()
+
+	dcgmFieldsInit = func() int { return 0 }
+	dcgmFieldsTerm = func() int { return 0 }
+	t.Cleanup(func() {
+		dcgmFieldsInit = dcgm.FieldsInit
+		dcgmFieldsTerm = dcgm.FieldsTerm
+	})
+
+	s := NewHostengineSupervisor(&Config{UseRemoteHE: standalone, CollectInterval: 10}, h.init)
+	s.minBackoff = time.Millisecond
+	s.maxBackoff = 5 * time.Millisecond
+	return s
+}
+
+func TestHostengineSupervisor_Connect(t *testing.T) {
+	t.Run("Standalone hostengine is retried", func(t *testing.T) {
+		h := &fakeHostengine{failures: 2}
+		s := newTestHostengineSupervisor(t, true, h)
+
+		require.NoError(t, s.Connect(context.Background()))
+		assert.True(t, s.Connected())
+
+		s.Close()
+		assert.False(t, s.Connected())
+		inits, shutdowns := h.counts()
+		assert.Equal(t, 1, inits)
+		assert.Equal(t, 1, shutdowns)
+	})
+
+	t.Run("Standalone hostengine is retried until the context is done", func(t *testing.T) {
+		s := newTestHostengineSupervisor(t, true, &fakeHostengine{failures: 1000})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		assert.ErrorContains(t, s.Connect(ctx), "connection refused")
+	})
+
+	t.Run("Embedded hostengine is not retried", func(t *testing.T) {
+		h := &fakeHostengine{failures: 1}
+		s := newTestHostengineSupervisor(t, false, h)
+
+		assert.Error(t, s.Connect(context.Background()))
+		assert.False(t, s.Connected())
+	})
+}
+
+func TestHostengineSupervisor_Run(t *testing.T) {
+	lost := &dcgm.DcgmError{Code: dcgm.DCGM_ST_CONNECTION_NOT_VALID}
+
+	var pingMtx sync.Mutex
+	pingErr := error(nil)
+	dcgmGetAllDeviceCount = func() (uint, error) {
+		pingMtx.Lock()
+		defer pingMtx.Unlock()
+		return 1, pingErr
+	}
+	defer func() {
+		dcgmGetAllDeviceCount = dcgm.GetAllDeviceCount
+	}()
+
+	h := &fakeHostengine{}
+	s := newTestHostengineSupervisor(t, true, h)
+	require.NoError(t, s.Connect(context.Background()))
+
+	disconnects := make(chan struct{}, 10)
+	reconnects := make(chan struct{}, 10)
+	s.OnReconnect(func() {
+		disconnects <- struct{}{}
+	}, func() error {
+		pingMtx.Lock()
+		pingErr = nil
+		pingMtx.Unlock()
+		reconnects <- struct{}{}
+		return nil
+	})
+
+	stop := make(chan interface{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go s.Run(stop, &wg)
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	// The hostengine restarts: the first reconnection fails
+	h.mtx.Lock()
+	h.failures = 1
+	h.mtx.Unlock()
+	pingMtx.Lock()
+	pingErr = fmt.Errorf("wrapped; err: %w", lost)
+	pingMtx.Unlock()
+
+	select {
+	case <-reconnects:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the supervisor didn't reconnect")
+	}
+
+	assert.Len(t, disconnects, 2, "the collectors are discarded before every attempt")
+	assert.Eventually(t, s.Connected, 5*time.Second, time.Millisecond)
+	inits, shutdowns := h.counts()
+	assert.Equal(t, 2, inits)
+	assert.Equal(t, 1, shutdowns)
+}
+
+func TestIsConnectionError(t *testing.T) {
+	lost := &dcgm.DcgmError{Code: dcgm.DCGM_ST_CONNECTION_NOT_VALID}
+
+	assert.True(t, isConnectionError(lost))
+	assert.True(t, isConnectionError(errors.Join(errors.New("other"), fmt.Errorf("wrapped; err: %w", lost))))
+	assert.False(t, isConnectionError(&dcgm.DcgmError{Code: dcgm.DCGM_ST_NO_DATA}))
+	assert.False(t, isConnectionError(nil))
+}
@@ -19,6 +19,7 @@ package dcgmexporter
 import (
 	"context"
 	"fmt"
+	"maps"
 	"net"
 	"regexp"
 	"slices"
@@ -28,7 +29,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
-	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+	podresourcesv1alpha1 "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
 
 	"github.com/NVIDIA/dcgm-exporter/internal/pkg/nvmlprovider"
 )
@@ -44,9 +46,35 @@ var (
 func NewPodMapper(c *Config) (*PodMapper, error) {
 	logrus.Infof("Kubernetes metrics collection enabled!")
 
-	return &PodMapper{
-		Config: c,
-	}, nil
+	podMapper := &PodMapper{
+		Config:       c,
+		podResources: getPodResourcesCache(c),
+	}
+
+	if len(c.KubernetesPodLabels) > 0 || len(c.KubernetesPodAnnotations) > 0 || c.KubernetesWorkloads {
+		podMetadata, err := getPodMetadataCache(c)
+		if err != nil {
+			logrus.WithError(err).Warn("Cannot add the pod labels, annotations and workloads to the metrics")
+		}
+		podMapper.podMetadata = podMetadata
+	}
+
+	if c.KubernetesWorkloads && podMapper.podMetadata != nil {
+		workloads, err := getWorkloadResolver()
+		if err != nil {
+			logrus.WithError(err).Warn("Cannot add the workloads of the pods to the metrics")
+		}
+		podMapper.workloads = workloads
+	}
+
+	return podMapper, nil
+}
+
+// CloseKubernetesCaches stops the pod resources, pod metadata and workload caches shared by the pod mappers.
+func CloseKubernetesCaches() {
+	closeWorkloadResolver()
+	closePodMetadataCaches()
+	closePodResourcesCaches()
 }
 
 func (p *PodMapper) Name() string {
@@ -54,56 +82,58 @@ func (p *PodMapper) Name() string {
 }
 
 func (p *PodMapper) Process(metrics MetricsByCounter, sysInfo SystemInfo) error {
-	socketPath := p.Config.PodResourcesKubeletSocket
-	_, err := os.Stat(socketPath)
-	if os.IsNotExist(err) {
-		logrus.Info("No Kubelet socket, ignoring")
-		return nil
-	}
+	// The pod resources are listed in the background, a slow or restarting kubelet doesn't delay the collection.
+	pods, migDevices := p.podResources.get()
 
-	// TODO: This needs to be moved out of the critical path.
-	c, cleanup, err := connectToServer(socketPath)
-	if err != nil {
-		return err
-	}
-	defer cleanup()
+	deviceToPods := p.toDeviceToPod(pods, migDevices, sysInfo)
 
-	pods, err := p.listPods(c)
-	if err != nil {
-		return err
-	}
+	logrus.Debugf("Device to pod mapping: %+v", deviceToPods)
 
-	deviceToPod := p.toDeviceToPod(pods, sysInfo)
-
-	logrus.Debugf("Device to pod mapping: %+v", deviceToPod)
-
-	// Note: for loop are copies the value, if we want to change the value
-	// and not the copy, we need to use the indexes
 	for counter := range metrics {
-		for j, val := range metrics[counter] {
-			deviceID, err := val.getIDOfType(p.Config.KubernetesGPUIdType)
+		var modifiedMetrics []Metric
+		for _, metric := range metrics[counter] {
+			deviceID, err := metric.getIDOfType(p.Config.KubernetesGPUIdType)
 			if err != nil {
 				return err
 			}
 
-			podInfo, exists := deviceToPod[deviceID]
-			if exists {
-				if !p.Config.UseOldNamespace {
-					metrics[counter][j].Attributes[podAttribute] = podInfo.Name
-					metrics[counter][j].Attributes[namespaceAttribute] = podInfo.Namespace
-					metrics[counter][j].Attributes[containerAttribute] = podInfo.Container
-				} else {
-					metrics[counter][j].Attributes[oldPodAttribute] = podInfo.Name
-					metrics[counter][j].Attributes[oldNamespaceAttribute] = podInfo.Namespace
-					metrics[counter][j].Attributes[oldContainerAttribute] = podInfo.Container
+			podInfos := deviceToPods[deviceID]
+			switch {
+			case len(podInfos) == 1:
+				p.setPodAttributes(metric.Attributes, podInfos[0])
+			case len(podInfos) > 1 && p.Config.KubernetesSharedGPUs != SharedGPUsInfo:
+				// One series per pod sharing the GPU
+				for _, podInfo := range podInfos {
+					modifiedMetric := metric
+					modifiedMetric.Attributes = maps.Clone(metric.Attributes)
+					p.setPodAttributes(modifiedMetric.Attributes, podInfo)
+					modifiedMetrics = append(modifiedMetrics, modifiedMetric)
 				}
+				continue
 			}
+			// With SharedGPUsInfo, the pods sharing the GPU are given by the DCGM_EXP_GPU_SHARED_PODS metric
+			modifiedMetrics = append(modifiedMetrics, metric)
 		}
+		metrics[counter] = modifiedMetrics
 	}
 
 	return nil
 }
 
+// setPodAttributes adds the pod, namespace and container attributes, and the extra attributes of the pod.
+func (p *PodMapper) setPodAttributes(attributes map[string]string, podInfo PodInfo) {
+	if !p.Config.UseOldNamespace {
+		attributes[podAttribute] = podInfo.Name
+		attributes[namespaceAttribute] = podInfo.Namespace
+		attributes[containerAttribute] = podInfo.Container
+	} else {
+		attributes[oldPodAttribute] = podInfo.Name
+		attributes[oldNamespaceAttribute] = podInfo.Namespace
+		attributes[oldContainerAttribute] = podInfo.Container
+	}
+	maps.Copy(attributes, podInfo.Attributes)
+}
+
 func connectToServer(socket string) (*grpc.ClientConn, func(), error) {
 	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
 	defer cancel()
@@ -124,7 +154,7 @@ func connectToServer(socket string) (*grpc.ClientConn, func(), error) {
 	return conn, func() { conn.Close() }, nil
 }
 
-func (p *PodMapper) listPods(conn *grpc.ClientConn) (*podresourcesapi.ListPodResourcesResponse, error) {
+func listPods(conn *grpc.ClientConn) ([]*podresourcesapi.PodResources, error) {
 	client := podresourcesapi.NewPodResourcesListerClient(conn)
 
 	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
@@ -135,42 +165,131 @@ func (p *PodMapper) listPods(conn *grpc.ClientConn) (*podresourcesapi.ListPodRes
 		return nil, fmt.Errorf("failure getting pod resources; err: %w", err)
 	}
 
-	return resp, nil
+	return resp.GetPodResources(), nil
+}
+
+// listPodsV1alpha1 lists the pod resources with the v1alpha1 API, served by the kubelets older than 1.20, and
+// converts them to the v1 API.
+func listPodsV1alpha1(conn *grpc.ClientConn) ([]*podresourcesapi.PodResources, error) {
+	client := podresourcesv1alpha1.NewPodResourcesListerClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	resp, err := client.List(ctx, &podresourcesv1alpha1.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failure getting pod resources; err: %w", err)
+	}
+
+	pods := make([]*podresourcesapi.PodResources, 0, len(resp.GetPodResources()))
+	for _, pod := range resp.GetPodResources() {
+		containers := make([]*podresourcesapi.ContainerResources, 0, len(pod.GetContainers()))
+		for _, container := range pod.GetContainers() {
+			devices := make([]*podresourcesapi.ContainerDevices, 0, len(container.GetDevices()))
+			for _, device := range container.GetDevices() {
+				devices = append(devices, &podresourcesapi.ContainerDevices{
+					ResourceName: device.GetResourceName(),
+					DeviceIds:    device.GetDeviceIds(),
+				})
+			}
+			containers = append(containers, &podresourcesapi.ContainerResources{
+				Name:    container.GetName(),
+				Devices: devices,
+			})
+		}
+		pods = append(pods, &podresourcesapi.PodResources{
+			Name:       pod.GetName(),
+			Namespace:  pod.GetNamespace(),
+			Containers: containers,
+		})
+	}
+
+	return pods, nil
+}
+
+// getAllocatableDevices returns the devices the kubelet can allocate to pods.
+func getAllocatableDevices(conn *grpc.ClientConn) ([]*podresourcesapi.ContainerDevices, error) {
+	client := podresourcesapi.NewPodResourcesListerClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	resp, err := client.GetAllocatableResources(ctx, &podresourcesapi.AllocatableResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failure getting allocatable resources; err: %w", err)
+	}
+
+	return resp.GetDevices(), nil
+}
+
+// podAttributes returns the allow-listed labels and annotations, and the workload of the pod, nil when they
+// aren't added. The workload is added once resolved.
+func (p *PodMapper) podAttributes(pod *podresourcesapi.PodResources) map[string]string {
+	if p.podMetadata == nil {
+		return nil
+	}
+
+	metadata := p.podMetadata.get(pod.GetNamespace(), pod.GetName())
+	attributes := podMetadataAttributes(metadata, p.Config.KubernetesPodLabels, p.Config.KubernetesPodAnnotations)
+
+	if p.workloads != nil && metadata != nil {
+		if w, resolved := p.workloads.get(metadata); resolved {
+			attributes[workloadKindAttribute] = w.Kind
+			attributes[workloadNameAttribute] = w.Name
+		}
+	}
+
+	return attributes
+}
+
+// isNvidiaResource returns whether the kubelet resource is a GPU or a MIG device.
+func isNvidiaResource(resourceName string, nvidiaResourceNames []string) bool {
+	return resourceName == nvidiaResourceName || slices.Contains(nvidiaResourceNames, resourceName) ||
+		// Mig resources appear differently than GPU resources
+		strings.HasPrefix(resourceName, nvidiaMigResourcePrefix)
 }
 
 func (p *PodMapper) toDeviceToPod(
-	devicePods *podresourcesapi.ListPodResourcesResponse, sysInfo SystemInfo,
-) map[string]PodInfo {
-	deviceToPodMap := make(map[string]PodInfo)
+	pods []*podresourcesapi.PodResources, migDevices map[string]*nvmlprovider.MIGDeviceInfo, sysInfo SystemInfo,
+) map[string][]PodInfo {
+	deviceToPodMap := make(map[string][]PodInfo)
+	// The kubelet reports a GPU shared through time-slicing or MPS as replicated devices, like 'GPU-<uuid>::1',
+	// allocated to several pods
+	addPod := func(deviceID string, podInfo PodInfo) {
+		if !slices.ContainsFunc(deviceToPodMap[deviceID], func(other PodInfo) bool {
+			return other.Name == podInfo.Name && other.Namespace == podInfo.Namespace &&
+				other.Container == podInfo.Container
+		}) {
+			deviceToPodMap[deviceID] = append(deviceToPodMap[deviceID], podInfo)
+		}
+	}
 
-	for _, pod := range devicePods.GetPodResources() {
+	for _, pod := range pods {
 		for _, container := range pod.GetContainers() {
 			for _, device := range container.GetDevices() {
 
-				resourceName := device.GetResourceName()
-				if resourceName != nvidiaResourceName && !slices.Contains(p.Config.NvidiaResourceNames, resourceName) {
-					// Mig resources appear differently than GPU resources
-					if !strings.HasPrefix(resourceName, nvidiaMigResourcePrefix) {
-						continue
-					}
+				if !isNvidiaResource(device.GetResourceName(), p.Config.NvidiaResourceNames) {
+					continue
 				}
 
 				podInfo := PodInfo{
-					Name:      pod.GetName(),
-					Namespace: pod.GetNamespace(),
-					Container: container.GetName(),
+					Name:       pod.GetName(),
+					Namespace:  pod.GetNamespace(),
+					Container:  container.GetName(),
+					Attributes: p.podAttributes(pod),
 				}
 
 				for _, deviceID := range device.GetDeviceIds() {
 					if strings.HasPrefix(deviceID, MIG_UUID_PREFIX) {
-						migDevice, err := nvmlGetMIGDeviceInfoByIDHook(deviceID)
-						if err == nil {
+						if migDevice, exists := migDevices[deviceID]; exists {
 							giIdentifier := GetGPUInstanceIdentifier(sysInfo, migDevice.ParentUUID,
 								uint(migDevice.GPUInstanceID))
-							deviceToPodMap[giIdentifier] = podInfo
+							addPod(giIdentifier, podInfo)
 						}
+						// The pods of the MIG devices of a GPU don't share the GPU: only one of them is attributed
+						// the GPU, as the metrics of the GPU would otherwise be counted once per pod
 						gpuUUID := deviceID[len(MIG_UUID_PREFIX):]
-						deviceToPodMap[gpuUUID] = podInfo
+						deviceToPodMap[gpuUUID] = []PodInfo{podInfo}
 					} else if gkeMigDeviceIDMatches := gkeMigDeviceIDRegex.FindStringSubmatch(deviceID); gkeMigDeviceIDMatches != nil {
 						var gpuIndex string
 						var gpuInstanceID string
@@ -183,15 +302,15 @@ func (p *PodMapper) toDeviceToPod(
 							}
 						}
 						giIdentifier := fmt.Sprintf("%s-%s", gpuIndex, gpuInstanceID)
-						deviceToPodMap[giIdentifier] = podInfo
+						addPod(giIdentifier, podInfo)
 					} else if strings.Contains(deviceID, gkeVirtualGPUDeviceIDSeparator) {
-						deviceToPodMap[strings.Split(deviceID, gkeVirtualGPUDeviceIDSeparator)[0]] = podInfo
+						addPod(strings.Split(deviceID, gkeVirtualGPUDeviceIDSeparator)[0], podInfo)
 					} else if strings.Contains(deviceID, "::") {
 						gpuInstanceID := strings.Split(deviceID, "::")[0]
-						deviceToPodMap[gpuInstanceID] = podInfo
+						addPod(gpuInstanceID, podInfo)
 					}
 					// Default mapping between deviceID and pod information
-					deviceToPodMap[deviceID] = podInfo
+					addPod(deviceID, podInfo)
 				}
 			}
 		}
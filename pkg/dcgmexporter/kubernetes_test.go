@@ -122,6 +122,47 @@ func CreateTmpDir(t *testing.T) (string, func()) {
 	}
 }
 
+// testPodResourcesSocket starts a pod-resources server giving the GPUs to the gpu-pod-<i> pods, and
+// returns its socket path. The server is stopped at the end of the test.
+func testPodResourcesSocket(t *testing.T, gpus ...string) string {
+	tmpDir, cleanup := CreateTmpDir(t)
+	t.Cleanup(cleanup)
+	socketPath := tmpDir + "/kubelet.sock"
+
+	stopServer := startPodResourcesServer(t, socketPath, gpus)
+	t.Cleanup(stopServer)
+	return socketPath
+}
+
+// testPodResources returns a cache of a pod-resources server giving the GPUs to the gpu-pod-<i> pods,
+// after its first refresh. The cache and the server are stopped at the end of the test.
+func testPodResources(t *testing.T, gpus ...string) *podResourcesCache {
+	podResources := testPodResourcesCache(testPodResourcesSocket(t, gpus...))
+	t.Cleanup(podResources.close)
+	return podResources
+}
+
+// podMapperTestCounter is the counter of the metrics processed in the pod mapper tests.
+var podMapperTestCounter = Counter{FieldID: 155, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "gauge"}
+
+// processTestMetrics processes a podMapperTestCounter metric of each GPU with the pod mapper, and returns
+// the resulting metrics.
+func processTestMetrics(t *testing.T, podMapper *PodMapper, uuids ...string) []Metric {
+	metrics := MetricsByCounter{}
+	for i, uuid := range uuids {
+		metrics[podMapperTestCounter] = append(metrics[podMapperTestCounter], Metric{
+			GPU:        fmt.Sprint(i),
+			GPUUUID:    uuid,
+			Value:      "42",
+			Counter:    podMapperTestCounter,
+			Attributes: map[string]string{},
+		})
+	}
+
+	require.NoError(t, podMapper.Process(metrics, SystemInfo{}))
+	return metrics[podMapperTestCounter]
+}
+
 // Contains a list of UUIDs
 type PodResourcesMockServer struct {
 	resourceName string
@@ -335,3 +376,70 @@ func TestProcessPodMapper_WithD_Different_Format_Of_DeviceID(t *testing.T) {
 			})
 	}
 }
+
+func TestPodMapper_ProcessSharedGPUs(t *testing.T) {
+	nvmlGetMIGDeviceInfoByIDHook = func(uuid string) (*nvmlprovider.MIGDeviceInfo, error) {
+		return nil, fmt.Errorf("no MIG device '%s'", uuid)
+	}
+	defer func() {
+		nvmlGetMIGDeviceInfoByIDHook = nvmlprovider.GetMIGDeviceInfoByID
+	}()
+
+	// gpu-pod-0 and gpu-pod-1 share GPU-1 through time-slicing, gpu-pod-2 has GPU-2
+	sharedPodResources := testPodResources(t, "GPU-1::0", "GPU-1::1", "GPU-2")
+	// gpu-pod-0 and gpu-pod-1 have MIG devices of GPU-1, gpu-pod-2 has GPU-2
+	migPodResources := testPodResources(t, "MIG-GPU-1", "MIG-GPU-1", "GPU-2")
+
+	tests := []struct {
+		name         string
+		podResources *podResourcesCache
+		sharedGPUs   string
+		want         []map[string]string
+	}{
+		{
+			name:         "time-slicing " + SharedGPUsSeries,
+			podResources: sharedPodResources,
+			sharedGPUs:   SharedGPUsSeries,
+			want: []map[string]string{
+				{podAttribute: "gpu-pod-0", namespaceAttribute: "default", containerAttribute: "default"},
+				{podAttribute: "gpu-pod-1", namespaceAttribute: "default", containerAttribute: "default"},
+				{podAttribute: "gpu-pod-2", namespaceAttribute: "default", containerAttribute: "default"},
+			},
+		},
+		{
+			name:         "time-slicing " + SharedGPUsInfo,
+			podResources: sharedPodResources,
+			sharedGPUs:   SharedGPUsInfo,
+			want: []map[string]string{
+				{},
+				{podAttribute: "gpu-pod-2", namespaceAttribute: "default", containerAttribute: "default"},
+			},
+		},
+		{
+			// The GPU of MIG devices isn't shared, its metrics aren't repeated for each pod
+			name:         "MIG " + SharedGPUsSeries,
+			podResources: migPodResources,
+			sharedGPUs:   SharedGPUsSeries,
+			want: []map[string]string{
+				{podAttribute: "gpu-pod-1", namespaceAttribute: "default", containerAttribute: "default"},
+				{podAttribute: "gpu-pod-2", namespaceAttribute: "default", containerAttribute: "default"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			podMapper := &PodMapper{
+				Config:       &Config{KubernetesGPUIdType: GPUUID, KubernetesSharedGPUs: tt.sharedGPUs},
+				podResources: tt.podResources,
+			}
+
+			var got []map[string]string
+			for _, metric := range processTestMetrics(t, podMapper, "GPU-1", "GPU-2") {
+				assert.Equal(t, "42", metric.Value)
+				got = append(got, metric.Attributes)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// targetRetryInterval is how long a hostengine that couldn't be connected to is skipped, so that an unreachable
+// target doesn't delay the collection of the others on every collect interval.
+const targetRetryInterval = 30 * time.Second
+
+var dcgmUpdateAllFields = dcgm.UpdateAllFields
+
+var (
+	targetUpCounter = Counter{
+		FieldName: "dcgm_exporter_target_up",
+		PromType:  "gauge",
+		Help:      "Whether the last collection of the metrics of the remote hostengine succeeded (1) or failed (0).",
+	}
+	probeSuccessCounter = Counter{
+		FieldName: "dcgm_exporter_probe_success",
+		PromType:  "gauge",
+		Help:      "Whether the probe of the remote hostengine succeeded (1) or failed (0).",
+	}
+	probeDurationCounter = Counter{
+		FieldName: "dcgm_exporter_probe_duration_seconds",
+		PromType:  "gauge",
+		Help:      "Duration of the probe of the remote hostengine, in seconds.",
+	}
+)
+
+// TargetCollector collects the metrics of several remote hostengines. go-dcgm has a single connection per
+// process, so the hostengines are collected one at a time: for each collection, the TargetCollector connects to
+// the hostengine, discovers its entities, watches the fields of the counters, reads their values and disconnects.
+// As the watches don't outlive a collection, the counters can only read the latest value of their fields.
+type TargetCollector struct {
+	config   *Config
+	counters []Counter
+	connect  func(target string) (func(), error)
+
+	unreachableMtx sync.Mutex
+	unreachable    map[string]time.Time // When the targets that couldn't be connected to are retried
+}
+
+func NewTargetCollector(c *Config) (*TargetCollector, error) {
+	source, err := readCounterSource(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// The profiling fields average their samples since the previous read, which a new watch doesn't have
+	config := *c
+	if config.CollectDCP {
+		logrus.Warn("Not collecting DCP metrics in multi-target mode")
+		config.CollectDCP = false
+	}
+
+	cs, err := source.extract(&config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid counters; err: %w", err)
+	}
+	if err := validateTargetCounters(cs.DCGMCounters); err != nil {
+		return nil, err
+	}
+
+	return &TargetCollector{
+		config:   c,
+		counters: cs.DCGMCounters,
+		connect: func(target string) (func(), error) {
+			return dcgm.Init(dcgm.Standalone, target, "0")
+		},
+		unreachable: map[string]time.Time{},
+	}, nil
+}
+
+// validateTargetCounters rejects the counters that need the samples of their fields over several collections.
+func validateTargetCounters(counters []Counter) error {
+	for _, c := range counters {
+		switch {
+		case c.WatchInterval != 0 || c.KeepAge != 0:
+			return fmt.Errorf("counter '%s': watch intervals and keep ages aren't supported in multi-target mode",
+				c.FieldName)
+		case c.Aggregate:
+			return fmt.Errorf("counter '%s': aggregates aren't supported in multi-target mode", c.FieldName)
+		case c.PromType == "histogram" || c.PromType == "summary":
+			return fmt.Errorf("counter '%s': %ss aren't supported in multi-target mode", c.FieldName, c.PromType)
+		}
+	}
+
+	return nil
+}
+
+// Run collects the metrics of the targets of the config every collect interval, and sends them to out.
+func (t *TargetCollector) Run(out chan []*dto.MetricFamily, stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(time.Duration(t.config.CollectInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			families := t.collectTargets()
+			if len(out) == cap(out) {
+				logrus.Errorf("Channel is full skipping.")
+				pipelineChannelDrops.Inc()
+			} else {
+				out <- families
+			}
+		}
+	}
+}
+
+func (t *TargetCollector) collectTargets() []*dto.MetricFamily {
+	families := newMetricFamilyBuilder()
+	families.withTimestamps = t.config.EmitTimestamps
+
+	targetUp := MetricsByCounter{}
+	for _, target := range t.config.RemoteHETargets {
+		up := "1"
+		entities, err := t.collect(target)
+		if err != nil {
+			logrus.WithError(err).Errorf("Failed to collect the metrics of the hostengine at '%s'", target)
+			up = "0"
+		}
+		for _, e := range entities {
+			families.add(e.Metrics, e.identity)
+		}
+
+		targetUp[targetUpCounter] = append(targetUp[targetUpCounter], Metric{
+			Counter:    targetUpCounter,
+			Value:      up,
+			Attributes: map[string]string{"target": target},
+		})
+	}
+	families.add(targetUp, noIdentityLabels)
+
+	return families.build()
+}
+
+// Probe collects the metrics of the hostengine at target, along with the success and the duration of the probe.
+func (t *TargetCollector) Probe(target string) []*dto.MetricFamily {
+	start := time.Now()
+
+	families := newMetricFamilyBuilder()
+	families.withTimestamps = t.config.EmitTimestamps
+
+	success := "1"
+	entities, err := t.collect(target)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to probe the hostengine at '%s'", target)
+		success = "0"
+	}
+	for _, e := range entities {
+		families.add(e.Metrics, e.identity)
+	}
+
+	families.add(MetricsByCounter{
+		probeSuccessCounter:  {{Counter: probeSuccessCounter, Value: success}},
+		probeDurationCounter: {{Counter: probeDurationCounter, Value: fmt.Sprint(time.Since(start).Seconds())}},
+	}, noIdentityLabels)
+
+	return families.build()
+}
+
+// collect returns the metrics of the entities of the hostengine at target. It holds the DCGM connection, so
+// nothing else calls DCGM meanwhile. The metrics of the entity types that can be collected are returned along
+// with the error of the others.
+func (t *TargetCollector) collect(target string) ([]EntityMetrics, error) {
+	if retry, ok := t.retryTime(target); ok {
+		return nil, fmt.Errorf("the hostengine at '%s' was unreachable; retrying at %s", target,
+			retry.Format(time.RFC3339))
+	}
+
+	dcgmConnection.Lock()
+	defer dcgmConnection.Unlock()
+
+	cleanup, err := t.connect(target)
+	t.setReachable(target, err == nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the hostengine at '%s'; err: %w", target, err)
+	}
+	defer cleanup()
+	dcgmFieldsInit()
+	defer dcgmFieldsTerm()
+
+	config := *t.config
+	config.UseRemoteHE = true
+	config.RemoteHEInfo = target
+
+	sysInfo := NewEntityGroupTypeSystemInfo(t.counters, &config)
+	for _, entityType := range FieldEntityGroupTypeToMonitor {
+		if err := sysInfo.Load(entityType); err != nil {
+			logrus.Debugf("Not collecting %s metrics of '%s'; %s", entityType.String(), target, err)
+		}
+	}
+
+	pipeline := &MetricsPipeline{
+		config:   &config,
+		counters: t.counters,
+		hostname: targetHostname(target),
+	}
+	collectors, cleanups, err := newDCGMCollectors(&config, t.counters, pipeline.hostname, NewDCGMCollector, sysInfo)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.setCollectors(collectors, cleanups)
+	defer pipeline.cleanup()
+
+	// The fields were just watched, they have no samples until DCGM updates them
+	if err := dcgmUpdateAllFields(); err != nil {
+		return nil, fmt.Errorf("failed to update the fields of the hostengine at '%s'; err: %w", target, err)
+	}
+
+	var res []EntityMetrics
+	var errs []error
+	for _, c := range pipeline.entityCollectors() {
+		metrics, err := pipeline.collect(c)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		res = append(res, EntityMetrics{Entity: c.entity, Metrics: metrics, identity: c.labels})
+	}
+
+	return res, errors.Join(errs...)
+}
+
+// retryTime returns when the target is retried, if it was unreachable and isn't retried yet.
+func (t *TargetCollector) retryTime(target string) (time.Time, bool) {
+	t.unreachableMtx.Lock()
+	defer t.unreachableMtx.Unlock()
+
+	retry, ok := t.unreachable[target]
+	if !ok || !time.Now().Before(retry) {
+		return time.Time{}, false
+	}
+	return retry, true
+}
+
+// setReachable records whether the target could be connected to.
+func (t *TargetCollector) setReachable(target string, reachable bool) {
+	t.unreachableMtx.Lock()
+	defer t.unreachableMtx.Unlock()
+
+	if reachable {
+		delete(t.unreachable, target)
+		return
+	}
+
+	// Probes can be sent for any target, forget the ones that aren't probed anymore
+	now := time.Now()
+	for other, retry := range t.unreachable {
+		if !now.Before(retry) {
+			delete(t.unreachable, other)
+		}
+	}
+	t.unreachable[target] = now.Add(targetRetryInterval)
+}
+
+// targetHostname returns the Hostname label of the metrics of a target: its host.
+func targetHostname(target string) string {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return target
+	}
+	return host
+}
+
+// RegisterProbe serves the metrics of any remote hostengine under /probe?target=host:port, like the
+// Prometheus multi-target exporters.
+func (s *MetricsServer) RegisterProbe(t *TargetCollector) {
+	s.router.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "the 'target' parameter is missing", http.StatusBadRequest)
+			return
+		}
+		if _, port, err := net.SplitHostPort(target); err != nil {
+			http.Error(w, fmt.Sprintf("invalid target '%s'; expected host:port", target), http.StatusBadRequest)
+			return
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			http.Error(w, fmt.Sprintf("invalid port of the target '%s'", target), http.StatusBadRequest)
+			return
+		}
+
+		families := t.Probe(target)
+
+		format := s.negotiateFormat(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusOK)
+		if err := encodeMetricFamilies(w, format, families); err != nil {
+			logrus.WithError(err).Error("Failed to write response.")
+		}
+	}).Methods(http.MethodGet)
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTargetCollector(config *Config) (*TargetCollector, *[]string) {
+	var connected []string
+	return &TargetCollector{
+		config: config,
+		connect: func(target string) (func(), error) {
+			connected = append(connected, target)
+			return nil, errors.New("connection refused")
+		},
+		unreachable: map[string]time.Time{},
+	}, &connected
+}
+
+func TestTargetCollector_CollectTargets(t *testing.T) {
+	c, connected := newTestTargetCollector(&Config{RemoteHETargets: []string{"node1:5555", "node2:5555"}})
+
+	families := c.collectTargets()
+	assert.Equal(t, []string{"node1:5555", "node2:5555"}, *connected)
+
+	require.Len(t, families, 1)
+	assert.Equal(t, "dcgm_exporter_target_up", families[0].GetName())
+	require.Len(t, families[0].Metric, 2)
+	for i, target := range []string{"node1:5555", "node2:5555"} {
+		assert.Equal(t, map[string]string{"target": target}, labelValues(families[0].Metric[i].GetLabel()))
+		assert.Equal(t, 0.0, families[0].Metric[i].GetGauge().GetValue())
+	}
+}
+
+func TestTargetCollector_SkipsUnreachableTargets(t *testing.T) {
+	c, connected := newTestTargetCollector(&Config{RemoteHETargets: []string{"node1:5555"}})
+
+	c.collectTargets()
+	families := c.collectTargets()
+	assert.Equal(t, []string{"node1:5555"}, *connected, "the unreachable target is retried later")
+	require.Len(t, families, 1)
+	assert.Equal(t, 0.0, families[0].Metric[0].GetGauge().GetValue())
+
+	c.unreachable["node1:5555"] = time.Now()
+	c.collectTargets()
+	assert.Equal(t, []string{"node1:5555", "node1:5555"}, *connected)
+}
+
+func TestValidateTargetCounters(t *testing.T) {
+	counter := Counter{FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	assert.NoError(t, validateTargetCounters([]Counter{counter}))
+
+	for name, update := range map[string]func(c *Counter){
+		"watch interval": func(c *Counter) { c.WatchInterval = time.Second },
+		"keep age":       func(c *Counter) { c.KeepAge = time.Minute },
+		"aggregate":      func(c *Counter) { c.Aggregate = true },
+		"histogram":      func(c *Counter) { c.PromType = "histogram" },
+		"summary":        func(c *Counter) { c.PromType = "summary" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := counter
+			update(&c)
+			assert.ErrorContains(t, validateTargetCounters([]Counter{c}), "multi-target mode")
+		})
+	}
+}
+
+func TestTargetCollector_Probe(t *testing.T) {
+	c, connected := newTestTargetCollector(&Config{})
+
+	families := c.Probe("node1:5555")
+	assert.Equal(t, []string{"node1:5555"}, *connected)
+
+	require.Len(t, families, 2)
+	assert.Equal(t, "dcgm_exporter_probe_duration_seconds", families[0].GetName())
+	assert.Equal(t, "dcgm_exporter_probe_success", families[1].GetName())
+	assert.Equal(t, 0.0, families[1].Metric[0].GetGauge().GetValue())
+}
+
+func TestTargetCollector_ProbeFieldValues(t *testing.T) {
+	teardownTest := setupTest(t)
+	runOnlyWithLiveGPUs(t)
+	teardownTest(t)
+
+	counter := Counter{FieldID: 100, FieldName: "DCGM_FI_DEV_SM_CLOCK", PromType: "gauge"}
+	c := &TargetCollector{
+		config: &Config{
+			GPUDevices:      DeviceOptions{Flex: true, MajorRange: []int{-1}, MinorRange: []int{-1}},
+			CollectInterval: 1000,
+		},
+		counters: []Counter{counter},
+		connect: func(target string) (func(), error) {
+			// The embedded hostengine stands for the remote one
+			return dcgm.Init(dcgm.Embedded)
+		},
+		unreachable: map[string]time.Time{},
+	}
+
+	families := c.Probe("localhost:5555")
+
+	values := map[string]*dto.MetricFamily{}
+	for _, mf := range families {
+		values[mf.GetName()] = mf
+	}
+	require.Contains(t, values, "dcgm_exporter_probe_success")
+	assert.Equal(t, 1.0, values["dcgm_exporter_probe_success"].Metric[0].GetGauge().GetValue())
+	require.Contains(t, values, counter.FieldName, "the probe returns the values of the fields it just watched")
+	for _, m := range values[counter.FieldName].Metric {
+		assert.Positive(t, m.GetGauge().GetValue())
+	}
+}
+
+func TestRegisterProbe(t *testing.T) {
+	c, connected := newTestTargetCollector(&Config{})
+
+	s, _, err := NewMetricsServer(&Config{}, nil, NewRegistry())
+	require.NoError(t, err)
+	s.RegisterProbe(c)
+
+	probe := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probe"+query, nil))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusBadRequest, probe("").Code)
+	assert.Equal(t, http.StatusBadRequest, probe("?target=node1").Code)
+	assert.Equal(t, http.StatusBadRequest, probe("?target=node1:http").Code)
+	assert.Empty(t, *connected)
+
+	rec := probe("?target=node1:5555")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "dcgm_exporter_probe_success 0")
+	assert.Equal(t, []string{"node1:5555"}, *connected)
+}
+
+func TestTargetHostname(t *testing.T) {
+	assert.Equal(t, "node1", targetHostname("node1:5555"))
+	assert.Equal(t, "::1", targetHostname("[::1]:5555"))
+	assert.Equal(t, "node1", targetHostname("node1"))
+}
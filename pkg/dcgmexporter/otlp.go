@@ -0,0 +1,468 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	OTLPProtocolGRPC = "grpc"
+	OTLPProtocolHTTP = "http/protobuf"
+
+	otlpTimeout = 30 * time.Second
+)
+
+// otlpScope is the instrumentation scope of the exported metrics.
+var otlpScope = &commonpb.InstrumentationScope{Name: "github.com/NVIDIA/dcgm-exporter"}
+
+// OTLPExporter pushes the metrics collected by the pipeline to an OpenTelemetry collector, over OTLP/gRPC
+// or OTLP/HTTP. The identity of the entities is exported as resource attributes, the pod and HPC job
+// attributes as data point attributes.
+type OTLPExporter struct {
+	sender    *pushSender[*collectormetrics.ExportMetricsServiceRequest]
+	startTime time.Time // Start time of the cumulative metrics
+	close     func() error
+}
+
+// NewOTLPExporter creates an OTLPExporter that pushes the metrics to the OTLP endpoint of the config.
+func NewOTLPExporter(c *Config) (*OTLPExporter, error) {
+	headers, err := parseOTLPHeaders(c.OTLPHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &OTLPExporter{
+		startTime: time.Now(),
+		close:     func() error { return nil },
+	}
+
+	var send func(context.Context, *collectormetrics.ExportMetricsServiceRequest) error
+	switch c.OTLPProtocol {
+	case OTLPProtocolGRPC:
+		creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+		if c.OTLPInsecure {
+			creds = insecure.NewCredentials()
+		}
+
+		conn, err := grpc.NewClient(c.OTLPEndpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("could not create OTLP gRPC client; err: %w", err)
+		}
+		send = otlpGRPCSender(collectormetrics.NewMetricsServiceClient(conn), headers)
+		e.close = conn.Close
+	case OTLPProtocolHTTP:
+		url := strings.TrimSuffix(c.OTLPEndpoint, "/") + "/v1/metrics"
+		send = otlpHTTPSender(&http.Client{Timeout: otlpTimeout}, url, headers)
+	default:
+		return nil, fmt.Errorf("invalid OTLP protocol '%s'; expected '%s' or '%s'", c.OTLPProtocol,
+			OTLPProtocolGRPC, OTLPProtocolHTTP)
+	}
+
+	e.sender = newPushSender("otlp", c.OTLPQueueSize, send)
+	return e, nil
+}
+
+// parseOTLPHeaders parses headers given as key=value.
+func parseOTLPHeaders(headers []string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, header := range headers {
+		key, value, ok := strings.Cut(header, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid OTLP header '%s'; expected key=value", header)
+		}
+		res[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return res, nil
+}
+
+func (e *OTLPExporter) Run(stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	e.sender.run(stop)
+
+	if err := e.close(); err != nil {
+		logrus.WithError(err).Warn("Failed to close the OTLP client")
+	}
+}
+
+// Write queues the metrics to be pushed.
+func (e *OTLPExporter) Write(metrics []EntityMetrics) {
+	req := encodeOTLPRequest(metrics, e.startTime, time.Now())
+	if len(req.ResourceMetrics) == 0 {
+		return
+	}
+
+	e.sender.queue.push(req)
+}
+
+func otlpGRPCSender(client collectormetrics.MetricsServiceClient,
+	headers map[string]string,
+) func(context.Context, *collectormetrics.ExportMetricsServiceRequest) error {
+	md := metadata.New(headers)
+
+	return func(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest) error {
+		ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, md), otlpTimeout)
+		defer cancel()
+
+		_, err := client.Export(ctx, req)
+		switch status.Code(err) {
+		case codes.OK:
+			return nil
+		case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.OutOfRange,
+			codes.Unavailable, codes.DataLoss:
+			return recoverableError{err}
+		default:
+			return err
+		}
+	}
+}
+
+func otlpHTTPSender(client *http.Client, url string,
+	headers map[string]string,
+) func(context.Context, *collectormetrics.ExportMetricsServiceRequest) error {
+	return func(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest) error {
+		body, err := proto.Marshal(req)
+		if err != nil {
+			return err
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Content-Type", "application/x-protobuf")
+		for key, value := range headers {
+			httpReq.Header.Set(key, value)
+		}
+
+		resp, err := client.Do(httpReq)
+		if err != nil {
+			return recoverableError{err}
+		}
+		defer resp.Body.Close()
+
+		return responseError(resp)
+	}
+}
+
+// otlpResource holds the metrics of a resource while they are encoded.
+type otlpResource struct {
+	attributes []*commonpb.KeyValue
+	metrics    map[string]*metricspb.Metric
+}
+
+// encodeOTLPRequest converts the metrics into an OTLP export request, with a resource per entity. Counters are
+// exported as cumulative monotonic sums starting at startTime. Metrics without a timestamp are timestamped with now.
+func encodeOTLPRequest(metrics []EntityMetrics, startTime, now time.Time,
+) *collectormetrics.ExportMetricsServiceRequest {
+	resources := map[string]*otlpResource{}
+
+	for _, em := range metrics {
+		for counter, values := range em.Metrics {
+			if counter.PromType == "label" {
+				continue
+			}
+
+			staticLabels := counter.StaticLabels()
+			for _, m := range values {
+				identity := em.identity(m)
+				key := labelPairsKey(identity)
+				r, exists := resources[key]
+				if !exists {
+					r = &otlpResource{
+						attributes: append(otlpAttributes(identity), otlpAttribute("service.name", "dcgm-exporter")),
+						metrics:    map[string]*metricspb.Metric{},
+					}
+					resources[key] = r
+				}
+
+				om, exists := r.metrics[counter.Name()]
+				if !exists {
+					om = newOTLPMetric(counter)
+					r.metrics[counter.Name()] = om
+				}
+
+				ts := now
+				if !m.Timestamp.IsZero() {
+					ts = m.Timestamp
+				}
+				attributes := otlpAttributes(metricLabelPairs(m, staticLabels, noIdentityLabels))
+				appendOTLPDataPoint(om, counter, m, attributes, startTime, ts)
+			}
+		}
+	}
+
+	req := &collectormetrics.ExportMetricsServiceRequest{}
+	for _, key := range sortedKeys(resources) {
+		r := resources[key]
+
+		var ms []*metricspb.Metric
+		for _, name := range sortedKeys(r.metrics) {
+			if om := r.metrics[name]; otlpDataPointCount(om) > 0 {
+				ms = append(ms, om)
+			}
+		}
+		if len(ms) == 0 {
+			continue
+		}
+
+		req.ResourceMetrics = append(req.ResourceMetrics, &metricspb.ResourceMetrics{
+			Resource:     &resourcepb.Resource{Attributes: r.attributes},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Scope: otlpScope, Metrics: ms}},
+		})
+	}
+
+	return req
+}
+
+// newOTLPMetric returns an empty OTLP metric of the type of the counter. Histograms without classic buckets
+// are exported as exponential histograms.
+func newOTLPMetric(counter Counter) *metricspb.Metric {
+	om := &metricspb.Metric{
+		Name:        counter.Name(),
+		Description: counter.Help,
+		Unit:        counter.Unit,
+	}
+
+	cumulative := metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	switch counter.PromType {
+	case "counter":
+		om.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{AggregationTemporality: cumulative, IsMonotonic: true}}
+	case "histogram":
+		if counter.NativeHistogramBucketFactor > 0 && len(counter.Buckets()) == 0 {
+			om.Data = &metricspb.Metric_ExponentialHistogram{
+				ExponentialHistogram: &metricspb.ExponentialHistogram{AggregationTemporality: cumulative},
+			}
+		} else {
+			om.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{AggregationTemporality: cumulative}}
+		}
+	case "summary":
+		om.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{}}
+	default:
+		om.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+	}
+	return om
+}
+
+// appendOTLPDataPoint appends the value of the metric to the data points of the OTLP metric.
+// Non-numeric values and distributions missing their samples are skipped.
+func appendOTLPDataPoint(om *metricspb.Metric, counter Counter, m Metric, attributes []*commonpb.KeyValue,
+	startTime, ts time.Time,
+) {
+	start := uint64(startTime.UnixNano())
+	timestamp := uint64(ts.UnixNano())
+
+	switch data := om.Data.(type) {
+	case *metricspb.Metric_Histogram:
+		if m.Histogram == nil {
+			return
+		}
+		dp := otlpHistogramDataPoint(m.Histogram)
+		dp.Attributes, dp.StartTimeUnixNano, dp.TimeUnixNano = attributes, start, timestamp
+		data.Histogram.DataPoints = append(data.Histogram.DataPoints, dp)
+		return
+	case *metricspb.Metric_ExponentialHistogram:
+		if m.Histogram == nil {
+			return
+		}
+		dp := otlpExponentialHistogramDataPoint(m.Histogram)
+		dp.Attributes, dp.StartTimeUnixNano, dp.TimeUnixNano = attributes, start, timestamp
+		data.ExponentialHistogram.DataPoints = append(data.ExponentialHistogram.DataPoints, dp)
+		return
+	case *metricspb.Metric_Summary:
+		if m.Summary == nil {
+			return
+		}
+		dp := otlpSummaryDataPoint(m.Summary)
+		dp.Attributes, dp.StartTimeUnixNano, dp.TimeUnixNano = attributes, start, timestamp
+		data.Summary.DataPoints = append(data.Summary.DataPoints, dp)
+		return
+	}
+
+	value, err := strconv.ParseFloat(m.Value, 64)
+	if err != nil {
+		logrus.WithError(err).Debugf("Skipping non-numeric value '%s' of the '%s' metric", m.Value,
+			counter.FieldName)
+		return
+	}
+	if counter.Scale != 0 {
+		value *= counter.Scale
+	}
+
+	dp := &metricspb.NumberDataPoint{
+		Attributes:   attributes,
+		TimeUnixNano: timestamp,
+		Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+	switch data := om.Data.(type) {
+	case *metricspb.Metric_Sum:
+		dp.StartTimeUnixNano = start
+		data.Sum.DataPoints = append(data.Sum.DataPoints, dp)
+	case *metricspb.Metric_Gauge:
+		data.Gauge.DataPoints = append(data.Gauge.DataPoints, dp)
+	}
+}
+
+// otlpHistogramDataPoint converts the cumulative classic buckets of a histogram into OTLP bucket counts,
+// the last count being the one of the +Inf bucket.
+func otlpHistogramDataPoint(h *dto.Histogram) *metricspb.HistogramDataPoint {
+	dp := &metricspb.HistogramDataPoint{
+		Count: h.GetSampleCount(),
+		Sum:   ptr.To(h.GetSampleSum()),
+	}
+
+	var previous uint64
+	for _, bucket := range h.Bucket {
+		dp.ExplicitBounds = append(dp.ExplicitBounds, bucket.GetUpperBound())
+		dp.BucketCounts = append(dp.BucketCounts, bucket.GetCumulativeCount()-previous)
+		previous = bucket.GetCumulativeCount()
+	}
+	dp.BucketCounts = append(dp.BucketCounts, h.GetSampleCount()-previous)
+
+	return dp
+}
+
+func otlpExponentialHistogramDataPoint(h *dto.Histogram) *metricspb.ExponentialHistogramDataPoint {
+	return &metricspb.ExponentialHistogramDataPoint{
+		Count:         h.GetSampleCount(),
+		Sum:           ptr.To(h.GetSampleSum()),
+		Scale:         h.GetSchema(),
+		ZeroCount:     h.GetZeroCount(),
+		ZeroThreshold: h.GetZeroThreshold(),
+		Positive:      otlpExponentialBuckets(h.PositiveSpan, h.PositiveDelta),
+		Negative:      otlpExponentialBuckets(h.NegativeSpan, h.NegativeDelta),
+	}
+}
+
+// otlpExponentialBuckets converts the sparse buckets of a native histogram, given as spans of delta-encoded
+// counts, into the dense buckets of an OTLP exponential histogram.
+func otlpExponentialBuckets(spans []*dto.BucketSpan,
+	deltas []int64,
+) *metricspb.ExponentialHistogramDataPoint_Buckets {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	var counts []uint64
+	var count int64
+	i := 0
+	for s, span := range spans {
+		if s > 0 {
+			// The offset of the following spans is the gap since the end of the previous one
+			for j := int32(0); j < span.GetOffset(); j++ {
+				counts = append(counts, 0)
+			}
+		}
+		for j := uint32(0); j < span.GetLength() && i < len(deltas); j++ {
+			count += deltas[i]
+			i++
+			counts = append(counts, uint64(count))
+		}
+	}
+
+	// The Prometheus bucket of index i covers (base^(i-1), base^i], the OTLP one (base^i, base^(i+1)]
+	return &metricspb.ExponentialHistogramDataPoint_Buckets{
+		Offset:       spans[0].GetOffset() - 1,
+		BucketCounts: counts,
+	}
+}
+
+func otlpSummaryDataPoint(s *dto.Summary) *metricspb.SummaryDataPoint {
+	dp := &metricspb.SummaryDataPoint{
+		Count: s.GetSampleCount(),
+		Sum:   s.GetSampleSum(),
+	}
+	for _, q := range s.Quantile {
+		dp.QuantileValues = append(dp.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+			Quantile: q.GetQuantile(),
+			Value:    q.GetValue(),
+		})
+	}
+	return dp
+}
+
+func otlpDataPointCount(om *metricspb.Metric) int {
+	switch data := om.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		return len(data.Gauge.DataPoints)
+	case *metricspb.Metric_Sum:
+		return len(data.Sum.DataPoints)
+	case *metricspb.Metric_Histogram:
+		return len(data.Histogram.DataPoints)
+	case *metricspb.Metric_ExponentialHistogram:
+		return len(data.ExponentialHistogram.DataPoints)
+	case *metricspb.Metric_Summary:
+		return len(data.Summary.DataPoints)
+	default:
+		return 0
+	}
+}
+
+// otlpAttributes converts label pairs into OTLP attributes. Empty labels are omitted, as in the Prometheus format.
+func otlpAttributes(labels []*dto.LabelPair) []*commonpb.KeyValue {
+	var res []*commonpb.KeyValue
+	for _, l := range labels {
+		if l.GetValue() == "" {
+			continue
+		}
+		res = append(res, otlpAttribute(l.GetName(), l.GetValue()))
+	}
+	return res
+}
+
+func otlpAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+// labelPairsKey returns a key identifying the label pairs.
+func labelPairsKey(labels []*dto.LabelPair) string {
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteString(l.GetName())
+		sb.WriteByte(0xff)
+		sb.WriteString(l.GetValue())
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
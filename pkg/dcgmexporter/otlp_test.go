@@ -0,0 +1,347 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/utils/ptr"
+)
+
+func otlpAttributeMap(attributes []*commonpb.KeyValue) map[string]string {
+	res := map[string]string{}
+	for _, kv := range attributes {
+		res[kv.Key] = kv.Value.GetStringValue()
+	}
+	return res
+}
+
+func testEntityMetrics() []EntityMetrics {
+	power := Counter{FieldID: 155, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "gauge", Help: "Power draw (in W).", Unit: "watts"}
+	energy := Counter{FieldID: 156, FieldName: "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", PromType: "counter", Help: "Total energy consumption since boot (in mJ).", Scale: 0.001}
+	temp := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "histogram", Help: "GPU temperature (in C)."}.
+		WithBuckets([]float64{40, 60})
+
+	gpu := func(id, uuid string) Metric {
+		return Metric{GPU: id, UUID: "UUID", GPUUUID: uuid, GPUModelName: "NVIDIA H100", Hostname: "node"}
+	}
+	withValue := func(m Metric, counter Counter, value string) Metric {
+		m.Counter, m.Value = counter, value
+		return m
+	}
+
+	pod := withValue(gpu("0", "GPU-0"), power, "42")
+	pod.Attributes = map[string]string{"pod": "trainer", "namespace": "ml", "container": "main"}
+	pod.Timestamp = time.Unix(1700000000, 0)
+
+	hist := gpu("1", "GPU-1")
+	hist.Counter = temp
+	hist.Histogram = &dto.Histogram{
+		SampleCount: ptr.To(uint64(3)),
+		SampleSum:   ptr.To(float64(175)),
+		Bucket: []*dto.Bucket{
+			{UpperBound: ptr.To(float64(40)), CumulativeCount: ptr.To(uint64(1))},
+			{UpperBound: ptr.To(float64(60)), CumulativeCount: ptr.To(uint64(2))},
+		},
+	}
+
+	return []EntityMetrics{
+		{
+			Entity: "gpu",
+			Metrics: MetricsByCounter{
+				power:  {pod, withValue(gpu("1", "GPU-1"), power, "43")},
+				energy: {withValue(gpu("0", "GPU-0"), energy, "5000"), withValue(gpu("1", "GPU-1"), energy, "n/a")},
+				temp:   {hist},
+			},
+			identity: gpuMetricLabels,
+		},
+		{
+			Entity: "switch",
+			Metrics: MetricsByCounter{
+				power: {{Counter: power, Value: "12", GPU: "0", Hostname: "node"}},
+			},
+			identity: switchMetricLabels,
+		},
+	}
+}
+
+func TestEncodeOTLPRequest(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	now := time.Unix(1700000010, 0)
+
+	req := encodeOTLPRequest(testEntityMetrics(), start, now)
+	require.Len(t, req.ResourceMetrics, 3)
+
+	resources := map[string]*metricspb.ResourceMetrics{}
+	for _, rm := range req.ResourceMetrics {
+		attributes := otlpAttributeMap(rm.Resource.Attributes)
+		assert.Equal(t, "dcgm-exporter", attributes["service.name"])
+		assert.Equal(t, "node", attributes["Hostname"])
+		resources[attributes["UUID"]+attributes["nvswitch"]] = rm
+	}
+
+	gpu0 := resources["GPU-0"]
+	require.NotNil(t, gpu0)
+	assert.Equal(t, map[string]string{
+		"service.name": "dcgm-exporter", "gpu": "0", "UUID": "GPU-0", "modelName": "NVIDIA H100", "Hostname": "node",
+	}, otlpAttributeMap(gpu0.Resource.Attributes))
+
+	metrics := gpu0.ScopeMetrics[0].Metrics
+	require.Len(t, metrics, 2)
+
+	power := metrics[0]
+	assert.Equal(t, "DCGM_FI_DEV_POWER_USAGE", power.Name)
+	assert.Equal(t, "watts", power.Unit)
+	require.Len(t, power.GetGauge().DataPoints, 1)
+	dp := power.GetGauge().DataPoints[0]
+	assert.Equal(t, float64(42), dp.GetAsDouble())
+	assert.Equal(t, uint64(time.Unix(1700000000, 0).UnixNano()), dp.TimeUnixNano)
+	assert.Equal(t, map[string]string{"pod": "trainer", "namespace": "ml", "container": "main"},
+		otlpAttributeMap(dp.Attributes))
+
+	energy := metrics[1]
+	require.NotNil(t, energy.GetSum())
+	assert.True(t, energy.GetSum().IsMonotonic)
+	assert.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		energy.GetSum().AggregationTemporality)
+	require.Len(t, energy.GetSum().DataPoints, 1)
+	assert.Equal(t, float64(5), energy.GetSum().DataPoints[0].GetAsDouble())
+	assert.Equal(t, uint64(start.UnixNano()), energy.GetSum().DataPoints[0].StartTimeUnixNano)
+	assert.Equal(t, uint64(now.UnixNano()), energy.GetSum().DataPoints[0].TimeUnixNano)
+
+	// The non-numeric energy of GPU 1 is skipped
+	gpu1 := resources["GPU-1"]
+	require.NotNil(t, gpu1)
+	metrics = gpu1.ScopeMetrics[0].Metrics
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "DCGM_FI_DEV_GPU_TEMP", metrics[0].Name)
+	require.Len(t, metrics[0].GetHistogram().DataPoints, 1)
+	h := metrics[0].GetHistogram().DataPoints[0]
+	assert.Equal(t, uint64(3), h.Count)
+	assert.Equal(t, float64(175), h.GetSum())
+	assert.Equal(t, []float64{40, 60}, h.ExplicitBounds)
+	assert.Equal(t, []uint64{1, 1, 1}, h.BucketCounts)
+
+	nvswitch := resources["0"]
+	require.NotNil(t, nvswitch)
+	assert.Equal(t, float64(12), nvswitch.ScopeMetrics[0].Metrics[0].GetGauge().DataPoints[0].GetAsDouble())
+}
+
+func TestEncodeOTLPRequest_ExporterMetrics(t *testing.T) {
+	xidCounter := Counter{FieldName: "DCGM_EXP_XID_ERRORS_COUNT", PromType: "gauge"}
+	req := encodeOTLPRequest([]EntityMetrics{{
+		Entity: "exporter",
+		Metrics: MetricsByCounter{xidCounter: {{
+			Counter: xidCounter, Value: "2", GPU: "0", UUID: "UUID", GPUUUID: "GPU-0", Hostname: "node",
+			Attributes: map[string]string{"xid_error": "43"},
+		}}},
+		identity: exporterMetricLabels,
+	}}, time.Unix(1600000000, 0), time.Unix(1700000000, 0))
+
+	require.Len(t, req.ResourceMetrics, 1)
+	rm := req.ResourceMetrics[0]
+	assert.Equal(t, "GPU-0", otlpAttributeMap(rm.Resource.Attributes)["UUID"])
+	metric := rm.ScopeMetrics[0].Metrics[0]
+	assert.Equal(t, "DCGM_EXP_XID_ERRORS_COUNT", metric.Name)
+	dp := metric.GetGauge().DataPoints[0]
+	assert.Equal(t, float64(2), dp.GetAsDouble())
+	assert.Equal(t, map[string]string{"xid_error": "43"}, otlpAttributeMap(dp.Attributes))
+}
+
+func TestOTLPExponentialBuckets(t *testing.T) {
+	// Prometheus buckets 2, 3 and 6 with counts 1, 3 and 2
+	buckets := otlpExponentialBuckets([]*dto.BucketSpan{
+		{Offset: ptr.To(int32(2)), Length: ptr.To(uint32(2))},
+		{Offset: ptr.To(int32(2)), Length: ptr.To(uint32(1))},
+	}, []int64{1, 2, -1})
+
+	require.NotNil(t, buckets)
+	assert.Equal(t, int32(1), buckets.Offset)
+	assert.Equal(t, []uint64{1, 3, 0, 0, 2}, buckets.BucketCounts)
+
+	assert.Nil(t, otlpExponentialBuckets(nil, nil))
+}
+
+func TestOTLPExporter_HTTP(t *testing.T) {
+	received := make(chan *collectormetrics.ExportMetricsServiceRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		req := &collectormetrics.ExportMetricsServiceRequest{}
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Authorization") != "Bearer token" ||
+			proto.Unmarshal(b, req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- req
+	}))
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(&Config{
+		OTLPEndpoint:  server.URL,
+		OTLPProtocol:  OTLPProtocolHTTP,
+		OTLPHeaders:   []string{"Authorization=Bearer token"},
+		OTLPQueueSize: 10,
+	})
+	require.NoError(t, err)
+
+	exporter.Write(testEntityMetrics())
+	req, ok := exporter.sender.queue.pop()
+	require.True(t, ok)
+	require.True(t, exporter.sender.sendWithRetry(context.Background(), req))
+
+	select {
+	case req := <-received:
+		assert.Len(t, req.ResourceMetrics, 3)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the OTLP request")
+	}
+}
+
+type otlpReceiver struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+	codes    []codes.Code // Codes of the next responses, OK when empty
+	received chan *collectormetrics.ExportMetricsServiceRequest
+}
+
+func (r *otlpReceiver) Export(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest,
+) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	if md, _ := metadata.FromIncomingContext(ctx); len(md.Get("x-tenant")) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "missing tenant")
+	}
+	if len(r.codes) > 0 {
+		code := r.codes[0]
+		r.codes = r.codes[1:]
+		return nil, status.Error(code, "failed")
+	}
+	r.received <- req
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+func TestOTLPExporter_GRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	receiver := &otlpReceiver{
+		codes:    []codes.Code{codes.Unavailable},
+		received: make(chan *collectormetrics.ExportMetricsServiceRequest, 1),
+	}
+	server := grpc.NewServer()
+	collectormetrics.RegisterMetricsServiceServer(server, receiver)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	exporter, err := NewOTLPExporter(&Config{
+		OTLPEndpoint:  listener.Addr().String(),
+		OTLPProtocol:  OTLPProtocolGRPC,
+		OTLPInsecure:  true,
+		OTLPHeaders:   []string{"x-tenant=gpu"},
+		OTLPQueueSize: 10,
+	})
+	require.NoError(t, err)
+	exporter.sender.minBackoff = time.Millisecond
+	defer exporter.close()
+
+	// The unavailable receiver is retried
+	exporter.Write(testEntityMetrics())
+	req, ok := exporter.sender.queue.pop()
+	require.True(t, ok)
+	require.True(t, exporter.sender.sendWithRetry(context.Background(), req))
+
+	select {
+	case req := <-receiver.received:
+		assert.Len(t, req.ResourceMetrics, 3)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the OTLP request")
+	}
+}
+
+type blockingOTLPReceiver struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+	received chan struct{}
+}
+
+func (r *blockingOTLPReceiver) Export(ctx context.Context, req *collectormetrics.ExportMetricsServiceRequest,
+) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	r.received <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestOTLPExporter_StopCancelsExport(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	receiver := &blockingOTLPReceiver{received: make(chan struct{}, 1)}
+	server := grpc.NewServer()
+	collectormetrics.RegisterMetricsServiceServer(server, receiver)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	exporter, err := NewOTLPExporter(&Config{
+		OTLPEndpoint:  listener.Addr().String(),
+		OTLPProtocol:  OTLPProtocolGRPC,
+		OTLPInsecure:  true,
+		OTLPQueueSize: 10,
+	})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	stop := make(chan interface{})
+	go exporter.Run(stop, &wg)
+
+	exporter.Write(testEntityMetrics())
+	select {
+	case <-receiver.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the OTLP request")
+	}
+
+	close(stop)
+	require.NoError(t, WaitWithTimeout(&wg, time.Second), "stopping didn't cancel the export in flight")
+}
+
+func TestNewOTLPExporter_Invalid(t *testing.T) {
+	_, err := NewOTLPExporter(&Config{OTLPEndpoint: "localhost:4317", OTLPProtocol: "thrift"})
+	assert.ErrorContains(t, err, "invalid OTLP protocol")
+
+	_, err = NewOTLPExporter(&Config{OTLPEndpoint: "localhost:4317", OTLPProtocol: OTLPProtocolGRPC,
+		OTLPHeaders: []string{"no-value"}})
+	assert.ErrorContains(t, err, "invalid OTLP header")
+}
@@ -20,10 +20,15 @@ import (
 	"context"
 	"encoding/csv"
 	"fmt"
+	"io"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/prometheus/common/model"
 	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -37,43 +42,97 @@ const (
 )
 
 func GetCounterSet(c *Config) (*CounterSet, error) {
-	var (
-		err     error
-		records [][]string
-	)
+	if c.ConfigMapData == undefinedConfigMapData {
+		logrus.Infof("Falling back to metric file '%s'", c.CollectorsFile)
+	}
+
+	source, err := readCounterSource(c)
+	if err != nil {
+		logrus.Error(err)
+		return new(CounterSet), err
+	}
+
+	return source.extract(c)
+}
+
+// counterSpec is an entry of a YAML or JSON counters file.
+type counterSpec struct {
+	Field         string            `json:"field"`
+	Type          string            `json:"type"`
+	Help          string            `json:"help"`
+	Name          string            `json:"name,omitempty"`
+	Unit          string            `json:"unit,omitempty"`
+	Scale         float64           `json:"scale,omitempty"`
+	EntityTypes   []string          `json:"entityTypes,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	WatchInterval string            `json:"watchInterval,omitempty"`
+	KeepAge       string            `json:"keepAge,omitempty"`
+	Aggregate     bool              `json:"aggregate,omitempty"`
+
+	Buckets                     []float64 `json:"buckets,omitempty"`
+	NativeHistogramBucketFactor float64   `json:"nativeHistogramBucketFactor,omitempty"`
+	Quantiles                   []float64 `json:"quantiles,omitempty"`
+}
+
+// countersFile is the layout of a YAML or JSON counters file.
+type countersFile struct {
+	Counters []counterSpec `json:"counters"`
+}
+
+// counterSource holds the counters as read from the ConfigMap or the counters file,
+// either as CSV records or as the entries of a YAML or JSON file.
+type counterSource struct {
+	records [][]string
+	specs   []counterSpec
+}
+
+func (s counterSource) extract(c *Config) (*CounterSet, error) {
+	if s.specs != nil {
+		return extractCounterSpecs(s.specs, c)
+	}
 
-	res := new(CounterSet)
+	// extractCounters trims the records in place, keep the source as read
+	return extractCounters(cloneRecords(s.records), c)
+}
 
+// readCounterSource reads the counters from the ConfigMap when one is specified, from the counters file otherwise.
+func readCounterSource(c *Config) (counterSource, error) {
 	if c.ConfigMapData != undefinedConfigMapData {
-		var client kubernetes.Interface
-		client, err = getKubeClient()
+		client, err := getKubeClient()
 		if err != nil {
-			logrus.Fatal(err)
+			return counterSource{}, err
 		}
-		records, err = readConfigMap(client, c)
+		records, err := readConfigMap(client, c)
 		if err != nil {
-			logrus.Fatal(err)
+			return counterSource{}, err
 		}
-	} else {
-		err = fmt.Errorf("no configmap data specified")
+		return counterSource{records: records}, nil
 	}
 
-	if err != nil || c.ConfigMapData == undefinedConfigMapData {
-		logrus.Infof("Falling back to metric file '%s'", c.CollectorsFile)
-
-		records, err = ReadCSVFile(c.CollectorsFile)
+	if isStructuredCountersFile(c.CollectorsFile) {
+		specs, err := readCountersFile(c.CollectorsFile)
 		if err != nil {
-			logrus.Errorf("Could not read metrics file '%s'; err: %v", c.CollectorsFile, err)
-			return res, err
+			return counterSource{}, fmt.Errorf("could not read metrics file '%s'; err: %w", c.CollectorsFile, err)
 		}
+		return counterSource{specs: specs}, nil
 	}
 
-	res, err = extractCounters(records, c)
+	records, err := ReadCSVFile(c.CollectorsFile)
 	if err != nil {
-		return res, err
+		return counterSource{}, fmt.Errorf("could not read metrics file '%s'; err: %w", c.CollectorsFile, err)
 	}
 
-	return res, err
+	return counterSource{records: records}, nil
+}
+
+// isStructuredCountersFile returns true when the counters file is a YAML or a JSON file, based on its extension.
+func isStructuredCountersFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
 }
 
 func ReadCSVFile(filename string) ([][]string, error) {
@@ -91,11 +150,37 @@ func ReadCSVFile(filename string) ([][]string, error) {
 	return records, err
 }
 
+// readCountersFile reads the entries of a YAML or JSON counters file. JSON being a subset of YAML,
+// both are parsed the same way.
+func readCountersFile(filename string) ([]counterSpec, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var f countersFile
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("malformed counters file; err: %w", err)
+	}
+
+	if f.Counters == nil {
+		f.Counters = []counterSpec{}
+	}
+
+	return f.Counters, nil
+}
+
 func extractCounters(records [][]string, c *Config) (*CounterSet, error) {
 	res := CounterSet{}
 
 	for i, record := range records {
-		useOld := false
 		if len(record) == 0 {
 			continue
 		}
@@ -110,49 +195,164 @@ func extractCounters(records [][]string, c *Config) (*CounterSet, error) {
 				record)
 		}
 
-		fieldID, ok := dcgm.DCGM_FI[record[0]]
-		oldFieldID, oldOk := dcgm.OLD_DCGM_FI[record[0]]
-		if !ok && !oldOk {
+		spec := counterSpec{Field: record[0], Type: record[1], Help: record[2]}
+		if err := appendCounter(&res, spec, fmt.Sprintf("line %d", i), c); err != nil {
+			return nil, err
+		}
+	}
+
+	return &res, nil
+}
+
+func extractCounterSpecs(specs []counterSpec, c *Config) (*CounterSet, error) {
+	res := CounterSet{}
+
+	for i, spec := range specs {
+		if err := appendCounter(&res, spec, fmt.Sprintf("entry %d", i), c); err != nil {
+			return nil, fmt.Errorf("invalid counter '%s'; err: %w", spec.Field, err)
+		}
+	}
+
+	return &res, nil
+}
 
-			expField, err := IdentifyMetricType(record[0])
+// appendCounter appends the counter described by spec to the DCGM or the exporter counters of res.
+// Counters of fields that aren't enabled are skipped; where locates the counter in the logs.
+func appendCounter(res *CounterSet, spec counterSpec, where string, c *Config) error {
+	fieldID, ok := dcgm.DCGM_FI[spec.Field]
+	oldFieldID, oldOk := dcgm.OLD_DCGM_FI[spec.Field]
+	if !ok && !oldOk {
+
+		expField, err := IdentifyMetricType(spec.Field)
+		if err != nil {
+			return fmt.Errorf("could not find DCGM field; err: %w", err)
+		} else if expField != DCGMFIUnknown {
+			counter, err := spec.counter(dcgm.Short(expField))
 			if err != nil {
-				return nil, fmt.Errorf("could not find DCGM field; err: %w", err)
-			} else if expField != DCGMFIUnknown {
-				res.ExporterCounters = append(res.ExporterCounters, Counter{dcgm.Short(expField), record[0], record[1], record[2]})
-				continue
+				return err
 			}
+			res.ExporterCounters = append(res.ExporterCounters, counter)
+			return nil
 		}
+	}
 
-		if !ok && oldOk {
-			useOld = true
+	if !ok && oldOk {
+		fieldID = oldFieldID
+	}
+
+	if !fieldIsSupported(uint(fieldID), c) {
+		logrus.Warnf("Skipping %s ('%s'): metric not enabled", where, spec.Field)
+		return nil
+	}
+
+	if _, ok := promMetricType[spec.Type]; !ok {
+		return fmt.Errorf("could not find Prometheus metric type '%s'", spec.Type)
+	}
+
+	counter, err := spec.counter(fieldID)
+	if err != nil {
+		return err
+	}
+	res.DCGMCounters = append(res.DCGMCounters, counter)
+
+	return nil
+}
+
+// counter returns the Counter of the field, with the options of the spec.
+func (s counterSpec) counter(fieldID dcgm.Short) (Counter, error) {
+	if s.Name != "" && !model.IsValidMetricName(model.LabelValue(s.Name)) {
+		return Counter{}, fmt.Errorf("invalid metric name '%s'", s.Name)
+	}
+
+	entityTypes, err := parseEntityTypes(s.EntityTypes)
+	if err != nil {
+		return Counter{}, err
+	}
+
+	for name := range s.Labels {
+		if !model.LabelName(name).IsValid() {
+			return Counter{}, fmt.Errorf("invalid label name '%s'", name)
 		}
+	}
 
-		if !useOld {
-			if !fieldIsSupported(uint(fieldID), c) {
-				logrus.Warnf("Skipping line %d ('%s'): metric not enabled", i, record[0])
-				continue
-			}
+	watchInterval, err := parsePositiveDuration(s.WatchInterval)
+	if err != nil {
+		return Counter{}, fmt.Errorf("invalid watch interval; err: %w", err)
+	}
 
-			if _, ok := promMetricType[record[1]]; !ok {
-				return nil, fmt.Errorf("could not find Prometheus metric type '%s'", record[1])
-			}
+	keepAge, err := parsePositiveDuration(s.KeepAge)
+	if err != nil {
+		return Counter{}, fmt.Errorf("invalid retention; err: %w", err)
+	}
 
-			res.DCGMCounters = append(res.DCGMCounters, Counter{fieldID, record[0], record[1], record[2]})
-		} else {
-			if !fieldIsSupported(uint(oldFieldID), c) {
-				logrus.Warnf("Skipping line %d ('%s'): metric not enabled", i, record[0])
-				continue
-			}
+	if s.Aggregate && s.Type != "gauge" {
+		return Counter{}, fmt.Errorf("only gauges can be aggregated, not '%s'", s.Type)
+	}
 
-			if _, ok := promMetricType[record[1]]; !ok {
-				return nil, fmt.Errorf("could not find Prometheus metric type '%s'", record[1])
-			}
+	if err := s.validateDistribution(); err != nil {
+		return Counter{}, err
+	}
 
-			res.DCGMCounters = append(res.DCGMCounters, Counter{oldFieldID, record[0], record[1], record[2]})
+	counter := Counter{
+		FieldID:       fieldID,
+		FieldName:     s.Field,
+		PromType:      s.Type,
+		Help:          s.Help,
+		Unit:          s.Unit,
+		MetricName:    s.Name,
+		Scale:         s.Scale,
+		EntityTypes:   entityTypes,
+		WatchInterval: watchInterval,
+		KeepAge:       keepAge,
+		Aggregate:     s.Aggregate,
+
+		NativeHistogramBucketFactor: s.NativeHistogramBucketFactor,
+	}
+
+	return counter.WithStaticLabels(s.Labels).WithBuckets(s.Buckets).WithQuantiles(s.Quantiles), nil
+}
+
+// validateDistribution checks the histogram and summary options of the spec.
+func (s counterSpec) validateDistribution() error {
+	if (len(s.Buckets) > 0 || s.NativeHistogramBucketFactor != 0) && s.Type != "histogram" {
+		return fmt.Errorf("buckets are only supported by histograms, not '%s'", s.Type)
+	}
+	for i := 1; i < len(s.Buckets); i++ {
+		if s.Buckets[i] <= s.Buckets[i-1] {
+			return fmt.Errorf("buckets %v must be in increasing order", s.Buckets)
 		}
 	}
+	if s.NativeHistogramBucketFactor != 0 && s.NativeHistogramBucketFactor <= 1 {
+		return fmt.Errorf("native histogram bucket factor %v must be greater than 1", s.NativeHistogramBucketFactor)
+	}
 
-	return &res, nil
+	if len(s.Quantiles) > 0 && s.Type != "summary" {
+		return fmt.Errorf("quantiles are only supported by summaries, not '%s'", s.Type)
+	}
+	for _, q := range s.Quantiles {
+		if q <= 0 || q >= 1 {
+			return fmt.Errorf("quantile %v must be between 0 and 1", q)
+		}
+	}
+
+	return nil
+}
+
+// parsePositiveDuration parses an optional duration, returning 0 when s is empty.
+func parsePositiveDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration '%s' must be positive", s)
+	}
+
+	return d, nil
 }
 
 func fieldIsSupported(fieldID uint, c *Config) bool {
@@ -176,19 +376,33 @@ func fieldIsSupported(fieldID uint, c *Config) bool {
 }
 
 func readConfigMap(kubeClient kubernetes.Interface, c *Config) ([][]string, error) {
-	parts := strings.Split(c.ConfigMapData, ":")
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("malformed configmap-data '%s'", c.ConfigMapData)
+	namespace, name, err := parseConfigMapData(c.ConfigMapData)
+	if err != nil {
+		return nil, err
 	}
 
 	var cm *corev1.ConfigMap
-	cm, err := kubeClient.CoreV1().ConfigMaps(parts[0]).Get(context.TODO(), parts[1], metav1.GetOptions{})
+	cm, err = kubeClient.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("could not retrieve ConfigMap '%s'; err: %w", c.ConfigMapData, err)
 	}
 
+	return configMapRecords(cm, c.ConfigMapData)
+}
+
+// parseConfigMapData returns the namespace and the name of the ConfigMap given as <NAMESPACE>:<NAME>.
+func parseConfigMapData(configMapData string) (string, string, error) {
+	parts := strings.Split(configMapData, ":")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("malformed configmap-data '%s'", configMapData)
+	}
+	return parts[0], parts[1], nil
+}
+
+// configMapRecords reads the counters from the 'metrics' key of the ConfigMap.
+func configMapRecords(cm *corev1.ConfigMap, configMapData string) ([][]string, error) {
 	if _, ok := cm.Data["metrics"]; !ok {
-		return nil, fmt.Errorf("malformed ConfigMap '%s'; no 'metrics' key", c.ConfigMapData)
+		return nil, fmt.Errorf("malformed ConfigMap '%s'; no 'metrics' key", configMapData)
 	}
 
 	r := csv.NewReader(strings.NewReader(cm.Data["metrics"]))
@@ -2,8 +2,11 @@ package dcgmexporter
 
 import (
 	"testing"
+	"time"
 
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
@@ -155,3 +158,150 @@ func extractCountersHelper(t *testing.T, input string, valid bool) {
 		assert.Nil(t, cc, "Expected no counters.")
 	}
 }
+
+func writeCountersFile(t *testing.T, pattern, content string) string {
+	f, err := os.CreateTemp("", pattern)
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	_, err = f.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	return f.Name()
+}
+
+func TestGetCounterSet_StructuredFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		content string
+	}{
+		{
+			name:    "YAML",
+			pattern: "counters.*.yaml",
+			content: `
+counters:
+  - field: DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION
+    type: counter
+    help: Total energy consumption since boot.
+    name: gpu_energy_joules_total
+    unit: joules
+    scale: 0.001
+    entityTypes: [gpu]
+    labels:
+      team: ml
+    watchInterval: 10s
+    keepAge: 1m
+  - field: DCGM_FI_DEV_GPU_TEMP
+    type: gauge
+    help: GPU temperature (in C).
+`,
+		},
+		{
+			name:    "JSON",
+			pattern: "counters.*.json",
+			content: `{"counters": [
+  {"field": "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", "type": "counter", "help": "Total energy consumption since boot.",
+   "name": "gpu_energy_joules_total", "unit": "joules", "scale": 0.001, "entityTypes": ["gpu"],
+   "labels": {"team": "ml"}, "watchInterval": "10s", "keepAge": "1m"},
+  {"field": "DCGM_FI_DEV_GPU_TEMP", "type": "gauge", "help": "GPU temperature (in C)."}
+]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{
+				ConfigMapData:  undefinedConfigMapData,
+				CollectorsFile: writeCountersFile(t, tt.pattern, tt.content),
+			}
+			cs, err := GetCounterSet(&c)
+			require.NoError(t, err)
+			require.Len(t, cs.DCGMCounters, 2)
+
+			energy := cs.DCGMCounters[0]
+			assert.Equal(t, dcgm.DCGM_FI["DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION"], energy.FieldID)
+			assert.Equal(t, "counter", energy.PromType)
+			assert.Equal(t, "gpu_energy_joules_total", energy.Name())
+			assert.Equal(t, "joules", energy.Unit)
+			assert.Equal(t, 0.001, energy.Scale)
+			assert.True(t, energy.AppliesTo(dcgm.FE_GPU))
+			assert.False(t, energy.AppliesTo(dcgm.FE_SWITCH))
+			assert.Equal(t, map[string]string{"team": "ml"}, energy.StaticLabels())
+			assert.Equal(t, 10*time.Second, energy.WatchInterval)
+			assert.Equal(t, time.Minute, energy.KeepAge)
+
+			// Without options, counters are the same as the ones of a CSV file
+			assert.Equal(t, Counter{
+				FieldID:   dcgm.DCGM_FI["DCGM_FI_DEV_GPU_TEMP"],
+				FieldName: "DCGM_FI_DEV_GPU_TEMP",
+				PromType:  "gauge",
+				Help:      "GPU temperature (in C).",
+			}, cs.DCGMCounters[1])
+		})
+	}
+}
+
+func TestGetCounterSet_InvalidStructuredFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "Unknown entity type",
+			content: "counters:\n  - {field: DCGM_FI_DEV_GPU_TEMP, type: gauge, help: t, entityTypes: [gpus]}\n",
+		},
+		{
+			name:    "Invalid watch interval",
+			content: "counters:\n  - {field: DCGM_FI_DEV_GPU_TEMP, type: gauge, help: t, watchInterval: often}\n",
+		},
+		{
+			name:    "Negative retention",
+			content: "counters:\n  - {field: DCGM_FI_DEV_GPU_TEMP, type: gauge, help: t, keepAge: -1s}\n",
+		},
+		{
+			name:    "Aggregated non-gauge",
+			content: "counters:\n  - {field: DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION, type: counter, help: t, aggregate: true}\n",
+		},
+		{
+			name:    "Buckets of a gauge",
+			content: "counters:\n  - {field: DCGM_FI_DEV_GPU_TEMP, type: gauge, help: t, buckets: [40, 60]}\n",
+		},
+		{
+			name:    "Unsorted buckets",
+			content: "counters:\n  - {field: DCGM_FI_DEV_GPU_TEMP, type: histogram, help: t, buckets: [60, 40]}\n",
+		},
+		{
+			name:    "Invalid quantile",
+			content: "counters:\n  - {field: DCGM_FI_DEV_GPU_TEMP, type: summary, help: t, quantiles: [1.5]}\n",
+		},
+		{
+			name:    "Invalid metric name",
+			content: "counters:\n  - {field: DCGM_FI_DEV_GPU_TEMP, type: gauge, help: t, name: gpu-temp}\n",
+		},
+		{
+			name:    "Invalid label name",
+			content: "counters:\n  - {field: DCGM_FI_DEV_GPU_TEMP, type: gauge, help: t, labels: {a-b: c}}\n",
+		},
+		{
+			name:    "Unknown option",
+			content: "counters:\n  - {field: DCGM_FI_DEV_GPU_TEMP, type: gauge, help: t, interval: 1s}\n",
+		},
+		{
+			name:    "Unknown type",
+			content: "counters:\n  - {field: DCGM_FI_DEV_GPU_TEMP, type: gaug, help: t}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{
+				ConfigMapData:  undefinedConfigMapData,
+				CollectorsFile: writeCountersFile(t, "counters.*.yml", tt.content),
+			}
+			_, err := GetCounterSet(&c)
+			assert.Error(t, err)
+		})
+	}
+}
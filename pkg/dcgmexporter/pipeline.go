@@ -17,13 +17,14 @@
 package dcgmexporter
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
+	"slices"
 	"sync"
-	"text/template"
 	"time"
 
 	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 )
 
@@ -35,85 +36,117 @@ func NewMetricsPipeline(config *Config,
 ) (*MetricsPipeline, func(), error) {
 	logrus.WithField(LoggerDumpKey, fmt.Sprintf("%+v", counters)).Debug("Counters are initialized")
 
-	cleanups := []func(){}
+	collectors, cleanups, err := newDCGMCollectors(config, counters, hostname, newDCGMCollector,
+		fieldEntityGroupTypeSystemInfo)
+	if err != nil {
+		return nil, func() {}, err
+	}
 
-	var (
-		gpuCollector    *DCGMCollector
-		switchCollector *DCGMCollector
-		linkCollector   *DCGMCollector
-		cpuCollector    *DCGMCollector
-		coreCollector   *DCGMCollector
-		err             error
-	)
-
-	if item, exists := fieldEntityGroupTypeSystemInfo.Get(dcgm.FE_GPU); exists {
-		var cleanup func()
-		gpuCollector, cleanup, err = newDCGMCollector(counters, hostname, config, item)
-		if err != nil {
-			logrus.Warn("Cannot create DCGMCollector for dcgm.FE_GPU")
-		}
-		cleanups = append(cleanups, cleanup)
+	transformations := getTransformations(config)
+
+	m := &MetricsPipeline{
+		config: config,
+
+		counters:        counters,
+		hostname:        hostname,
+		transformations: transformations,
 	}
+	m.setCollectors(collectors, cleanups)
 
-	if item, exists := fieldEntityGroupTypeSystemInfo.Get(dcgm.FE_SWITCH); exists {
-		var cleanup func()
-		switchCollector, cleanup, err = newDCGMCollector(counters, hostname, config, item)
-		if err != nil {
-			logrus.Warn("Cannot create DCGMCollector for dcgm.FE_SWITCH")
+	return m, m.cleanup, nil
+}
+
+// newDCGMCollectors creates a DCGMCollector for every entity type with system info. When the collector of
+// an entity type can't be created, e.g. because its fields can't be watched, the collectors already created
+// are cleaned up and the error is returned.
+func newDCGMCollectors(config *Config,
+	counters []Counter,
+	hostname string,
+	newDCGMCollector DCGMCollectorConstructor,
+	fieldEntityGroupTypeSystemInfo *FieldEntityGroupTypeSystemInfo,
+) (map[dcgm.Field_Entity_Group]*DCGMCollector, []func(), error) {
+	collectors := map[dcgm.Field_Entity_Group]*DCGMCollector{}
+	cleanups := []func(){}
+
+	for _, entityType := range FieldEntityGroupTypeToMonitor {
+		item, exists := fieldEntityGroupTypeSystemInfo.Get(entityType)
+		if !exists {
+			continue
 		}
-		cleanups = append(cleanups, cleanup)
-	}
 
-	if item, exists := fieldEntityGroupTypeSystemInfo.Get(dcgm.FE_LINK); exists {
-		var cleanup func()
-		linkCollector, cleanup, err = newDCGMCollector(counters, hostname, config, item)
+		collector, cleanup, err := newDCGMCollector(counters, hostname, config, item)
+		if err != nil && item.isEmpty() {
+			// There are no fields to watch for the entity type
+			logrus.WithError(err).Warnf("Cannot create DCGMCollector for %s", entityType.String())
+			continue
+		}
 		if err != nil {
-			logrus.Warn("Cannot create DCGMCollector for dcgm.FE_LINK")
+			for _, cleanup := range cleanups {
+				cleanup()
+			}
+			return nil, nil, fmt.Errorf("cannot create the DCGM collector of the %s entities; err: %w",
+				entityType.String(), err)
 		}
+		collectors[entityType] = collector
 		cleanups = append(cleanups, cleanup)
 	}
 
-	if item, exists := fieldEntityGroupTypeSystemInfo.Get(dcgm.FE_CPU); exists {
-		var cleanup func()
-		cpuCollector, cleanup, err = newDCGMCollector(counters, hostname, config, item)
-		if err != nil {
-			logrus.Warn("Cannot create DCGMCollector for dcgm.FE_CPU")
-		}
-		cleanups = append(cleanups, cleanup)
+	return collectors, cleanups, nil
+}
+
+// setCollectors replaces the collectors of the pipeline. The caller must hold collectorsMtx,
+// unless the pipeline isn't running yet.
+func (m *MetricsPipeline) setCollectors(collectors map[dcgm.Field_Entity_Group]*DCGMCollector, cleanups []func()) {
+	m.gpuCollector = collectors[dcgm.FE_GPU]
+	m.switchCollector = collectors[dcgm.FE_SWITCH]
+	m.linkCollector = collectors[dcgm.FE_LINK]
+	m.cpuCollector = collectors[dcgm.FE_CPU]
+	m.coreCollector = collectors[dcgm.FE_CPU_CORE]
+	m.cleanups = cleanups
+}
+
+// Reload replaces the collectors of the pipeline with collectors of the new counters, which rebuilds
+// the DCGM field groups. Collections in progress complete with the previous collectors. When the new
+// collectors can't be created, the previous ones are kept and the error is returned.
+func (m *MetricsPipeline) Reload(counters []Counter,
+	newDCGMCollector DCGMCollectorConstructor,
+	fieldEntityGroupTypeSystemInfo *FieldEntityGroupTypeSystemInfo,
+) error {
+	logrus.WithField(LoggerDumpKey, fmt.Sprintf("%+v", counters)).Debug("Counters are reloaded")
+
+	collectors, cleanups, err := newDCGMCollectors(m.config, counters, m.hostname, newDCGMCollector,
+		fieldEntityGroupTypeSystemInfo)
+	if err != nil {
+		return err
 	}
 
-	if item, exists := fieldEntityGroupTypeSystemInfo.Get(dcgm.FE_CPU_CORE); exists {
-		var cleanup func()
-		coreCollector, cleanup, err = newDCGMCollector(counters, hostname, config, item)
-		if err != nil {
-			logrus.Warn("Cannot create DCGMCollector for dcgm.FE_CPU_CORE")
-		}
-		cleanups = append(cleanups, cleanup)
+	m.collectorsMtx.Lock()
+	previousCleanups := m.cleanups
+	m.counters = counters
+	m.setCollectors(collectors, cleanups)
+	m.collectorsMtx.Unlock()
+
+	// The last good metrics belong to the previous counters
+	m.lastGoodMtx.Lock()
+	m.lastGood = nil
+	m.lastGoodMtx.Unlock()
+
+	for _, cleanup := range previousCleanups {
+		cleanup()
 	}
+	clearDecodedOptions()
 
-	transformations := getTransformations(config)
+	return nil
+}
 
-	return &MetricsPipeline{
-			config: config,
-
-			migMetricsFormat:     template.Must(template.New("migMetrics").Parse(migMetricsFormat)),
-			switchMetricsFormat:  template.Must(template.New("switchMetrics").Parse(switchMetricsFormat)),
-			linkMetricsFormat:    template.Must(template.New("switchMetrics").Parse(linkMetricsFormat)),
-			cpuMetricsFormat:     template.Must(template.New("cpuMetrics").Parse(cpuMetricsFormat)),
-			cpuCoreMetricsFormat: template.Must(template.New("cpuMetrics").Parse(cpuCoreMetricsFormat)),
-
-			counters:        counters,
-			gpuCollector:    gpuCollector,
-			switchCollector: switchCollector,
-			linkCollector:   linkCollector,
-			transformations: transformations,
-			cpuCollector:    cpuCollector,
-			coreCollector:   coreCollector,
-		}, func() {
-			for _, cleanup := range cleanups {
-				cleanup()
-			}
-		}, nil
+func (m *MetricsPipeline) cleanup() {
+	m.collectorsMtx.Lock()
+	defer m.collectorsMtx.Unlock()
+
+	for _, cleanup := range m.cleanups {
+		cleanup()
+	}
+	m.cleanups = nil
 }
 
 func getTransformations(c *Config) []Transform {
@@ -140,22 +173,41 @@ func NewMetricsPipelineWithGPUCollector(c *Config, collector *DCGMCollector) (*M
 	return &MetricsPipeline{
 		config: c,
 
-		migMetricsFormat:     template.Must(template.New("migMetrics").Parse(migMetricsFormat)),
-		switchMetricsFormat:  template.Must(template.New("switchMetrics").Parse(switchMetricsFormat)),
-		linkMetricsFormat:    template.Must(template.New("switchMetrics").Parse(linkMetricsFormat)),
-		cpuMetricsFormat:     template.Must(template.New("cpuMetrics").Parse(cpuMetricsFormat)),
-		cpuCoreMetricsFormat: template.Must(template.New("cpuMetrics").Parse(cpuCoreMetricsFormat)),
-
 		counters:     collector.Counters,
 		gpuCollector: collector,
 	}, func() {}, nil
 }
 
-func (m *MetricsPipeline) Run(out chan string, stop chan interface{}, wg *sync.WaitGroup) {
+// Discard drops the collectors without cleaning them up, because their DCGM groups and field watches are gone
+// with the hostengine. The pipeline collects nothing until Reload.
+func (m *MetricsPipeline) Discard() {
+	m.collectorsMtx.Lock()
+	m.setCollectors(nil, nil)
+	m.collectorsMtx.Unlock()
+}
+
+// AddSink adds a sink the metrics are written to after every collection of Run. It must be called
+// before the pipeline runs.
+func (m *MetricsPipeline) AddSink(sink MetricsSink) {
+	m.sinks = append(m.sinks, sink)
+}
+
+// SetSinkRegistry sets the registry of the DCGM_EXP collectors, whose metrics are written to the sinks along
+// with the DCGM metrics. It must be called before the pipeline runs.
+func (m *MetricsPipeline) SetSinkRegistry(registry *Registry) {
+	m.registry = registry
+}
+
+// Run collects the metrics every collect interval, writes them to the sinks and sends them to out.
+// out may be nil when the metrics are only written to the sinks.
+func (m *MetricsPipeline) Run(out chan []*dto.MetricFamily, stop chan interface{}, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	logrus.Info("Pipeline starting")
 
+	m.setPeriodic(true)
+	defer m.setPeriodic(false)
+
 	// Note we are using a ticker so that we can stick as close as possible to the collect interval.
 	// e.g: The CollectInterval is 10s and the transformation pipeline takes 5s, the time will
 	// ensure we really collect metrics every 10s by firing an event 5s after the run function completes.
@@ -167,16 +219,17 @@ func (m *MetricsPipeline) Run(out chan string, stop chan interface{}, wg *sync.W
 		case <-stop:
 			return
 		case <-t.C:
-			o, err := m.run()
+			o, err := m.run(m.sinks)
 			if err != nil {
 				logrus.Errorf("Failed to collect metrics; err: %v", err)
-				/* flush output rather than output stale data */
-				out <- ""
-				continue
 			}
 
+			if out == nil {
+				continue
+			}
 			if len(out) == cap(out) {
 				logrus.Errorf("Channel is full skipping.")
+				pipelineChannelDrops.Inc()
 			} else {
 				out <- o
 			}
@@ -184,194 +237,244 @@ func (m *MetricsPipeline) Run(out chan string, stop chan interface{}, wg *sync.W
 	}
 }
 
-func (m *MetricsPipeline) run() (string, error) {
-	var metrics map[Counter][]Metric
-	var err error
-	var formatted string
+// collectorUpCounter reports, per entity type, whether the last collection of DCGM metrics succeeded.
+var collectorUpCounter = Counter{
+	FieldName: "dcgm_exporter_collector_up",
+	PromType:  "gauge",
+	Help:      "Whether the last collection of DCGM metrics of the entity type succeeded (1) or failed (0).",
+}
 
-	if m.gpuCollector != nil {
-		/* Collect GPU Metrics */
-		metrics, err = m.gpuCollector.GetMetrics()
-		if err != nil {
-			return "", fmt.Errorf("failed to collect gpu metrics; err: %w", err)
+// collectorsUp returns whether the metric families report an entity type whose last collection succeeded.
+func collectorsUp(families []*dto.MetricFamily) bool {
+	for _, mf := range families {
+		if mf.GetName() != collectorUpCounter.FieldName {
+			continue
 		}
-
-		for _, transform := range m.transformations {
-			err := transform.Process(metrics, m.gpuCollector.SysInfo)
-			if err != nil {
-				return "", fmt.Errorf("failed to transform metrics for transform '%s'; err: %w", transform.Name(), err)
+		for _, m := range mf.Metric {
+			if m.GetGauge().GetValue() == 1 {
+				return true
 			}
 		}
+	}
+	return false
+}
 
-		formatted, err = FormatMetrics(m.migMetricsFormat, metrics)
-		if err != nil {
-			return "", fmt.Errorf("failed to format metrics; err: %w", err)
+// metricsGetter returns the metrics of an entity type, like DCGMCollector does.
+type metricsGetter interface {
+	GetMetrics() (MetricsByCounter, error)
+}
+
+// EntityMetrics are the metrics collected for an entity type, with the function that returns their
+// identity labels.
+type EntityMetrics struct {
+	Entity   string
+	Metrics  MetricsByCounter
+	identity metricLabelsFunc
+}
+
+// MetricsSink receives the metrics of every entity type after each collection of the pipeline.
+// Sinks must not modify the metrics, nor block the pipeline.
+type MetricsSink interface {
+	Write(metrics []EntityMetrics)
+}
+
+// entityCollector collects the metrics of a single entity type of the pipeline.
+type entityCollector struct {
+	entity    string
+	collector metricsGetter
+	sysInfo   SystemInfo
+	labels    metricLabelsFunc
+	transform bool // Apply the transformations of the pipeline
+}
+
+func (m *MetricsPipeline) entityCollectors() []entityCollector {
+	var res []entityCollector
+	for _, c := range []struct {
+		entity    string
+		collector *DCGMCollector
+		labels    metricLabelsFunc
+	}{
+		{entity: "gpu", collector: m.gpuCollector, labels: gpuMetricLabels},
+		{entity: "switch", collector: m.switchCollector, labels: switchMetricLabels},
+		{entity: "link", collector: m.linkCollector, labels: linkMetricLabels},
+		{entity: "cpu", collector: m.cpuCollector, labels: cpuMetricLabels},
+		{entity: "cpu_core", collector: m.coreCollector, labels: cpuCoreMetricLabels},
+	} {
+		if c.collector == nil {
+			continue
 		}
+		res = append(res, entityCollector{
+			entity:    c.entity,
+			collector: c.collector,
+			sysInfo:   c.collector.SysInfo,
+			labels:    c.labels,
+			transform: c.collector == m.gpuCollector,
+		})
 	}
+	return res
+}
 
-	if m.switchCollector != nil {
-		/* Collect Switch Metrics */
-		metrics, err = m.switchCollector.GetMetrics()
-		if err != nil {
-			return "", fmt.Errorf("failed to collect switch metrics; err: %w", err)
-		}
+// run collects the metrics of every entity type. A failing entity type doesn't affect the others:
+// its last good metrics are exposed instead, and the failure is reported by dcgm_exporter_collector_up.
+// The returned error joins the failures of all entity types. The metrics are also written to the sinks.
+func (m *MetricsPipeline) run(sinks []MetricsSink) ([]*dto.MetricFamily, error) {
+	// The registry holds the DCGM connection itself, so it is gathered first
+	var exporterMetrics []EntityMetrics
+	if len(sinks) > 0 {
+		exporterMetrics = m.gatherSinkRegistry()
+	}
 
-		if len(metrics) > 0 {
-			switchFormatted, err := FormatMetrics(m.switchMetricsFormat, metrics)
-			if err != nil {
-				logrus.Warnf("Failed to format switch metrics with error: %v", err)
-			}
+	dcgmConnection.RLock()
+	defer dcgmConnection.RUnlock()
 
-			formatted = formatted + switchFormatted
-		}
+	m.collectorsMtx.RLock()
+	defer m.collectorsMtx.RUnlock()
+
+	res, err := m.runCollectors(m.entityCollectors(), sinks, exporterMetrics...)
+	m.recordCollection(res)
+
+	return res, err
+}
+
+// gatherSinkRegistry returns the metrics of the DCGM_EXP collectors to write to the sinks.
+func (m *MetricsPipeline) gatherSinkRegistry() []EntityMetrics {
+	if m.registry == nil {
+		return nil
 	}
 
-	if m.linkCollector != nil {
-		/* Collect Link Metrics */
-		metrics, err = m.linkCollector.GetMetrics()
+	metrics, err := m.registry.Gather()
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to collect the exporter metrics written to the sinks")
+		return nil
+	}
+	return []EntityMetrics{{Entity: "exporter", Metrics: metrics, identity: exporterMetricLabels}}
+}
+
+// runCollectors collects the metrics of the collectors, and writes them to the sinks along with the
+// metrics of other.
+func (m *MetricsPipeline) runCollectors(collectors []entityCollector, sinks []MetricsSink,
+	other ...EntityMetrics,
+) ([]*dto.MetricFamily, error) {
+	families := newMetricFamilyBuilder()
+	families.withTimestamps = m.config.EmitTimestamps
+
+	collectorUp := MetricsByCounter{}
+	var collected []EntityMetrics
+	var errs []error
+
+	for _, c := range collectors {
+		up := "1"
+		metrics, err := m.collect(c)
 		if err != nil {
-			return "", fmt.Errorf("failed to collect link metrics; err: %w", err)
+			errs = append(errs, err)
+			up = "0"
+			metrics = m.lastGoodMetrics(c.entity)
+		} else {
+			m.setLastGoodMetrics(c.entity, metrics)
 		}
 
-		if len(metrics) > 0 {
-			switchFormatted, err := FormatMetrics(m.linkMetricsFormat, metrics)
-			if err != nil {
-				logrus.Warnf("failed to format link metrics; err: %v", err)
-			}
+		families.add(metrics, c.labels)
+		collected = append(collected, EntityMetrics{Entity: c.entity, Metrics: metrics, identity: c.labels})
 
-			formatted = formatted + switchFormatted
-		}
+		collectorUp[collectorUpCounter] = append(collectorUp[collectorUpCounter], Metric{
+			Counter:    collectorUpCounter,
+			Value:      up,
+			Attributes: map[string]string{"entity": c.entity},
+		})
 	}
 
-	if m.cpuCollector != nil {
-		/* Collect CPU Metrics */
-		metrics, err = m.cpuCollector.GetMetrics()
-		if err != nil {
-			return "", fmt.Errorf("failed to collect CPU metrics; err: %w", err)
-		}
+	families.add(collectorUp, noIdentityLabels)
 
-		if len(metrics) > 0 {
-			cpuFormatted, err := FormatMetrics(m.cpuMetricsFormat, metrics)
-			if err != nil {
-				logrus.Warnf("Failed to format cpu metrics with error: %v", err)
-			}
+	collected = append(collected, other...)
+	for _, sink := range sinks {
+		sink.Write(collected)
+	}
 
-			formatted = formatted + cpuFormatted
-		}
+	res := families.build()
+	updateSeriesCount(res)
+
+	return res, errors.Join(errs...)
+}
+
+func (m *MetricsPipeline) collect(c entityCollector) (MetricsByCounter, error) {
+	start := time.Now()
+	metrics, err := c.collector.GetMetrics()
+	collectionDuration.WithLabelValues(c.entity).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect %s metrics; err: %w", c.entity, err)
 	}
 
-	if m.coreCollector != nil {
-		/* Collect cpu core Metrics */
-		metrics, err = m.coreCollector.GetMetrics()
-		if err != nil {
-			return "", fmt.Errorf("failed to collect CPU core metrics; err: %w", err)
-		}
+	m.dropStaleMetrics(metrics)
 
-		if len(metrics) > 0 {
-			coreFormatted, err := FormatMetrics(m.cpuCoreMetricsFormat, metrics)
+	if c.transform {
+		for _, transform := range m.transformations {
+			start := time.Now()
+			err := transform.Process(metrics, c.sysInfo)
+			transformDuration.WithLabelValues(transform.Name()).Observe(time.Since(start).Seconds())
 			if err != nil {
-				logrus.Warnf("failed to format cpu core metrics; err: %v", err)
+				return nil, fmt.Errorf("failed to transform metrics for transform '%s'; err: %w", transform.Name(), err)
 			}
-
-			formatted = formatted + coreFormatted
 		}
 	}
 
-	return formatted, nil
+	return metrics, nil
 }
 
-/*
-* The goal here is to get to the following format:
-* ```
-* # HELP FIELD_ID HELP_MSG
-* # TYPE FIELD_ID PROM_TYPE
-* FIELD_ID{gpu="GPU_INDEX_0",uuid="GPU_UUID", attr...} VALUE
-* FIELD_ID{gpu="GPU_INDEX_N",uuid="GPU_UUID", attr...} VALUE
-* ...
-* ```
- */
+func (m *MetricsPipeline) lastGoodMetrics(entity string) MetricsByCounter {
+	m.lastGoodMtx.Lock()
+	defer m.lastGoodMtx.Unlock()
+
+	metrics := MetricsByCounter{}
+	for counter, values := range m.lastGood[entity] {
+		metrics[counter] = slices.Clone(values)
+	}
 
-var migMetricsFormat = `
-{{- range $counter, $metrics := . -}}
-# HELP {{ $counter.FieldName }} {{ $counter.Help }}
-# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
-{{- range $metric := $metrics }}
-{{ $counter.FieldName }}{gpu="{{ $metric.GPU }}",{{ $metric.UUID }}="{{ $metric.GPUUUID }}",pci_bus_id="{{ $metric.GPUPCIBusID }}",device="{{ $metric.GPUDevice }}",modelName="{{ $metric.GPUModelName }}"{{if $metric.MigProfile}},GPU_I_PROFILE="{{ $metric.MigProfile }}",GPU_I_ID="{{ $metric.GPUInstanceID }}"{{end}}{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
-
-{{- range $k, $v := $metric.Labels -}}
-	,{{ $k }}="{{ $v }}"
-{{- end -}}
-{{- range $k, $v := $metric.Attributes -}}
-	,{{ $k }}="{{ $v }}"
-{{- end -}}
-
-} {{ $metric.Value -}}
-{{- end }}
-{{ end }}`
-
-var switchMetricsFormat = `
-{{- range $counter, $metrics := . -}}
-# HELP {{ $counter.FieldName }} {{ $counter.Help }}
-# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
-{{- range $metric := $metrics }}
-{{ $counter.FieldName }}{nvswitch="{{ $metric.GPU }}"{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
-
-{{- range $k, $v := $metric.Labels -}}
-	,{{ $k }}="{{ $v }}"
-{{- end -}}
-} {{ $metric.Value -}}
-{{- end }}
-{{ end }}`
-
-var linkMetricsFormat = `
-{{- range $counter, $metrics := . -}}
-# HELP {{ $counter.FieldName }} {{ $counter.Help }}
-# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
-{{- range $metric := $metrics }}
-{{ $counter.FieldName }}{nvlink="{{ $metric.GPU }}",nvswitch="{{ $metric.GPUDevice }}"{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
-
-{{- range $k, $v := $metric.Labels -}}
-	,{{ $k }}="{{ $v }}"
-{{- end -}}
-} {{ $metric.Value -}}
-{{- end }}
-{{ end }}`
-
-var cpuMetricsFormat = `
-{{- range $counter, $metrics := . -}}
-# HELP {{ $counter.FieldName }} {{ $counter.Help }}
-# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
-{{- range $metric := $metrics }}
-{{ $counter.FieldName }}{cpu="{{ $metric.GPU }}"{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
-
-{{- range $k, $v := $metric.Labels -}}
-	,{{ $k }}="{{ $v }}"
-{{- end -}}
-} {{ $metric.Value -}}
-{{- end }}
-{{ end }}`
-
-var cpuCoreMetricsFormat = `
-{{- range $counter, $metrics := . -}}
-# HELP {{ $counter.FieldName }} {{ $counter.Help }}
-# TYPE {{ $counter.FieldName }} {{ $counter.PromType }}
-{{- range $metric := $metrics }}
-{{ $counter.FieldName }}{cpucore="{{ $metric.GPU }}",cpu="{{ $metric.GPUDevice }}"{{if $metric.Hostname }},Hostname="{{ $metric.Hostname }}"{{end}}
-
-{{- range $k, $v := $metric.Labels -}}
-	,{{ $k }}="{{ $v }}"
-{{- end -}}
-} {{ $metric.Value -}}
-{{- end }}
-{{ end }}`
-
-// FormatMetrics Template is passed here so that it isn't recompiled at each iteration
-func FormatMetrics(t *template.Template, groupedMetrics MetricsByCounter) (string, error) {
-	// Format metrics
-	var res bytes.Buffer
-	if err := t.Execute(&res, groupedMetrics); err != nil {
-		return "", err
+	// The last good metrics age too, until they are older than the staleness threshold
+	m.dropStaleMetrics(metrics)
+	return metrics
+}
+
+func (m *MetricsPipeline) setLastGoodMetrics(entity string, metrics MetricsByCounter) {
+	m.lastGoodMtx.Lock()
+	defer m.lastGoodMtx.Unlock()
+
+	if m.lastGood == nil {
+		m.lastGood = map[string]MetricsByCounter{}
+	}
+	m.lastGood[entity] = metrics
+}
+
+// dropStaleMetrics removes the metrics sampled by DCGM more than StaleIntervals collect intervals ago,
+// so that a stalled hostengine shows up as a gap instead of a flat line.
+func (m *MetricsPipeline) dropStaleMetrics(metrics MetricsByCounter) {
+	if m.config.StaleIntervals <= 0 {
+		return
 	}
 
-	return res.String(), nil
+	collectInterval := time.Duration(m.config.CollectInterval) * time.Millisecond
+	dropStaleMetrics(metrics, m.config.StaleIntervals, collectInterval, time.Now())
+}
+
+// dropStaleMetrics drops the metrics sampled more than the given number of watch intervals ago.
+// The watch interval of a counter is the collect interval, unless the counter is watched less often.
+func dropStaleMetrics(metrics MetricsByCounter, intervals int, collectInterval time.Duration, now time.Time) {
+	for counter, values := range metrics {
+		maxAge := time.Duration(intervals) * max(collectInterval, counter.WatchInterval)
+
+		fresh := values[:0]
+		for _, metric := range values {
+			if !metric.Timestamp.IsZero() && now.Sub(metric.Timestamp) > maxAge {
+				logrus.Debugf("Dropping the '%s' sample of entity '%s' taken at %s", counter.FieldName, metric.GPU,
+					metric.Timestamp)
+				continue
+			}
+			fresh = append(fresh, metric)
+		}
+
+		if len(fresh) == 0 {
+			delete(metrics, counter)
+		} else {
+			metrics[counter] = fresh
+		}
+	}
 }
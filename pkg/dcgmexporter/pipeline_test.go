@@ -19,7 +19,9 @@ package dcgmexporter
 import (
 	"errors"
 	"testing"
+	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
@@ -40,7 +42,7 @@ func TestRun(t *testing.T) {
 	defer cleanup()
 	require.NoError(t, err)
 
-	out, err := p.run()
+	out, err := p.run(nil)
 	require.NoError(t, err)
 	require.NotEmpty(t, out)
 
@@ -202,7 +204,246 @@ func TestNewMetricsPipelineWhenFieldEntityGroupTypeSystemInfoItemIsEmpty(t *test
 	defer cleanup()
 	require.NoError(t, err)
 
-	out, err := p.run()
+	out, err := p.run(nil)
 	require.NoError(t, err)
 	require.Empty(t, out)
 }
+
+func TestDropStaleMetrics(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tempCounter := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	powerCounter := Counter{FieldID: 155, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "gauge"}
+	eccCounter := Counter{
+		FieldID:       312,
+		FieldName:     "DCGM_FI_DEV_ECC_DBE_VOL_TOTAL",
+		PromType:      "counter",
+		WatchInterval: 5 * time.Minute,
+	}
+
+	metrics := MetricsByCounter{
+		tempCounter: {
+			{Counter: tempCounter, GPU: "0", Value: "42", Timestamp: now.Add(-time.Second)},
+			{Counter: tempCounter, GPU: "1", Value: "43", Timestamp: now.Add(-time.Minute)},
+			{Counter: tempCounter, GPU: "2", Value: "44"},
+		},
+		powerCounter: {
+			{Counter: powerCounter, GPU: "0", Value: "100", Timestamp: now.Add(-time.Hour)},
+		},
+		eccCounter: {
+			{Counter: eccCounter, GPU: "0", Value: "0", Timestamp: now.Add(-10 * time.Minute)},
+			{Counter: eccCounter, GPU: "1", Value: "0", Timestamp: now.Add(-time.Hour)},
+		},
+	}
+
+	dropStaleMetrics(metrics, 3, 10*time.Second, now)
+
+	require.Len(t, metrics, 2)
+	// Counters watched less often than the collect interval are stale after their own watch intervals
+	require.Len(t, metrics[eccCounter], 1)
+	assert.Equal(t, "0", metrics[eccCounter][0].GPU)
+	require.Len(t, metrics[tempCounter], 2)
+	// Metrics without a DCGM timestamp are never stale
+	assert.Equal(t, "0", metrics[tempCounter][0].GPU)
+	assert.Equal(t, "2", metrics[tempCounter][1].GPU)
+}
+
+type fakeMetricsGetter struct {
+	metrics MetricsByCounter
+	err     error
+}
+
+func (f *fakeMetricsGetter) GetMetrics() (MetricsByCounter, error) {
+	return f.metrics, f.err
+}
+
+func TestRunCollectors_IsolatesEntityFailures(t *testing.T) {
+	tempCounter := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	switchCounter := Counter{FieldID: 701, FieldName: "DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT", PromType: "gauge"}
+
+	gpu := &fakeMetricsGetter{metrics: MetricsByCounter{
+		tempCounter: {{Counter: tempCounter, GPU: "0", Value: "42"}},
+	}}
+	nvswitch := &fakeMetricsGetter{metrics: MetricsByCounter{
+		switchCounter: {{Counter: switchCounter, GPU: "0", Value: "50"}},
+	}}
+
+	p := &MetricsPipeline{config: &Config{}}
+	collectors := []entityCollector{
+		{entity: "gpu", collector: gpu, labels: gpuMetricLabels, transform: true},
+		{entity: "switch", collector: nvswitch, labels: switchMetricLabels},
+	}
+
+	collectorUp := func(families []*dto.MetricFamily) map[string]float64 {
+		res := map[string]float64{}
+		for _, mf := range families {
+			if mf.GetName() != collectorUpCounter.FieldName {
+				continue
+			}
+			for _, m := range mf.Metric {
+				require.Equal(t, []string{"entity"}, labelNames(m.Label))
+				res[m.Label[0].GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+		return res
+	}
+
+	families, err := p.runCollectors(collectors, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"gpu": 1, "switch": 1}, collectorUp(families))
+
+	// The switch fails: its last good metrics are kept and the GPU metrics are still collected
+	nvswitch.metrics, nvswitch.err = nil, errors.New("nvswitch failure")
+	gpu.metrics[tempCounter][0].Value = "43"
+
+	families, err = p.runCollectors(collectors, nil)
+	require.ErrorContains(t, err, "failed to collect switch metrics")
+	assert.Equal(t, map[string]float64{"gpu": 1, "switch": 0}, collectorUp(families))
+
+	require.Len(t, families, 3)
+	assert.Equal(t, "DCGM_FI_DEV_GPU_TEMP", families[0].GetName())
+	assert.Equal(t, 43.0, families[0].Metric[0].GetGauge().GetValue())
+	assert.Equal(t, "DCGM_FI_DEV_NVSWITCH_TEMPERATURE_CURRENT", families[1].GetName())
+	assert.Equal(t, 50.0, families[1].Metric[0].GetGauge().GetValue())
+}
+
+type fakeMetricsSink struct {
+	written [][]EntityMetrics
+}
+
+func (f *fakeMetricsSink) Write(metrics []EntityMetrics) {
+	f.written = append(f.written, metrics)
+}
+
+func TestRunCollectors_WritesSinks(t *testing.T) {
+	tempCounter := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	gpu := &fakeMetricsGetter{metrics: MetricsByCounter{
+		tempCounter: {{Counter: tempCounter, GPU: "0", Value: "42"}},
+	}}
+
+	p := &MetricsPipeline{config: &Config{}}
+	collectors := []entityCollector{{entity: "gpu", collector: gpu, labels: gpuMetricLabels}}
+	sink := &fakeMetricsSink{}
+
+	_, err := p.runCollectors(collectors, []MetricsSink{sink})
+	require.NoError(t, err)
+	require.Len(t, sink.written, 1)
+	require.Len(t, sink.written[0], 1)
+	assert.Equal(t, "gpu", sink.written[0][0].Entity)
+	assert.Equal(t, "42", sink.written[0][0].Metrics[tempCounter][0].Value)
+
+	// Scrapes of the native mode don't write to the sinks
+	_, err = p.runCollectors(collectors, nil)
+	require.NoError(t, err)
+	assert.Len(t, sink.written, 1)
+}
+
+func TestMetricsPipeline_WritesExporterMetricsToSinks(t *testing.T) {
+	xidCounter := Counter{FieldName: "DCGM_EXP_XID_ERRORS_COUNT", PromType: "gauge"}
+	collector := new(mockCollector)
+	collector.On("GetMetrics").Return(MetricsByCounter{
+		xidCounter: {{Counter: xidCounter, Value: "1", GPU: "0", Attributes: map[string]string{"xid_error": "43"}}},
+	}, nil)
+	registry := NewRegistry()
+	registry.Register(collector)
+
+	p := &MetricsPipeline{config: &Config{}}
+	p.SetSinkRegistry(registry)
+	sink := &fakeMetricsSink{}
+
+	_, err := p.run([]MetricsSink{sink})
+	require.NoError(t, err)
+	require.Len(t, sink.written, 1)
+	require.Len(t, sink.written[0], 1)
+	assert.Equal(t, "exporter", sink.written[0][0].Entity)
+	assert.Equal(t, "1", sink.written[0][0].Metrics[xidCounter][0].Value)
+
+	// The scrapes of the native mode gather the registry themselves
+	_, err = p.run(nil)
+	require.NoError(t, err)
+	collector.AssertNumberOfCalls(t, "GetMetrics", 1)
+}
+
+func TestMetricsPipeline_Reload(t *testing.T) {
+	cleanupCounter := 0
+	enabledCollector := map[dcgm.Field_Entity_Group]struct{}{
+		dcgm.FE_SWITCH: {},
+	}
+
+	config := &Config{}
+	fieldEntityGroupTypeSystemInfo := NewEntityGroupTypeSystemInfo(nil, config)
+	for egt := range enabledCollector {
+		fieldEntityGroupTypeSystemInfo.items[egt] = FieldEntityGroupTypeSystemInfoItem{
+			SystemInfo: SystemInfo{
+				InfoType: egt,
+			},
+		}
+	}
+
+	p, cleanup, err := NewMetricsPipeline(config, nil, "",
+		testNewDCGMCollector(t, &cleanupCounter, enabledCollector), fieldEntityGroupTypeSystemInfo)
+	require.NoError(t, err)
+	previous := p.switchCollector
+	require.NotNil(t, previous)
+
+	removedLabels := map[string]string{"removed": "true"}
+	_ = Counter{FieldID: 155, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "gauge"}.WithStaticLabels(removedLabels)
+	counters := []Counter{{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}}
+	err = p.Reload(counters, testNewDCGMCollector(t, &cleanupCounter, enabledCollector), fieldEntityGroupTypeSystemInfo)
+	require.NoError(t, err)
+
+	// The previous collectors are cleaned up on reload, the new ones by the pipeline cleanup
+	assert.Equal(t, 1, cleanupCounter)
+	assert.NotSame(t, previous, p.switchCollector)
+	assert.Equal(t, counters, p.counters)
+	// The options of the removed counters aren't kept
+	_, exists := decodedStaticLabels.Load(encodeStaticLabels(removedLabels))
+	assert.False(t, exists)
+
+	cleanup()
+	assert.Equal(t, 2, cleanupCounter)
+}
+
+func TestMetricsPipeline_WatchFailure(t *testing.T) {
+	cleanupCounter := 0
+	enabledCollector := map[dcgm.Field_Entity_Group]struct{}{
+		dcgm.FE_SWITCH: {},
+	}
+
+	config := &Config{}
+	fieldEntityGroupTypeSystemInfo := NewEntityGroupTypeSystemInfo(nil, config)
+	for _, egt := range []dcgm.Field_Entity_Group{dcgm.FE_GPU, dcgm.FE_SWITCH} {
+		fieldEntityGroupTypeSystemInfo.items[egt] = FieldEntityGroupTypeSystemInfoItem{
+			SystemInfo:   SystemInfo{InfoType: egt},
+			DeviceFields: []dcgm.Short{150},
+		}
+	}
+
+	newCollector := testNewDCGMCollector(t, &cleanupCounter, enabledCollector)
+	failingSwitch := func(c []Counter, hostname string, config *Config, item FieldEntityGroupTypeSystemInfoItem,
+	) (*DCGMCollector, func(), error) {
+		if item.SystemInfo.InfoType == dcgm.FE_SWITCH {
+			return nil, func() {}, errors.New("failed to watch metrics")
+		}
+		return newCollector(c, hostname, config, item)
+	}
+
+	// The watch failures are returned at startup, the collectors already created are cleaned up
+	_, cleanup, err := NewMetricsPipeline(config, nil, "", failingSwitch, fieldEntityGroupTypeSystemInfo)
+	require.ErrorContains(t, err, "failed to watch metrics")
+	cleanup()
+	assert.Equal(t, 1, cleanupCounter)
+
+	p, cleanup, err := NewMetricsPipeline(config, nil, "", newCollector, fieldEntityGroupTypeSystemInfo)
+	require.NoError(t, err)
+	defer cleanup()
+	previous := p.gpuCollector
+
+	// A failed reload keeps the current collectors
+	counters := []Counter{{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}}
+	err = p.Reload(counters, failingSwitch, fieldEntityGroupTypeSystemInfo)
+	require.ErrorContains(t, err, "failed to watch metrics")
+	assert.Same(t, previous, p.gpuCollector)
+	assert.NotNil(t, p.switchCollector)
+	assert.Nil(t, p.counters)
+	assert.Equal(t, 2, cleanupCounter)
+}
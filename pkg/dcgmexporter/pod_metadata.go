@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	PodMetadataSourceAPIServer = "apiserver"
+	PodMetadataSourceKubelet   = "kubelet"
+
+	podLabelAttributePrefix      = "label_"
+	podAnnotationAttributePrefix = "annotation_"
+)
+
+var (
+	invalidAttributeChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	podMetadataCachesMtx sync.Mutex
+	podMetadataCaches    = map[string]*podMetadataCache{}
+)
+
+// podMetadataCache keeps the labels and annotations of the pods of the node, so that the pod mappers can add
+// them to the metrics. The pods are watched through the API server, or listed from the /pods endpoint of the
+// kubelet every interval.
+type podMetadataCache struct {
+	store  cache.Store
+	synced cache.InformerSynced
+	run    func(stop <-chan struct{}) // Starts filling the store
+	stop   chan struct{}
+}
+
+// getPodMetadataCache returns the pod metadata cache of the source of the config, which is shared by the pod
+// mappers of the pipeline and of all the collectors.
+func getPodMetadataCache(c *Config) (*podMetadataCache, error) {
+	podMetadataCachesMtx.Lock()
+	defer podMetadataCachesMtx.Unlock()
+
+	if metadata, exists := podMetadataCaches[c.PodMetadataSource]; exists {
+		return metadata, nil
+	}
+
+	var metadata *podMetadataCache
+	switch c.PodMetadataSource {
+	case PodMetadataSourceAPIServer:
+		nodeName := os.Getenv("NODE_NAME")
+		if nodeName == "" {
+			return nil, fmt.Errorf("the NODE_NAME environment variable is required to watch the pods of the node")
+		}
+		client, err := getKubeClient()
+		if err != nil {
+			return nil, fmt.Errorf("cannot create the Kubernetes client; err: %w", err)
+		}
+		metadata = newAPIServerPodMetadataCache(client, nodeName)
+	case PodMetadataSourceKubelet:
+		client, err := getKubeletClient(c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create the kubelet client; err: %w", err)
+		}
+		interval := time.Duration(c.CollectInterval) * time.Millisecond
+		if interval <= 0 {
+			interval = defaultPodResourcesInterval
+		}
+		metadata = newKubeletPodMetadataCache(client, c.KubeletPodsURL, interval)
+	default:
+		return nil, fmt.Errorf("invalid pod metadata source '%s'; expected '%s' or '%s'",
+			c.PodMetadataSource, PodMetadataSourceAPIServer, PodMetadataSourceKubelet)
+	}
+
+	// The pods are listed in the background, the collections don't wait for them
+	metadata.start()
+	podMetadataCaches[c.PodMetadataSource] = metadata
+	return metadata, nil
+}
+
+// closePodMetadataCaches stops filling the shared caches, and forgets them.
+func closePodMetadataCaches() {
+	podMetadataCachesMtx.Lock()
+	defer podMetadataCachesMtx.Unlock()
+
+	for source, metadata := range podMetadataCaches {
+		metadata.close()
+		delete(podMetadataCaches, source)
+	}
+}
+
+// newAPIServerPodMetadataCache watches the pods scheduled on the node through the API server.
+func newAPIServerPodMetadataCache(client kubernetes.Interface, nodeName string) *podMetadataCache {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+		}),
+		informers.WithTransform(stripPod))
+	informer := factory.Core().V1().Pods().Informer()
+
+	return &podMetadataCache{
+		store:  informer.GetStore(),
+		synced: informer.HasSynced,
+		run:    factory.Start,
+		stop:   make(chan struct{}),
+	}
+}
+
+// newKubeletPodMetadataCache lists the pods of the node from the /pods endpoint of the kubelet every interval,
+// as the kubelet doesn't support watches.
+func newKubeletPodMetadataCache(client *http.Client, url string, interval time.Duration) *podMetadataCache {
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	var synced atomic.Bool
+
+	return &podMetadataCache{
+		store:  store,
+		synced: synced.Load,
+		run: func(stop <-chan struct{}) {
+			go func() {
+				for {
+					pods, err := listKubeletPods(client, url)
+					if err != nil {
+						logrus.WithError(err).Warn("Failed to list the pods of the kubelet; keeping the previous pods")
+					} else {
+						objs := make([]interface{}, 0, len(pods))
+						for i := range pods {
+							pod, _ := stripPod(&pods[i])
+							objs = append(objs, pod)
+						}
+						if err := store.Replace(objs, ""); err != nil {
+							logrus.WithError(err).Warn("Failed to update the pods of the kubelet")
+						}
+						synced.Store(true)
+					}
+
+					select {
+					case <-stop:
+						return
+					case <-time.After(interval):
+					}
+				}
+			}()
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+// getKubeletClient returns a client of the kubelet authenticated with the service account of the exporter.
+func getKubeletClient(c *Config) (*http.Client, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := kubeletTLSConfig(c, config.TLSClientConfig.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.TLSClientConfig = tlsConfig
+
+	return rest.HTTPClientFor(config)
+}
+
+// kubeletTLSConfig returns the TLS config of the kubelet client. The serving certificate of the kubelet is
+// verified with the CA of the config, the cluster CA otherwise, unless the verification is explicitly skipped.
+// As the certificate is issued for the node, it is verified against NODE_NAME when the kubelet is reached
+// through the loopback interface.
+func kubeletTLSConfig(c *Config, clusterCAFile string) (rest.TLSClientConfig, error) {
+	if c.KubeletSkipTLSVerify {
+		logrus.Warn("Not verifying the serving certificate of the kubelet")
+		return rest.TLSClientConfig{Insecure: true}, nil
+	}
+
+	tlsConfig := rest.TLSClientConfig{CAFile: clusterCAFile}
+	if c.KubeletCAFile != "" {
+		tlsConfig.CAFile = c.KubeletCAFile
+	}
+
+	u, err := url.Parse(c.KubeletPodsURL)
+	if err != nil {
+		return rest.TLSClientConfig{}, fmt.Errorf("invalid kubelet pods URL '%s'; err: %w", c.KubeletPodsURL, err)
+	}
+	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" && isLoopbackHost(u.Hostname()) {
+		tlsConfig.ServerName = nodeName
+	}
+
+	return tlsConfig, nil
+}
+
+// isLoopbackHost returns whether host is localhost or a loopback address.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func listKubeletPods(client *http.Client, url string) ([]corev1.Pod, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubelet pods URL '%s'; err: %w", url, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failure getting the pods from '%s'; err: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failure getting the pods from '%s'; status: %s", url, resp.Status)
+	}
+
+	var pods corev1.PodList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("invalid pods from '%s'; err: %w", url, err)
+	}
+
+	return pods.Items, nil
+}
+
+// stripPod keeps only the name, namespace, labels, annotations and owners of the pods, to limit the memory of the
+// cache.
+func stripPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		// Tombstones of deleted pods
+		return obj, nil
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+			Labels:          pod.Labels,
+			Annotations:     pod.Annotations,
+			OwnerReferences: pod.OwnerReferences,
+		},
+	}, nil
+}
+
+// start starts filling the cache.
+func (p *podMetadataCache) start() {
+	p.run(p.stop)
+}
+
+// get returns the pod, nil when it isn't known or when the pods weren't listed yet: the pod labels and
+// annotations are added once the pods are listed.
+func (p *podMetadataCache) get(namespace, name string) *corev1.Pod {
+	if !p.synced() {
+		return nil
+	}
+
+	obj, exists, err := p.store.GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil
+	}
+
+	pod, _ := obj.(*corev1.Pod)
+	return pod
+}
+
+// close stops filling the cache.
+func (p *podMetadataCache) close() {
+	close(p.stop)
+}
+
+// podMetadataAttributes returns the allow-listed labels and annotations of the pod, as metric attributes.
+func podMetadataAttributes(pod *corev1.Pod, labels, annotations []string) map[string]string {
+	attributes := map[string]string{}
+	if pod == nil {
+		return attributes
+	}
+
+	for _, label := range labels {
+		if value, exists := pod.Labels[label]; exists {
+			attributes[podMetadataAttributeName(podLabelAttributePrefix, label)] = value
+		}
+	}
+	for _, annotation := range annotations {
+		if value, exists := pod.Annotations[annotation]; exists {
+			attributes[podMetadataAttributeName(podAnnotationAttributePrefix, annotation)] = value
+		}
+	}
+
+	return attributes
+}
+
+// podMetadataAttributeName returns the name of the attribute of a label or annotation, like kube-state-metrics:
+// the 'app.kubernetes.io/name' label is added as 'label_app_kubernetes_io_name'.
+func podMetadataAttributeName(prefix, name string) string {
+	return prefix + invalidAttributeChars.ReplaceAllString(name, "_")
+}
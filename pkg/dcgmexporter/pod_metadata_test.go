@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func testPod(name string, labels, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{NodeName: "node-a"},
+	}
+}
+
+// startTestPodMetadataCache starts filling the cache, and waits for the pods to be listed.
+func startTestPodMetadataCache(t *testing.T, metadata *podMetadataCache) *podMetadataCache {
+	metadata.start()
+	require.Eventually(t, metadata.synced, 5*time.Second, 10*time.Millisecond)
+	return metadata
+}
+
+func TestPodMetadataAttributes(t *testing.T) {
+	pod := testPod("gpu-pod-0",
+		map[string]string{"team": "ml", "app.kubernetes.io/name": "trainer", "unlisted": "x"},
+		map[string]string{"example.com/cost-center": "1234", "unlisted": "x"})
+
+	assert.Equal(t, map[string]string{
+		"label_team":                         "ml",
+		"label_app_kubernetes_io_name":       "trainer",
+		"annotation_example_com_cost_center": "1234",
+	}, podMetadataAttributes(pod,
+		[]string{"team", "app.kubernetes.io/name", "missing"},
+		[]string{"example.com/cost-center"}))
+
+	assert.Empty(t, podMetadataAttributes(nil, []string{"team"}, nil))
+}
+
+func TestAPIServerPodMetadataCache(t *testing.T) {
+	client := fake.NewSimpleClientset(testPod("gpu-pod-0", map[string]string{"team": "ml"}, nil))
+
+	metadata := startTestPodMetadataCache(t, newAPIServerPodMetadataCache(client, "node-a"))
+	defer metadata.close()
+
+	pod := metadata.get("default", "gpu-pod-0")
+	require.NotNil(t, pod)
+	assert.Equal(t, map[string]string{"team": "ml"}, pod.Labels)
+	assert.Empty(t, pod.Spec, "only the metadata of the pods is cached")
+	assert.Nil(t, metadata.get("default", "unknown"))
+
+	// The pods are watched
+	_, err := client.CoreV1().Pods("default").Create(context.Background(),
+		testPod("gpu-pod-1", map[string]string{"team": "infra"}, nil), metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		pod := metadata.get("default", "gpu-pod-1")
+		return pod != nil && pod.Labels["team"] == "infra"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestKubeletPodMetadataCache(t *testing.T) {
+	var team atomic.Value
+	team.Store("ml")
+	var available atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/pods", r.URL.Path)
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		pods := corev1.PodList{Items: []corev1.Pod{
+			*testPod("gpu-pod-0", map[string]string{"team": team.Load().(string)}, nil),
+		}}
+		assert.NoError(t, json.NewEncoder(w).Encode(pods))
+	}))
+	defer server.Close()
+
+	metadata := newKubeletPodMetadataCache(server.Client(), server.URL+"/pods", 10*time.Millisecond)
+	metadata.start()
+	defer metadata.close()
+
+	// The collections don't wait for the pods to be listed
+	assert.Nil(t, metadata.get("default", "gpu-pod-0"))
+
+	available.Store(true)
+	require.Eventually(t, func() bool {
+		return metadata.get("default", "gpu-pod-0") != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	pod := metadata.get("default", "gpu-pod-0")
+	assert.Equal(t, map[string]string{"team": "ml"}, pod.Labels)
+
+	// The pods are listed every interval
+	team.Store("infra")
+	require.Eventually(t, func() bool {
+		return metadata.get("default", "gpu-pod-0").Labels["team"] == "infra"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestKubeletTLSConfig(t *testing.T) {
+	t.Setenv("NODE_NAME", "node-a")
+
+	tlsConfig, err := kubeletTLSConfig(&Config{KubeletPodsURL: "https://localhost:10250/pods"}, "/ca.crt")
+	require.NoError(t, err)
+	assert.Equal(t, rest.TLSClientConfig{CAFile: "/ca.crt", ServerName: "node-a"}, tlsConfig)
+
+	tlsConfig, err = kubeletTLSConfig(&Config{
+		KubeletPodsURL: "https://10.0.0.1:10250/pods",
+		KubeletCAFile:  "/kubelet-ca.crt",
+	}, "/ca.crt")
+	require.NoError(t, err)
+	assert.Equal(t, rest.TLSClientConfig{CAFile: "/kubelet-ca.crt"}, tlsConfig)
+
+	tlsConfig, err = kubeletTLSConfig(&Config{
+		KubeletPodsURL:       "https://localhost:10250/pods",
+		KubeletSkipTLSVerify: true,
+	}, "/ca.crt")
+	require.NoError(t, err)
+	assert.Equal(t, rest.TLSClientConfig{Insecure: true}, tlsConfig)
+}
+
+func TestPodMapper_ProcessPodMetadata(t *testing.T) {
+	c := &Config{
+		KubernetesGPUIdType:      GPUUID,
+		KubernetesPodLabels:      []string{"app.kubernetes.io/name"},
+		KubernetesPodAnnotations: []string{"example.com/cost-center"},
+	}
+	podMetadata := startTestPodMetadataCache(t, newAPIServerPodMetadataCache(fake.NewSimpleClientset(testPod("gpu-pod-0",
+		map[string]string{"app.kubernetes.io/name": "trainer", "team": "ml"},
+		map[string]string{"example.com/cost-center": "1234"})), "node-a"))
+	defer podMetadata.close()
+	podMapper := &PodMapper{Config: c, podResources: testPodResources(t, "GPU-1"), podMetadata: podMetadata}
+
+	metrics := processTestMetrics(t, podMapper, "GPU-1")
+	assert.Equal(t, map[string]string{
+		podAttribute:                         "gpu-pod-0",
+		namespaceAttribute:                   "default",
+		containerAttribute:                   "default",
+		"label_app_kubernetes_io_name":       "trainer",
+		"annotation_example_com_cost_center": "1234",
+	}, metrics[0].Attributes)
+}
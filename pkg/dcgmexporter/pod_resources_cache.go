@@ -0,0 +1,329 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/NVIDIA/dcgm-exporter/internal/pkg/nvmlprovider"
+)
+
+const (
+	podResourcesMinBackoff = time.Second
+	podResourcesMaxBackoff = 30 * time.Second
+
+	// defaultPodResourcesInterval is used when the collect interval isn't configured.
+	defaultPodResourcesInterval = 30 * time.Second
+)
+
+var (
+	podResourcesCachesMtx sync.Mutex
+	podResourcesCaches    = map[string]*podResourcesCache{}
+)
+
+// podResourcesCache lists the pod resources of the kubelet in the background, over a persistent gRPC connection,
+// so that the collections don't wait for the kubelet. The last successful list is kept while the kubelet
+// doesn't answer.
+// The v1 API is used when the kubelet serves it, with fallback to v1alpha1. With v1, the allocatable GPUs and MIG
+// devices are exported by the dcgm_exporter_pod_resources_device_assigned metric.
+type podResourcesCache struct {
+	socketPath    string
+	resourceNames []string // Extra resource names of the GPUs, see Config.NvidiaResourceNames
+	interval      time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+
+	// Only accessed by the refreshes
+	v1alpha1      bool // The kubelet of the connection doesn't serve the v1 API
+	noAllocatable bool // The kubelet of the connection doesn't serve GetAllocatableResources
+
+	ready chan struct{} // Closed after the first refresh, successful or not
+	stop  chan struct{}
+
+	mtx        sync.RWMutex
+	pods       []*podresourcesapi.PodResources
+	migDevices map[string]*nvmlprovider.MIGDeviceInfo // Parent GPU and GPU instance of the MIG device IDs
+}
+
+// getPodResourcesCache returns the cache of the kubelet socket of the config, which is shared by the pod mappers
+// of the pipeline and of all the collectors. The refreshes start when the cache is created.
+func getPodResourcesCache(c *Config) *podResourcesCache {
+	podResourcesCachesMtx.Lock()
+	defer podResourcesCachesMtx.Unlock()
+
+	cache, exists := podResourcesCaches[c.PodResourcesKubeletSocket]
+	if !exists {
+		interval := time.Duration(c.CollectInterval) * time.Millisecond
+		if interval <= 0 {
+			interval = defaultPodResourcesInterval
+		}
+		cache = newPodResourcesCache(c.PodResourcesKubeletSocket, c.NvidiaResourceNames, interval)
+		cache.start()
+		podResourcesCaches[c.PodResourcesKubeletSocket] = cache
+	}
+	return cache
+}
+
+// closePodResourcesCaches stops the refreshes of the shared caches, and forgets them.
+func closePodResourcesCaches() {
+	podResourcesCachesMtx.Lock()
+	defer podResourcesCachesMtx.Unlock()
+
+	for socketPath, cache := range podResourcesCaches {
+		cache.close()
+		delete(podResourcesCaches, socketPath)
+	}
+}
+
+func newPodResourcesCache(socketPath string, resourceNames []string, interval time.Duration) *podResourcesCache {
+	return &podResourcesCache{
+		socketPath:    socketPath,
+		resourceNames: resourceNames,
+		interval:      interval,
+		minBackoff:    podResourcesMinBackoff,
+		maxBackoff:    podResourcesMaxBackoff,
+		ready:         make(chan struct{}),
+		stop:          make(chan struct{}),
+	}
+}
+
+// start starts the refreshes in the background.
+func (p *podResourcesCache) start() {
+	go p.run()
+}
+
+// get returns the pod resources of the last successful list, none until the first list.
+func (p *podResourcesCache) get() ([]*podresourcesapi.PodResources, map[string]*nvmlprovider.MIGDeviceInfo) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	return p.pods, p.migDevices
+}
+
+// run refreshes the pod resources every interval, until the cache is closed. The connection is reopened with
+// backoff when the kubelet fails.
+func (p *podResourcesCache) run() {
+	var conn *grpc.ClientConn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	backoff := p.minBackoff
+	first := true
+
+	for {
+		delay := p.interval
+		var err error
+		conn, err = p.refresh(conn)
+		if err != nil {
+			logrus.WithError(err).Warnf("Failed to list the pod resources; retrying in %s", backoff)
+			delay = backoff
+			backoff = min(backoff*2, p.maxBackoff)
+		} else {
+			backoff = p.minBackoff
+		}
+
+		if first {
+			close(p.ready)
+			first = false
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// close stops the refreshes.
+func (p *podResourcesCache) close() {
+	close(p.stop)
+}
+
+// refresh lists the pod resources over conn, which is opened when nil. It returns the connection to reuse, nil
+// after a failure. The assigned devices are only exported while the allocatable devices are known: they are
+// reset when the kubelet is unreachable, or doesn't serve or fails to return the allocatable devices.
+func (p *podResourcesCache) refresh(conn *grpc.ClientConn) (*grpc.ClientConn, error) {
+	assignedUpdated := false
+	defer func() {
+		if !assignedUpdated {
+			podResourcesDeviceAssigned.Reset()
+		}
+	}()
+
+	if _, err := os.Stat(p.socketPath); os.IsNotExist(err) {
+		if conn != nil {
+			conn.Close()
+		}
+		if p.listed() {
+			// The kubelet removes its socket while restarting, keep the pods until it's back
+			podResourcesErrors.WithLabelValues("connect").Inc()
+			return nil, fmt.Errorf("kubelet socket '%s' is missing", p.socketPath)
+		}
+		logrus.Debug("No Kubelet socket, ignoring")
+		return nil, nil
+	}
+
+	if conn == nil {
+		var err error
+		conn, _, err = connectToServer(p.socketPath)
+		if err != nil {
+			podResourcesErrors.WithLabelValues("connect").Inc()
+			return nil, err
+		}
+		// The kubelet may have been upgraded or downgraded
+		p.v1alpha1 = false
+		p.noAllocatable = false
+	}
+
+	pods, err := p.listPods(conn)
+	if err != nil {
+		podResourcesErrors.WithLabelValues("list").Inc()
+		conn.Close()
+		return nil, err
+	}
+
+	p.update(pods)
+
+	allocatable, err := p.getAllocatableDevices(conn)
+	if err != nil {
+		// The pods are listed, the allocatable devices are retried on the next refresh
+		podResourcesErrors.WithLabelValues("allocatable").Inc()
+		logrus.WithError(err).Warn("Failed to get the allocatable devices")
+		return conn, nil
+	}
+	if allocatable != nil {
+		p.updateAssignedDevices(pods, allocatable)
+		assignedUpdated = true
+	}
+
+	return conn, nil
+}
+
+// listPods lists the pod resources with the v1 API, or with the v1alpha1 API when the kubelet doesn't serve v1.
+func (p *podResourcesCache) listPods(conn *grpc.ClientConn) ([]*podresourcesapi.PodResources, error) {
+	if !p.v1alpha1 {
+		pods, err := listPods(conn)
+		if !isUnimplemented(err) {
+			return pods, err
+		}
+		logrus.Info("The kubelet doesn't serve the v1 pod-resources API, falling back to v1alpha1")
+		p.v1alpha1 = true
+	}
+
+	return listPodsV1alpha1(conn)
+}
+
+// getAllocatableDevices returns the devices the kubelet can allocate to pods, nil when the kubelet doesn't serve
+// GetAllocatableResources.
+func (p *podResourcesCache) getAllocatableDevices(conn *grpc.ClientConn) ([]*podresourcesapi.ContainerDevices, error) {
+	if p.v1alpha1 || p.noAllocatable {
+		return nil, nil
+	}
+
+	devices, err := getAllocatableDevices(conn)
+	if isUnimplemented(err) {
+		// Before Kubernetes 1.23, GetAllocatableResources is behind the KubeletPodResourcesGetAllocatable feature gate
+		logrus.Info("The kubelet doesn't serve the allocatable resources; the allocatable devices aren't exported")
+		p.noAllocatable = true
+		return nil, nil
+	}
+
+	return devices, err
+}
+
+// updateAssignedDevices exports the allocatable GPUs and MIG devices, and whether they are assigned to a pod.
+func (p *podResourcesCache) updateAssignedDevices(
+	pods []*podresourcesapi.PodResources, allocatable []*podresourcesapi.ContainerDevices,
+) {
+	assigned := map[string]bool{}
+	for _, pod := range pods {
+		for _, container := range pod.GetContainers() {
+			for _, device := range container.GetDevices() {
+				for _, deviceID := range device.GetDeviceIds() {
+					assigned[device.GetResourceName()+"/"+deviceID] = true
+				}
+			}
+		}
+	}
+
+	podResourcesDeviceAssigned.Reset()
+	for _, device := range allocatable {
+		if !isNvidiaResource(device.GetResourceName(), p.resourceNames) {
+			continue
+		}
+		for _, deviceID := range device.GetDeviceIds() {
+			value := 0.0
+			if assigned[device.GetResourceName()+"/"+deviceID] {
+				value = 1
+			}
+			podResourcesDeviceAssigned.WithLabelValues(device.GetResourceName(), deviceID).Set(value)
+		}
+	}
+}
+
+func isUnimplemented(err error) bool {
+	return status.Code(err) == codes.Unimplemented
+}
+
+// listed returns whether the pod resources were listed at least once.
+func (p *podResourcesCache) listed() bool {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	return p.migDevices != nil
+}
+
+// update replaces the pod resources, and resolves the parent GPU and the GPU instance of their MIG devices.
+func (p *podResourcesCache) update(pods []*podresourcesapi.PodResources) {
+	migDevices := map[string]*nvmlprovider.MIGDeviceInfo{}
+	for _, pod := range pods {
+		for _, container := range pod.GetContainers() {
+			for _, device := range container.GetDevices() {
+				for _, deviceID := range device.GetDeviceIds() {
+					if _, resolved := migDevices[deviceID]; resolved || !strings.HasPrefix(deviceID, MIG_UUID_PREFIX) {
+						continue
+					}
+					migDevice, err := nvmlGetMIGDeviceInfoByIDHook(deviceID)
+					if err != nil {
+						logrus.WithError(err).Debugf("Cannot resolve the MIG device '%s'", deviceID)
+						continue
+					}
+					migDevices[deviceID] = migDevice
+				}
+			}
+		}
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.pods = pods
+	p.migDevices = migDevices
+}
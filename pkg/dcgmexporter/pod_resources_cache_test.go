@@ -0,0 +1,323 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+	podresourcesv1alpha1 "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
+
+	"github.com/NVIDIA/dcgm-exporter/internal/pkg/nvmlprovider"
+)
+
+// testPodResourcesCache returns a cache of the socket, after its first refresh.
+func testPodResourcesCache(socketPath string) *podResourcesCache {
+	cache := newPodResourcesCache(socketPath, nil, 10*time.Millisecond)
+	cache.minBackoff = 10 * time.Millisecond
+	cache.maxBackoff = 10 * time.Millisecond
+	cache.start()
+	<-cache.ready
+	return cache
+}
+
+func startPodResourcesServer(t *testing.T, socketPath string, gpus []string) func() {
+	server := grpc.NewServer()
+	podresourcesv1alpha1.RegisterPodResourcesListerServer(server, NewPodResourcesMockServer(nvidiaResourceName, gpus))
+	return StartMockServer(t, server, socketPath)
+}
+
+// podResourcesV1MockServer serves the v1 pod-resources API, without the v1alpha1 API.
+type podResourcesV1MockServer struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	pods          []*podresourcesapi.PodResources
+	allocatable   []*podresourcesapi.ContainerDevices
+	noAllocatable bool // GetAllocatableResources is behind a disabled feature gate
+}
+
+func (s *podResourcesV1MockServer) List(
+	ctx context.Context, req *podresourcesapi.ListPodResourcesRequest,
+) (*podresourcesapi.ListPodResourcesResponse, error) {
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: s.pods}, nil
+}
+
+func (s *podResourcesV1MockServer) GetAllocatableResources(
+	ctx context.Context, req *podresourcesapi.AllocatableResourcesRequest,
+) (*podresourcesapi.AllocatableResourcesResponse, error) {
+	if s.noAllocatable {
+		return nil, status.Error(codes.Unimplemented, "feature gate disabled")
+	}
+	return &podresourcesapi.AllocatableResourcesResponse{Devices: s.allocatable}, nil
+}
+
+func podDeviceIDs(pods []*podresourcesapi.PodResources) []string {
+	var res []string
+	for _, pod := range pods {
+		for _, container := range pod.GetContainers() {
+			for _, device := range container.GetDevices() {
+				res = append(res, device.GetDeviceIds()...)
+			}
+		}
+	}
+	return res
+}
+
+func TestPodResourcesCache_Get(t *testing.T) {
+	tmpDir, cleanup := CreateTmpDir(t)
+	defer cleanup()
+	socketPath := tmpDir + "/kubelet.sock"
+
+	stopServer := startPodResourcesServer(t, socketPath,
+		[]string{"GPU-00000000-0000-0000-0000-000000000000", "MIG-b8ea3855-276c-c9cb-b366-c6fa655957c5"})
+	defer stopServer()
+
+	nvmlGetMIGDeviceInfoByIDHook = func(uuid string) (*nvmlprovider.MIGDeviceInfo, error) {
+		return &nvmlprovider.MIGDeviceInfo{
+			ParentUUID:    "00000000-0000-0000-0000-000000000000",
+			GPUInstanceID: 3,
+		}, nil
+	}
+	defer func() {
+		nvmlGetMIGDeviceInfoByIDHook = nvmlprovider.GetMIGDeviceInfoByID
+	}()
+
+	cache := testPodResourcesCache(socketPath)
+	defer cache.close()
+
+	pods, migDevices := cache.get()
+	assert.Equal(t, []string{"GPU-00000000-0000-0000-0000-000000000000", "MIG-b8ea3855-276c-c9cb-b366-c6fa655957c5"},
+		podDeviceIDs(pods))
+	require.Contains(t, migDevices, "MIG-b8ea3855-276c-c9cb-b366-c6fa655957c5")
+	assert.Equal(t, 3, migDevices["MIG-b8ea3855-276c-c9cb-b366-c6fa655957c5"].GPUInstanceID)
+	assert.Len(t, migDevices, 1)
+}
+
+func TestPodResourcesCache_GetBeforeFirstList(t *testing.T) {
+	tmpDir, cleanup := CreateTmpDir(t)
+	defer cleanup()
+
+	// The collections don't wait for the first list
+	cache := newPodResourcesCache(tmpDir+"/kubelet.sock", nil, time.Hour)
+	pods, migDevices := cache.get()
+	assert.Empty(t, pods)
+	assert.Empty(t, migDevices)
+}
+
+func TestCloseKubernetesCaches(t *testing.T) {
+	tmpDir, cleanup := CreateTmpDir(t)
+	defer cleanup()
+
+	cache := getPodResourcesCache(&Config{PodResourcesKubeletSocket: tmpDir + "/kubelet.sock"})
+	assert.Same(t, cache, getPodResourcesCache(&Config{PodResourcesKubeletSocket: tmpDir + "/kubelet.sock"}))
+
+	CloseKubernetesCaches()
+	assert.Empty(t, podResourcesCaches)
+	select {
+	case <-cache.stop:
+	default:
+		t.Fatal("The cache wasn't closed")
+	}
+}
+
+func TestPodResourcesCache_KubeletRestart(t *testing.T) {
+	tmpDir, cleanup := CreateTmpDir(t)
+	defer cleanup()
+	socketPath := tmpDir + "/kubelet.sock"
+
+	stopServer := startPodResourcesServer(t, socketPath, []string{"GPU-1"})
+
+	cache := testPodResourcesCache(socketPath)
+	defer cache.close()
+
+	pods, _ := cache.get()
+	require.Equal(t, []string{"GPU-1"}, podDeviceIDs(pods))
+
+	// The pods are kept while the kubelet is down
+	stopServer()
+	time.Sleep(50 * time.Millisecond)
+	pods, _ = cache.get()
+	require.Equal(t, []string{"GPU-1"}, podDeviceIDs(pods))
+
+	// and refreshed once it's back
+	stopServer = startPodResourcesServer(t, socketPath, []string{"GPU-2"})
+	defer stopServer()
+
+	require.Eventually(t, func() bool {
+		pods, _ := cache.get()
+		return assert.ObjectsAreEqual([]string{"GPU-2"}, podDeviceIDs(pods))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPodResourcesCache_NoSocket(t *testing.T) {
+	tmpDir, cleanup := CreateTmpDir(t)
+	defer cleanup()
+
+	cache := testPodResourcesCache(tmpDir + "/kubelet.sock")
+	defer cache.close()
+
+	pods, migDevices := cache.get()
+	assert.Empty(t, pods)
+	assert.Empty(t, migDevices)
+}
+
+func TestPodMapper_ProcessCachedPods(t *testing.T) {
+	c := &Config{KubernetesGPUIdType: GPUUID, PodResourcesKubeletSocket: testPodResourcesSocket(t, "GPU-1")}
+	podMapper, err := NewPodMapper(c)
+	require.NoError(t, err)
+	defer CloseKubernetesCaches()
+	other, err := NewPodMapper(c)
+	require.NoError(t, err)
+	assert.Same(t, podMapper.podResources, other.podResources, "the pod mappers share a single cache")
+	<-podMapper.podResources.ready
+
+	metrics := processTestMetrics(t, podMapper, "GPU-1", "GPU-2")
+	assert.Equal(t, map[string]string{
+		podAttribute:       "gpu-pod-0",
+		namespaceAttribute: "default",
+		containerAttribute: "default",
+	}, metrics[0].Attributes)
+	assert.Empty(t, metrics[1].Attributes)
+}
+
+func TestPodResourcesCache_V1(t *testing.T) {
+	mockServer := &podResourcesV1MockServer{
+		pods: []*podresourcesapi.PodResources{
+			{
+				Name:      "gpu-pod",
+				Namespace: "default",
+				Containers: []*podresourcesapi.ContainerResources{
+					{
+						Name: "default",
+						Devices: []*podresourcesapi.ContainerDevices{
+							{ResourceName: nvidiaResourceName, DeviceIds: []string{"GPU-1"}},
+							{ResourceName: "nvidia.com/mig-1g.10gb", DeviceIds: []string{"MIG-1"}},
+						},
+					},
+				},
+			},
+		},
+		allocatable: []*podresourcesapi.ContainerDevices{
+			{ResourceName: nvidiaResourceName, DeviceIds: []string{"GPU-1", "GPU-2"}},
+			{ResourceName: "nvidia.com/mig-1g.10gb", DeviceIds: []string{"MIG-1", "MIG-2"}},
+			{ResourceName: "example.com/nic", DeviceIds: []string{"NIC-1"}},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		noAllocatable bool
+		want          map[string]float64
+	}{
+		{
+			name: "exports the allocatable devices",
+			want: map[string]float64{
+				nvidiaResourceName + "/GPU-1":       1,
+				nvidiaResourceName + "/GPU-2":       0,
+				"nvidia.com/mig-1g.10gb" + "/MIG-1": 1,
+				"nvidia.com/mig-1g.10gb" + "/MIG-2": 0,
+			},
+		},
+		{
+			name:          "without GetAllocatableResources",
+			noAllocatable: true,
+			want:          map[string]float64{},
+		},
+	}
+
+	nvmlGetMIGDeviceInfoByIDHook = func(uuid string) (*nvmlprovider.MIGDeviceInfo, error) {
+		return &nvmlprovider.MIGDeviceInfo{}, nil
+	}
+	defer func() {
+		nvmlGetMIGDeviceInfoByIDHook = nvmlprovider.GetMIGDeviceInfoByID
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir, cleanup := CreateTmpDir(t)
+			defer cleanup()
+			socketPath := tmpDir + "/kubelet.sock"
+
+			mockServer.noAllocatable = tt.noAllocatable
+			server := grpc.NewServer()
+			podresourcesapi.RegisterPodResourcesListerServer(server, mockServer)
+			stopServer := StartMockServer(t, server, socketPath)
+			defer stopServer()
+
+			podResourcesDeviceAssigned.Reset()
+			defer podResourcesDeviceAssigned.Reset()
+
+			cache := testPodResourcesCache(socketPath)
+			defer cache.close()
+
+			pods, _ := cache.get()
+			assert.Equal(t, []string{"GPU-1", "MIG-1"}, podDeviceIDs(pods))
+
+			got := map[string]float64{}
+			for resource, devices := range map[string][]string{
+				nvidiaResourceName:       {"GPU-1", "GPU-2"},
+				"nvidia.com/mig-1g.10gb": {"MIG-1", "MIG-2"},
+			} {
+				for _, device := range devices {
+					if tt.noAllocatable {
+						continue
+					}
+					got[resource+"/"+device] = testutil.ToFloat64(
+						podResourcesDeviceAssigned.WithLabelValues(resource, device))
+				}
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, len(tt.want), testutil.CollectAndCount(podResourcesDeviceAssigned),
+				"only the allocatable GPUs and MIG devices are exported")
+		})
+	}
+}
+
+func TestPodResourcesCache_V1_KubeletDown(t *testing.T) {
+	tmpDir, cleanup := CreateTmpDir(t)
+	defer cleanup()
+	socketPath := tmpDir + "/kubelet.sock"
+
+	mockServer := &podResourcesV1MockServer{
+		allocatable: []*podresourcesapi.ContainerDevices{
+			{ResourceName: nvidiaResourceName, DeviceIds: []string{"GPU-1", "GPU-2"}},
+		},
+	}
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, mockServer)
+	stopServer := StartMockServer(t, server, socketPath)
+
+	podResourcesDeviceAssigned.Reset()
+	defer podResourcesDeviceAssigned.Reset()
+
+	cache := testPodResourcesCache(socketPath)
+	defer cache.close()
+	assert.Equal(t, 2, testutil.CollectAndCount(podResourcesDeviceAssigned))
+
+	// The allocatable devices aren't known while the kubelet is down
+	stopServer()
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCount(podResourcesDeviceAssigned) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// collectionErrorDesc describes the invalid metric reported to a prometheus.Registry when a collection fails.
+var collectionErrorDesc = prometheus.NewDesc("dcgm_exporter_collection_error",
+	"Error reported when the collection of DCGM metrics fails.", nil, nil)
+
+// NewPrometheusRegistry returns a prometheus.Registry that collects the DCGM metrics of the pipeline and
+// the exporter metrics of the registry on every scrape, next to the self metrics and the Go runtime and process metrics.
+func NewPrometheusRegistry(pipeline *MetricsPipeline, registry *Registry) (*prometheus.Registry, error) {
+	reg := prometheus.NewRegistry()
+
+	for _, c := range append([]prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		pipeline,
+		registry,
+	}, selfMetrics...) {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return reg, nil
+}
+
+// familyMetric exposes a sample of a metric family as a prometheus.Metric.
+type familyMetric struct {
+	desc   *prometheus.Desc
+	metric *dto.Metric
+}
+
+func (m familyMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m familyMetric) Write(out *dto.Metric) error {
+	out.Label = m.metric.Label
+	out.Gauge = m.metric.Gauge
+	out.Counter = m.metric.Counter
+	out.Summary = m.metric.Summary
+	out.Untyped = m.metric.Untyped
+	out.Histogram = m.metric.Histogram
+	out.TimestampMs = m.metric.TimestampMs
+	return nil
+}
+
+// collectMetricFamilies sends every sample of the metric families to ch.
+func collectMetricFamilies(ch chan<- prometheus.Metric, families []*dto.MetricFamily) {
+	for _, mf := range families {
+		desc := prometheus.NewDesc(mf.GetName(), mf.GetHelp(), nil, nil)
+		for _, m := range mf.Metric {
+			ch <- familyMetric{desc: desc, metric: m}
+		}
+	}
+}
+
+// collectMetrics converts metrics into metric families and sends them to ch.
+func collectMetrics(ch chan<- prometheus.Metric, metrics MetricsByCounter, identity metricLabelsFunc) {
+	families := newMetricFamilyBuilder()
+	families.add(metrics, identity)
+	collectMetricFamilies(ch, families.build())
+}
+
+func metricLabelsForEntity(entityType dcgm.Field_Entity_Group) metricLabelsFunc {
+	switch entityType {
+	case dcgm.FE_SWITCH:
+		return switchMetricLabels
+	case dcgm.FE_LINK:
+		return linkMetricLabels
+	case dcgm.FE_CPU:
+		return cpuMetricLabels
+	case dcgm.FE_CPU_CORE:
+		return cpuCoreMetricLabels
+	default:
+		return gpuMetricLabels
+	}
+}
+
+// Describe sends no descriptors, which makes the pipeline an unchecked collector:
+// the set of DCGM metrics is only known after they are collected.
+func (m *MetricsPipeline) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect collects DCGM metrics of all entity types and applies the transformations.
+func (m *MetricsPipeline) Collect(ch chan<- prometheus.Metric) {
+	families, err := m.run(nil)
+	if err != nil {
+		// The failures are reported by dcgm_exporter_collector_up, along with the metrics of the other entity types
+		logrus.Errorf("Failed to collect metrics; err: %v", err)
+	}
+
+	collectMetricFamilies(ch, families)
+}
+
+// Describe sends no descriptors, which makes the collector an unchecked collector.
+func (c *DCGMCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect collects metrics of the entity type of the collector, without any transformation.
+func (c *DCGMCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics, err := c.GetMetrics()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(collectionErrorDesc, err)
+		return
+	}
+
+	collectMetrics(ch, metrics, metricLabelsForEntity(c.SysInfo.InfoType))
+}
+
+// Describe sends no descriptors, which makes the collector an unchecked collector.
+func (c *expCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect collects the exporter metrics of the collector.
+func (c *expCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics, err := c.getMetrics()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(collectionErrorDesc, err)
+		return
+	}
+
+	collectMetrics(ch, metrics, gpuMetricLabels)
+}
+
+// Describe sends no descriptors, which makes the registry an unchecked collector.
+func (r *Registry) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect collects metrics of all registered collectors.
+func (r *Registry) Collect(ch chan<- prometheus.Metric) {
+	if r.empty() {
+		return
+	}
+
+	dcgmConnection.RLock()
+	defer dcgmConnection.RUnlock()
+
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	for _, c := range r.collectors {
+		c.Collect(ch)
+	}
+}
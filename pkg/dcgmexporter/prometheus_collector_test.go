@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// familiesCollector is a prometheus.Collector that collects fixed metric families.
+type familiesCollector struct {
+	families []*dto.MetricFamily
+	err      error
+}
+
+func (c familiesCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c familiesCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.err != nil {
+		ch <- prometheus.NewInvalidMetric(collectionErrorDesc, c.err)
+		return
+	}
+	collectMetricFamilies(ch, c.families)
+}
+
+func TestCollectMetricFamilies(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(familiesCollector{families: testMetricFamilies()}))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, 2)
+
+	assert.Equal(t, "DCGM_FI_DEV_POWER_USAGE", families[0].GetName())
+	assert.Equal(t, "Power draw (in W).", families[0].GetHelp())
+	assert.Equal(t, dto.MetricType_GAUGE, families[0].GetType())
+	require.Len(t, families[0].Metric, 1)
+	assert.Equal(t, 42.0, families[0].Metric[0].GetGauge().GetValue())
+	// The registry sorts labels by name
+	assert.Equal(t, []string{"UUID", "device", "gpu", "modelName", "pci_bus_id"},
+		labelNames(families[0].Metric[0].Label))
+
+	assert.Equal(t, "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", families[1].GetName())
+	assert.Equal(t, dto.MetricType_COUNTER, families[1].GetType())
+	assert.Equal(t, 1234.0, families[1].Metric[0].GetCounter().GetValue())
+}
+
+func TestNativeMetricsServer_Metrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), familiesCollector{
+		families: append(testMetricFamilies(), testCollectorUpFamilies("1")...),
+	})
+
+	s, cleanup, err := NewNativeMetricsServer(&Config{Address: ":0", EnableOpenMetrics: true}, reg)
+	require.NoError(t, err)
+	defer cleanup()
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var parser expfmt.TextParser
+	mf, err := parser.TextToMetricFamilies(rec.Body)
+	require.NoError(t, err)
+	assert.Contains(t, mf, "go_goroutines")
+	assert.Contains(t, mf, "DCGM_FI_DEV_POWER_USAGE")
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, expfmt.TypeOpenMetrics, expfmt.Format(rec.Header().Get("Content-Type")).FormatType())
+	assert.Contains(t, rec.Body.String(), "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION_total{")
+
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestNativeMetricsServer_Metrics_CollectionError(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		familiesCollector{families: testMetricFamilies()},
+		familiesCollector{err: errors.New("boom")},
+	)
+
+	s, cleanup, err := NewNativeMetricsServer(&Config{Address: ":0"}, reg)
+	require.NoError(t, err)
+	defer cleanup()
+
+	// The error is returned along with the metrics of the healthy collectors
+	families, err := s.Gather()
+	assert.ErrorContains(t, err, "boom")
+	assert.Len(t, families, 2)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, req)
+
+	// Metrics of healthy collectors are still served
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "DCGM_FI_DEV_POWER_USAGE{")
+}
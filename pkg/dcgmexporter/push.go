@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	pushMinBackoff = 500 * time.Millisecond
+	pushMaxBackoff = 30 * time.Second
+)
+
+// pushSender sends the queued requests of a push sink, retrying recoverable failures with an exponential backoff.
+type pushSender[T any] struct {
+	sink       string // Name of the sink in logs and metrics
+	queue      *requestQueue[T]
+	send       func(context.Context, T) error
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func newPushSender[T any](sink string, queueSize int, send func(context.Context, T) error) *pushSender[T] {
+	return &pushSender[T]{
+		sink:       sink,
+		queue:      newRequestQueue[T](sink, queueSize),
+		send:       send,
+		minBackoff: pushMinBackoff,
+		maxBackoff: pushMaxBackoff,
+	}
+}
+
+// run sends the queued requests until stop is closed, which cancels the request in flight.
+func (s *pushSender[T]) run(stop chan interface{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.queue.ready:
+		}
+
+		for req, ok := s.queue.pop(); ok; req, ok = s.queue.pop() {
+			if !s.sendWithRetry(ctx, req) {
+				return
+			}
+		}
+	}
+}
+
+// sendWithRetry sends the request, retrying recoverable failures with an exponential backoff.
+// It returns false when ctx is canceled before the request could be sent.
+func (s *pushSender[T]) sendWithRetry(ctx context.Context, req T) bool {
+	backoff := s.minBackoff
+	for {
+		err := s.send(ctx, req)
+		if err == nil {
+			pushRequests.WithLabelValues(s.sink, "success").Inc()
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+
+		pushRequests.WithLabelValues(s.sink, "failure").Inc()
+
+		if !errors.As(err, &recoverableError{}) {
+			logrus.WithError(err).Errorf("Push to %s rejected; dropping the request", s.sink)
+			pushDroppedRequests.WithLabelValues(s.sink, "rejected").Inc()
+			return true
+		}
+
+		logrus.WithError(err).Warnf("Push to %s failed; retrying in %s", s.sink, backoff)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, s.maxBackoff)
+	}
+}
+
+// recoverableError is returned for failures worth retrying: network errors, throttling and server errors.
+type recoverableError struct {
+	error
+}
+
+// responseError returns the error of an HTTP response, if any. Throttling and server errors are recoverable.
+func responseError(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// requestQueue is a bounded in-memory queue of requests waiting to be pushed. When it is full,
+// the oldest request is dropped.
+type requestQueue[T any] struct {
+	mtx      sync.Mutex
+	sink     string
+	requests []T
+	size     int
+	ready    chan struct{} // Signaled when a request is pushed
+}
+
+func newRequestQueue[T any](sink string, size int) *requestQueue[T] {
+	return &requestQueue[T]{
+		sink:  sink,
+		size:  max(size, 1),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *requestQueue[T]) push(req T) {
+	q.mtx.Lock()
+	if len(q.requests) >= q.size {
+		q.requests = q.requests[1:]
+		pushDroppedRequests.WithLabelValues(q.sink, "queue_full").Inc()
+	}
+	q.requests = append(q.requests, req)
+	pushQueueLength.WithLabelValues(q.sink).Set(float64(len(q.requests)))
+	q.mtx.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *requestQueue[T]) pop() (T, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if len(q.requests) == 0 {
+		var zero T
+		return zero, false
+	}
+
+	req := q.requests[0]
+	q.requests = q.requests[1:]
+	pushQueueLength.WithLabelValues(q.sink).Set(float64(len(q.requests)))
+	return req, true
+}
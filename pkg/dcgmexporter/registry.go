@@ -35,11 +35,49 @@ func NewRegistry() *Registry {
 
 // Register registers a collector with the registry.
 func (r *Registry) Register(c Collector) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
 	r.collectors = append(r.collectors, c)
 }
 
+// Replace replaces the registered collectors with the collectors of other and cleans up the previous ones.
+func (r *Registry) Replace(other *Registry) {
+	other.mtx.Lock()
+	collectors := other.collectors
+	other.collectors = nil
+	other.mtx.Unlock()
+
+	r.mtx.Lock()
+	previous := r.collectors
+	r.collectors = collectors
+	r.mtx.Unlock()
+
+	for _, c := range previous {
+		c.Cleanup()
+	}
+}
+
+// Discard drops the registered collectors without cleaning them up, because their DCGM groups and field
+// watches are gone with the hostengine.
+func (r *Registry) Discard() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.collectors = nil
+}
+
 // Gather gathers metrics from all registered collectors.
 func (r *Registry) Gather() (MetricsByCounter, error) {
+	// Without collectors, there is no need to wait for the DCGM connection, which the collections of remote
+	// hostengines hold
+	if r.empty() {
+		return MetricsByCounter{}, nil
+	}
+
+	dcgmConnection.RLock()
+	defer dcgmConnection.RUnlock()
+
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 
@@ -84,8 +122,19 @@ func (r *Registry) Gather() (MetricsByCounter, error) {
 	return output, nil
 }
 
+// empty returns whether no collector is registered.
+func (r *Registry) empty() bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return len(r.collectors) == 0
+}
+
 // Cleanup resources of registered collectors
 func (r *Registry) Cleanup() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
 	for _, c := range r.collectors {
 		c.Cleanup()
 	}
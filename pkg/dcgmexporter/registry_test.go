@@ -19,7 +19,10 @@ package dcgmexporter
 import (
 	"errors"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
@@ -37,6 +40,10 @@ func (m *mockCollector) Cleanup() {
 	m.Called()
 }
 
+func (m *mockCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (m *mockCollector) Collect(ch chan<- prometheus.Metric) {}
+
 func TestRegistry_Gather(t *testing.T) {
 	collector := new(mockCollector)
 	reg := NewRegistry()
@@ -106,3 +113,65 @@ func TestRegistry_Gather(t *testing.T) {
 
 	}
 }
+
+func TestRegistry_Replace(t *testing.T) {
+	previous := new(mockCollector)
+	previous.On("Cleanup").Return()
+	next := new(mockCollector)
+
+	reg := NewRegistry()
+	reg.Register(previous)
+
+	other := NewRegistry()
+	other.Register(next)
+
+	reg.Replace(other)
+
+	previous.AssertCalled(t, "Cleanup")
+	next.AssertNotCalled(t, "Cleanup")
+	assert.Equal(t, []Collector{next}, reg.collectors)
+	assert.Empty(t, other.collectors)
+}
+
+func TestRegistry_Discard(t *testing.T) {
+	collector := new(mockCollector)
+
+	reg := NewRegistry()
+	reg.Register(collector)
+	reg.Discard()
+
+	collector.AssertNotCalled(t, "Cleanup")
+	assert.Empty(t, reg.collectors)
+
+	metrics, err := reg.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
+
+func TestRegistry_DiscardWhileCollecting(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register(new(mockCollector))
+
+	// A reconnection holds the DCGM connection while it discards the collectors; the collections waiting for the
+	// connection must not hold the registry meanwhile
+	dcgmConnection.Lock()
+	collected := make(chan struct{})
+	go func() {
+		reg.Collect(make(chan prometheus.Metric, 1))
+		close(collected)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	discarded := make(chan struct{})
+	go func() {
+		reg.Discard()
+		close(discarded)
+	}()
+	select {
+	case <-discarded:
+	case <-time.After(time.Second):
+		t.Fatal("Discard waited for the collection")
+	}
+	dcgmConnection.Unlock()
+	<-collected
+}
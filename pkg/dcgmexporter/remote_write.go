@@ -0,0 +1,293 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/config"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const remoteWriteTimeout = 30 * time.Second
+
+// RemoteWriter pushes the metrics to a Prometheus remote-write endpoint after every collection,
+// for exporters that can't be scraped.
+type RemoteWriter struct {
+	url         string
+	client      *http.Client
+	gatherer    prometheus.Gatherer
+	collections <-chan struct{} // Receives a value after each collection; nil when the gatherer collects
+	interval    time.Duration
+	sender      *pushSender[[]byte]
+}
+
+// NewRemoteWriter creates a RemoteWriter that pushes the metrics of the gatherer. When collections isn't nil,
+// the metrics are pushed every time it receives a value, so that the metrics of a collection are pushed once.
+// Otherwise the gatherer collects the metrics, which are pushed every collect interval. The TLS and
+// authentication options of the HTTP client are read from the remote-write config file, when one is given.
+func NewRemoteWriter(c *Config, gatherer prometheus.Gatherer, collections <-chan struct{}) (*RemoteWriter, error) {
+	httpConfig := config.DefaultHTTPClientConfig
+	if c.RemoteWriteConfigFile != "" {
+		cfg, _, err := config.LoadHTTPConfigFile(c.RemoteWriteConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read remote-write config file '%s'; err: %w", c.RemoteWriteConfigFile, err)
+		}
+		httpConfig = *cfg
+	}
+
+	client, err := config.NewClientFromConfig(httpConfig, "dcgm-exporter")
+	if err != nil {
+		return nil, fmt.Errorf("could not create remote-write client; err: %w", err)
+	}
+	client.Timeout = remoteWriteTimeout
+
+	w := &RemoteWriter{
+		url:         c.RemoteWriteURL,
+		client:      client,
+		gatherer:    gatherer,
+		collections: collections,
+		interval:    time.Duration(c.CollectInterval) * time.Millisecond,
+	}
+	w.sender = newPushSender("remote_write", c.RemoteWriteQueueSize, w.sendRequest)
+	return w, nil
+}
+
+func (w *RemoteWriter) Run(stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var senderwg sync.WaitGroup
+	senderwg.Add(1)
+	go func() {
+		defer senderwg.Done()
+		w.sender.run(stop)
+	}()
+
+	// A nil channel never receives, so only one of the cases below pushes the metrics.
+	var ticks <-chan time.Time
+	if w.collections == nil {
+		t := time.NewTicker(w.interval)
+		defer t.Stop()
+		ticks = t.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			senderwg.Wait()
+			return
+		case <-w.collections:
+			w.push()
+		case <-ticks:
+			w.push()
+		}
+	}
+}
+
+// push gathers the metrics and queues them to be sent.
+func (w *RemoteWriter) push() {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		logrus.WithError(err).Error("Failed to gather the metrics to push")
+	}
+	if len(families) == 0 {
+		return
+	}
+
+	w.sender.queue.push(snappy.Encode(nil, encodeWriteRequest(families, time.Now())))
+}
+
+func (w *RemoteWriter) sendRequest(ctx context.Context, req []byte) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(req))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+
+	return responseError(resp)
+}
+
+// Remote-write protocol buffers field numbers, as defined by the prometheus.WriteRequest message.
+const (
+	writeRequestTimeseries = 1
+	writeRequestMetadata   = 3
+
+	timeSeriesLabels  = 1
+	timeSeriesSamples = 2
+
+	labelName  = 1
+	labelValue = 2
+
+	sampleValue     = 1
+	sampleTimestamp = 2
+
+	metadataType       = 1
+	metadataFamilyName = 2
+	metadataHelp       = 4
+	metadataUnit       = 5
+)
+
+// remoteWriteMetricTypes maps the metric types to the prometheus.MetricMetadata.MetricType values.
+var remoteWriteMetricTypes = map[dto.MetricType]uint64{
+	dto.MetricType_COUNTER:   1,
+	dto.MetricType_GAUGE:     2,
+	dto.MetricType_HISTOGRAM: 3,
+	dto.MetricType_SUMMARY:   5,
+}
+
+// encodeWriteRequest encodes the metric families as a remote-write WriteRequest. Histograms and summaries
+// are encoded as their classic series. Samples without a timestamp are timestamped with now.
+func encodeWriteRequest(families []*dto.MetricFamily, now time.Time) []byte {
+	var b []byte
+
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			ts := now.UnixMilli()
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+
+			for _, s := range metricSeries(mf, m) {
+				b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+				b = protowire.AppendBytes(b, encodeTimeSeries(s.labels, s.value, ts))
+			}
+		}
+	}
+
+	for _, mf := range families {
+		var md []byte
+		md = protowire.AppendTag(md, metadataType, protowire.VarintType)
+		md = protowire.AppendVarint(md, remoteWriteMetricTypes[mf.GetType()])
+		md = appendStringField(md, metadataFamilyName, mf.GetName())
+		md = appendStringField(md, metadataHelp, mf.GetHelp())
+		md = appendStringField(md, metadataUnit, mf.GetUnit())
+
+		b = protowire.AppendTag(b, writeRequestMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, md)
+	}
+
+	return b
+}
+
+type series struct {
+	labels map[string]string
+	value  float64
+}
+
+// metricSeries returns the series of a sample, with their __name__ label.
+func metricSeries(mf *dto.MetricFamily, m *dto.Metric) []series {
+	newSeries := func(suffix string, value float64, extra ...string) series {
+		labels := map[string]string{"__name__": mf.GetName() + suffix}
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			labels[extra[i]] = extra[i+1]
+		}
+		return series{labels: labels, value: value}
+	}
+
+	switch mf.GetType() {
+	case dto.MetricType_GAUGE:
+		return []series{newSeries("", m.GetGauge().GetValue())}
+	case dto.MetricType_COUNTER:
+		return []series{newSeries("", m.GetCounter().GetValue())}
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		var res []series
+		for _, bucket := range h.Bucket {
+			res = append(res, newSeries("_bucket", float64(bucket.GetCumulativeCount()),
+				"le", formatFloat(bucket.GetUpperBound())))
+		}
+		return append(res,
+			newSeries("_bucket", float64(h.GetSampleCount()), "le", "+Inf"),
+			newSeries("_sum", h.GetSampleSum()),
+			newSeries("_count", float64(h.GetSampleCount())))
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		var res []series
+		for _, q := range s.Quantile {
+			res = append(res, newSeries("", q.GetValue(), "quantile", formatFloat(q.GetQuantile())))
+		}
+		return append(res,
+			newSeries("_sum", s.GetSampleSum()),
+			newSeries("_count", float64(s.GetSampleCount())))
+	default:
+		return []series{newSeries("", m.GetUntyped().GetValue())}
+	}
+}
+
+// encodeTimeSeries encodes a TimeSeries of a single sample. Labels are sorted by name, as required by the protocol.
+func encodeTimeSeries(labels map[string]string, value float64, ts int64) []byte {
+	var b []byte
+
+	for _, name := range sortedKeys(labels) {
+		var l []byte
+		l = appendStringField(l, labelName, name)
+		l = appendStringField(l, labelValue, labels[name])
+
+		b = protowire.AppendTag(b, timeSeriesLabels, protowire.BytesType)
+		b = protowire.AppendBytes(b, l)
+	}
+
+	var s []byte
+	s = protowire.AppendTag(s, sampleValue, protowire.Fixed64Type)
+	s = protowire.AppendFixed64(s, math.Float64bits(value))
+	s = protowire.AppendTag(s, sampleTimestamp, protowire.VarintType)
+	s = protowire.AppendVarint(s, uint64(ts))
+
+	b = protowire.AppendTag(b, timeSeriesSamples, protowire.BytesType)
+	return protowire.AppendBytes(b, s)
+}
+
+func appendStringField(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
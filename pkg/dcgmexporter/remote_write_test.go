@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"k8s.io/utils/ptr"
+)
+
+type receivedSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decodes the time series of a remote-write WriteRequest.
+func decodeWriteRequest(t *testing.T, b []byte) []receivedSeries {
+	var res []receivedSeries
+	forEachField(t, b, func(num protowire.Number, v []byte) {
+		if num != writeRequestTimeseries {
+			return
+		}
+		s := receivedSeries{labels: map[string]string{}}
+		forEachField(t, v, func(num protowire.Number, v []byte) {
+			switch num {
+			case timeSeriesLabels:
+				var name, value string
+				forEachField(t, v, func(num protowire.Number, v []byte) {
+					if num == labelName {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				s.labels[name] = value
+			case timeSeriesSamples:
+				value, n := protowire.ConsumeFixed64(v[1:])
+				require.Greater(t, n, 0)
+				s.value = math.Float64frombits(value)
+				ts, n := protowire.ConsumeVarint(v[1+n+1:])
+				require.Greater(t, n, 0)
+				s.timestamp = int64(ts)
+			}
+		})
+		res = append(res, s)
+	})
+	return res
+}
+
+func forEachField(t *testing.T, b []byte, f func(num protowire.Number, v []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.Greater(t, n, 0)
+		b = b[n:]
+		require.Equal(t, protowire.BytesType, typ)
+		v, n := protowire.ConsumeBytes(b)
+		require.Greater(t, n, 0)
+		b = b[n:]
+		f(num, v)
+	}
+}
+
+type remoteWriteReceiver struct {
+	mtx      sync.Mutex
+	statuses []int    // Statuses of the next responses, 204 when empty
+	requests [][]byte // Decompressed accepted requests
+	received chan struct{}
+}
+
+func (r *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	compressed, _ := io.ReadAll(req.Body)
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil || req.Header.Get("Content-Encoding") != "snappy" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.mtx.Lock()
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	if status == http.StatusNoContent {
+		r.requests = append(r.requests, b)
+	}
+	r.mtx.Unlock()
+
+	w.WriteHeader(status)
+	r.received <- struct{}{}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	families := testMetricFamilies()
+	families[0].Metric[0].TimestampMs = ptr.To(int64(1690000000000))
+
+	series := decodeWriteRequest(t, encodeWriteRequest(families, now))
+	require.Len(t, series, 2)
+
+	assert.Equal(t, "DCGM_FI_DEV_POWER_USAGE", series[0].labels["__name__"])
+	assert.Equal(t, "0", series[0].labels["gpu"])
+	assert.Equal(t, "GPU-0", series[0].labels["UUID"])
+	assert.Equal(t, float64(42), series[0].value)
+	assert.Equal(t, int64(1690000000000), series[0].timestamp)
+
+	assert.Equal(t, "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", series[1].labels["__name__"])
+	assert.Equal(t, float64(1234), series[1].value)
+	assert.Equal(t, now.UnixMilli(), series[1].timestamp)
+}
+
+func TestRemoteWriter_Retry(t *testing.T) {
+	receiver := &remoteWriteReceiver{
+		statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+		received: make(chan struct{}, 10),
+	}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	writer, err := NewRemoteWriter(&Config{RemoteWriteURL: server.URL, RemoteWriteQueueSize: 10, CollectInterval: 1000},
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return testMetricFamilies(), nil }), nil)
+	require.NoError(t, err)
+	writer.sender.minBackoff = time.Millisecond
+
+	successes := testutil.ToFloat64(pushRequests.WithLabelValues("remote_write", "success"))
+
+	stop := make(chan interface{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writer.sender.run(stop)
+	}()
+
+	writer.push()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-receiver.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the remote write")
+		}
+	}
+	// Stopping cancels the request in flight
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(pushRequests.WithLabelValues("remote_write", "success")) == successes+1
+	}, 5*time.Second, time.Millisecond)
+	close(stop)
+	<-done
+
+	receiver.mtx.Lock()
+	defer receiver.mtx.Unlock()
+	require.Len(t, receiver.requests, 1)
+	assert.Len(t, decodeWriteRequest(t, receiver.requests[0]), 2)
+}
+
+func TestRemoteWriter_PushesCollections(t *testing.T) {
+	receiver := &remoteWriteReceiver{received: make(chan struct{}, 10)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	// The collect interval would push many times if the writer ran on its own ticker
+	collections := make(chan struct{})
+	writer, err := NewRemoteWriter(&Config{RemoteWriteURL: server.URL, RemoteWriteQueueSize: 10, CollectInterval: 1},
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return testMetricFamilies(), nil }), collections)
+	require.NoError(t, err)
+
+	stop := make(chan interface{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go writer.Run(stop, &wg)
+
+	for i := 0; i < 2; i++ {
+		collections <- struct{}{}
+		select {
+		case <-receiver.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the remote write")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	receiver.mtx.Lock()
+	defer receiver.mtx.Unlock()
+	assert.Len(t, receiver.requests, 2)
+}
+
+func TestRemoteWriter_Rejected(t *testing.T) {
+	receiver := &remoteWriteReceiver{
+		statuses: []int{http.StatusBadRequest},
+		received: make(chan struct{}, 10),
+	}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	writer, err := NewRemoteWriter(&Config{RemoteWriteURL: server.URL, RemoteWriteQueueSize: 10, CollectInterval: 1000},
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return testMetricFamilies(), nil }), nil)
+	require.NoError(t, err)
+
+	rejected := testutil.ToFloat64(pushDroppedRequests.WithLabelValues("remote_write", "rejected"))
+
+	require.True(t, writer.sender.sendWithRetry(context.Background(), snappy.Encode(nil, []byte("not a request"))))
+
+	assert.Equal(t, rejected+1, testutil.ToFloat64(pushDroppedRequests.WithLabelValues("remote_write", "rejected")))
+}
+
+func TestRemoteWriter_StopCancelsRequest(t *testing.T) {
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server notices that the client went away once the body is read
+		_, _ = io.Copy(io.Discard, r.Body)
+		received <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	writer, err := NewRemoteWriter(&Config{RemoteWriteURL: server.URL, RemoteWriteQueueSize: 10, CollectInterval: 1000},
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return testMetricFamilies(), nil }), nil)
+	require.NoError(t, err)
+
+	stop := make(chan interface{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writer.sender.run(stop)
+	}()
+
+	writer.push()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the remote write")
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stopping didn't cancel the remote write in flight")
+	}
+}
+
+func TestRequestQueue_DropsOldest(t *testing.T) {
+	q := newRequestQueue[[]byte]("test", 2)
+	q.push([]byte("1"))
+	q.push([]byte("2"))
+	q.push([]byte("3"))
+
+	var popped []string
+	for req, ok := q.pop(); ok; req, ok = q.pop() {
+		popped = append(popped, string(req))
+	}
+	assert.Equal(t, []string{"2", "3"}, popped)
+}
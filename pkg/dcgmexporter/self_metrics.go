@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metrics the exporter publishes about itself.
+var (
+	collectionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "dcgm_exporter_collection_duration_seconds",
+		Help: "Duration of the collection of DCGM metrics per entity type.",
+	}, []string{"entity"})
+
+	transformDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "dcgm_exporter_transform_duration_seconds",
+		Help: "Duration of the transformations applied to the collected metrics.",
+	}, []string{"transform"})
+
+	scrapesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dcgm_exporter_scrapes_total",
+		Help: "Total number of scrapes of the metrics endpoint.",
+	})
+
+	scrapeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "dcgm_exporter_scrape_duration_seconds",
+		Help: "Duration of the scrapes of the metrics endpoint.",
+	})
+
+	seriesCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dcgm_exporter_series",
+		Help: "Number of series emitted per counter by the last collection.",
+	}, []string{"counter"})
+
+	pipelineChannelDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dcgm_exporter_pipeline_channel_drops_total",
+		Help: "Total number of collections dropped because the metrics channel was full.",
+	})
+
+	podResourcesErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dcgm_exporter_pod_resources_errors_total",
+		Help: "Total number of failed calls to the kubelet pod-resources API.",
+	}, []string{"operation"})
+
+	podResourcesDeviceAssigned = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dcgm_exporter_pod_resources_device_assigned",
+		Help: "Whether a GPU or MIG device allocatable by the kubelet is assigned to a pod (1) or not (0).",
+	}, []string{"resource", "device"})
+
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dcgm_exporter_config_reload_success",
+		Help: "Whether the last reload of the counters succeeded (1) or failed (0).",
+	})
+
+	pushRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dcgm_exporter_push_requests_total",
+		Help: "Total number of requests pushed to a sink, by result.",
+	}, []string{"sink", "result"})
+
+	pushDroppedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dcgm_exporter_push_dropped_requests_total",
+		Help: "Total number of requests to a sink dropped, because the queue was full or the request was rejected.",
+	}, []string{"sink", "reason"})
+
+	pushQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dcgm_exporter_push_queue_length",
+		Help: "Number of requests waiting to be pushed to a sink.",
+	}, []string{"sink"})
+
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dcgm_exporter_build_info",
+		Help: "A metric with a constant '1' value labeled by the version of the exporter and the Go version.",
+	}, []string{"version", "goversion"})
+)
+
+var selfMetrics = []prometheus.Collector{
+	collectionDuration,
+	transformDuration,
+	scrapesTotal,
+	scrapeDuration,
+	seriesCount,
+	pipelineChannelDrops,
+	podResourcesErrors,
+	podResourcesDeviceAssigned,
+	configReloadSuccess,
+	pushRequests,
+	pushDroppedRequests,
+	pushQueueLength,
+	buildInfo,
+}
+
+// selfMetricsRegistry exposes the self metrics next to the cached DCGM metrics.
+var selfMetricsRegistry = newSelfMetricsRegistry()
+
+func newSelfMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(selfMetrics...)
+	return reg
+}
+
+// SetBuildVersion sets the version exposed by the dcgm_exporter_build_info metric.
+func SetBuildVersion(version string) {
+	buildInfo.Reset()
+	buildInfo.WithLabelValues(version, runtime.Version()).Set(1)
+}
+
+// updateSeriesCount records the number of series of every counter in the metric families.
+func updateSeriesCount(families []*dto.MetricFamily) {
+	seriesCount.Reset()
+	for _, mf := range families {
+		seriesCount.WithLabelValues(mf.GetName()).Set(float64(len(mf.Metric)))
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateSeriesCount(t *testing.T) {
+	updateSeriesCount(testMetricFamilies())
+
+	assert.Equal(t, 2, testutil.CollectAndCount(seriesCount))
+	assert.Equal(t, 1.0, testutil.ToFloat64(seriesCount.WithLabelValues("DCGM_FI_DEV_POWER_USAGE")))
+
+	// Counters that are no longer emitted are removed
+	updateSeriesCount(testMetricFamilies()[:1])
+	assert.Equal(t, 1, testutil.CollectAndCount(seriesCount))
+}
+
+func TestMetricsServer_Metrics_SelfMetrics(t *testing.T) {
+	SetBuildVersion("1.2.3")
+
+	s := &MetricsServer{
+		metrics:  testMetricFamilies(),
+		registry: NewRegistry(),
+	}
+
+	scrapes := testutil.ToFloat64(scrapesTotal)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	s.Metrics(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, scrapes+1, testutil.ToFloat64(scrapesTotal))
+
+	var parser expfmt.TextParser
+	mf, err := parser.TextToMetricFamilies(rec.Body)
+	require.NoError(t, err)
+	require.Contains(t, mf, "DCGM_FI_DEV_POWER_USAGE")
+	require.Contains(t, mf, "dcgm_exporter_build_info")
+
+	labels := map[string]string{}
+	for _, l := range mf["dcgm_exporter_build_info"].Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	assert.Equal(t, map[string]string{"version": "1.2.3", "goversion": runtime.Version()}, labels)
+}
@@ -19,17 +19,32 @@ package dcgmexporter
 import (
 	"context"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/exporter-toolkit/web"
 	"github.com/sirupsen/logrus"
 
 	"github.com/NVIDIA/dcgm-exporter/internal/pkg/logging"
 )
 
-func NewMetricsServer(c *Config, metrics chan string, registry *Registry) (*MetricsServer, func(), error) {
+func NewMetricsServer(c *Config, metrics chan []*dto.MetricFamily, registry *Registry) (*MetricsServer, func(), error) {
+	return newMetricsServer(c, metrics, registry, nil)
+}
+
+// NewNativeMetricsServer creates a MetricsServer that serves the metrics collected from the gatherer on every scrape.
+func NewNativeMetricsServer(c *Config, gatherer prometheus.Gatherer) (*MetricsServer, func(), error) {
+	return newMetricsServer(c, nil, nil, gatherer)
+}
+
+func newMetricsServer(c *Config, metrics chan []*dto.MetricFamily, registry *Registry,
+	gatherer prometheus.Gatherer,
+) (*MetricsServer, func(), error) {
 	router := mux.NewRouter()
 	serverv1 := &MetricsServer{
 		server: &http.Server{
@@ -43,9 +58,16 @@ func NewMetricsServer(c *Config, metrics chan string, registry *Registry) (*Metr
 			WebSystemdSocket:   &c.WebSystemdSocket,
 			WebConfigFile:      &c.WebConfigFile,
 		},
+		router:      router,
 		metricsChan: metrics,
-		metrics:     "",
 		registry:    registry,
+		gatherer:    gatherer,
+		openMetrics: c.EnableOpenMetrics,
+		// In the native mode the metrics are collected on scrapes, there is no collection until the first one
+		collected: gatherer != nil,
+	}
+	if gatherer == nil {
+		serverv1.collections = make(chan struct{}, 1)
 	}
 
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -66,7 +88,23 @@ func NewMetricsServer(c *Config, metrics chan string, registry *Registry) (*Metr
 	})
 
 	router.HandleFunc("/health", serverv1.Health)
-	router.HandleFunc("/metrics", serverv1.Metrics)
+	// The remote hostengines of the multi-target mode aren't described
+	if len(c.RemoteHETargets) == 0 && !c.Probe {
+		topology := newTopologyCache(c)
+		router.HandleFunc("/topology", func(w http.ResponseWriter, r *http.Request) {
+			t, err := topology.get()
+			if err != nil {
+				logrus.WithError(err).Error("Failed to discover the topology.")
+				writeAPIError(w, http.StatusServiceUnavailable, "failed to discover the topology")
+				return
+			}
+			serveTopology(w, r, t)
+		})
+	}
+	// The metrics can be pushed to a sink instead of being scraped
+	if !c.DisablePrometheusEndpoint {
+		router.HandleFunc("/metrics", serverv1.Metrics)
+	}
 
 	return serverv1, func() {}, nil
 }
@@ -110,29 +148,75 @@ func (s *MetricsServer) Run(stop chan interface{}, wg *sync.WaitGroup) {
 }
 
 func (s *MetricsServer) Metrics(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	defer func() {
+		scrapesTotal.Inc()
+		scrapeDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	families, err := s.Gather()
+	if s.gatherer != nil {
+		s.setCollected(collectorsUp(families))
+	}
+	if err != nil {
+		// The metrics of the collectors that succeeded are still served, when there are some
+		logrus.WithError(err).Error("Failed to collect metrics.")
+		if families == nil {
+			http.Error(w, "failed to collect metrics", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	format := s.negotiateFormat(r.Header)
+
+	w.Header().Set("Content-Type", string(format))
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(http.StatusOK)
-	_, err := w.Write([]byte(s.getMetrics()))
+	err = encodeMetricFamilies(w, format, families)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to write response.")
-		http.Error(w, "failed to write response", http.StatusInternalServerError)
 		return
 	}
+}
+
+// negotiateFormat returns the format preferred by the scraper: Prometheus text, protobuf, or OpenMetrics text
+// when enabled. OpenMetrics is opt-in, because it renames the counters and the metrics with a unit.
+func (s *MetricsServer) negotiateFormat(h http.Header) expfmt.Format {
+	if s.openMetrics {
+		return expfmt.NegotiateIncludingOpenMetrics(h)
+	}
+	return expfmt.Negotiate(h)
+}
+
+// Gather returns the metrics to serve: collected from the gatherer in the native mode, otherwise
+// the cached DCGM metrics followed by the metrics of the registry and the self metrics. In the native mode,
+// the metrics of the collectors that succeeded are returned along with the error of the others.
+func (s *MetricsServer) Gather() ([]*dto.MetricFamily, error) {
+	if s.gatherer != nil {
+		// The metrics of the collectors that succeeded are returned along with the error
+		return s.gatherer.Gather()
+	}
+
 	metrics, err := s.registry.Gather()
 	if err != nil {
-		logrus.WithError(err).Error("Failed to write response.")
-		http.Error(w, "failed to write response", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	err = encodeExpMetrics(w, metrics)
+
+	expFamilies := newMetricFamilyBuilder()
+	expFamilies.add(metrics, exporterMetricLabels)
+
+	selfFamilies, err := selfMetricsRegistry.Gather()
 	if err != nil {
-		http.Error(w, "failed to write response", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+
+	return slices.Concat(s.getMetrics(), expFamilies.build(), selfFamilies), nil
 }
 
+// Health responds OK when the last collection collected the metrics of an entity type, as reported by
+// dcgm_exporter_collector_up. In the native mode, the last collection is the one of the last scrape.
 func (s *MetricsServer) Health(w http.ResponseWriter, r *http.Request) {
-	if s.getMetrics() == "" {
+	if !s.isCollected() {
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.WriteHeader(http.StatusServiceUnavailable)
 		_, err := w.Write([]byte("KO"))
@@ -151,14 +235,41 @@ func (s *MetricsServer) Health(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *MetricsServer) updateMetrics(m string) {
+func (s *MetricsServer) updateMetrics(m []*dto.MetricFamily) {
 	s.Lock()
 	defer s.Unlock()
 
 	s.metrics = m
+	s.collected = collectorsUp(m)
+
+	// The collection is dropped when the previous one wasn't received yet, the metrics are replaced anyway
+	select {
+	case s.collections <- struct{}{}:
+	default:
+	}
+}
+
+// Collections returns a channel that receives a value after each collection, or nil in the native mode,
+// where the metrics are collected on every Gather.
+func (s *MetricsServer) Collections() <-chan struct{} {
+	return s.collections
+}
+
+func (s *MetricsServer) setCollected(collected bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.collected = collected
+}
+
+func (s *MetricsServer) isCollected() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.collected
 }
 
-func (s *MetricsServer) getMetrics() string {
+func (s *MetricsServer) getMetrics() []*dto.MetricFamily {
 	s.Lock()
 	defer s.Unlock()
 
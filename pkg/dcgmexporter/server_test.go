@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMetricFamilies() []*dto.MetricFamily {
+	powerCounter := Counter{
+		FieldID:   155,
+		FieldName: "DCGM_FI_DEV_POWER_USAGE",
+		PromType:  "gauge",
+		Help:      "Power draw (in W).",
+		Unit:      "watts",
+	}
+	energyCounter := Counter{
+		FieldID:   156,
+		FieldName: "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION",
+		PromType:  "counter",
+		Help:      "Total energy consumption since boot (in mJ).",
+	}
+
+	builder := newMetricFamilyBuilder()
+	builder.add(MetricsByCounter{
+		powerCounter: {
+			{Counter: powerCounter, Value: "42", GPU: "0", UUID: "UUID", GPUUUID: "GPU-0"},
+		},
+		energyCounter: {
+			{Counter: energyCounter, Value: "1234", GPU: "0", UUID: "UUID", GPUUUID: "GPU-0"},
+		},
+	}, gpuMetricLabels)
+
+	return builder.build()
+}
+
+// testCollectorUpFamilies returns the dcgm_exporter_collector_up family of a collection of the GPUs.
+func testCollectorUpFamilies(up string) []*dto.MetricFamily {
+	builder := newMetricFamilyBuilder()
+	builder.add(MetricsByCounter{
+		collectorUpCounter: {{Counter: collectorUpCounter, Value: up, Attributes: map[string]string{"entity": "gpu"}}},
+	}, noIdentityLabels)
+
+	return builder.build()
+}
+
+func TestMetricsServer_Health(t *testing.T) {
+	s, _, err := NewMetricsServer(&Config{}, nil, NewRegistry())
+	require.NoError(t, err)
+
+	health := func() int {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, health(), "nothing was collected yet")
+
+	// The collector_up family is always there, even when all the collectors fail
+	s.updateMetrics(testCollectorUpFamilies("0"))
+	assert.Equal(t, http.StatusServiceUnavailable, health())
+
+	s.updateMetrics(slices.Concat(testMetricFamilies(), testCollectorUpFamilies("1")))
+	assert.Equal(t, http.StatusOK, health())
+}
+
+func TestMetricsServer_Metrics_OpenMetricsDisabled(t *testing.T) {
+	s := &MetricsServer{
+		metrics:  testMetricFamilies(),
+		registry: NewRegistry(),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	rec := httptest.NewRecorder()
+	s.Metrics(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, expfmt.TypeTextPlain, expfmt.Format(rec.Header().Get("Content-Type")).FormatType())
+	// The names of the metrics are kept
+	assert.Contains(t, rec.Body.String(), "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION{")
+	assert.Contains(t, rec.Body.String(), "DCGM_FI_DEV_POWER_USAGE{")
+}
+
+func TestMetricsServer_Metrics_ContentNegotiation(t *testing.T) {
+	s := &MetricsServer{
+		metrics:     testMetricFamilies(),
+		registry:    NewRegistry(),
+		openMetrics: true,
+	}
+
+	tests := []struct {
+		name       string
+		accept     string
+		formatType expfmt.FormatType
+		assert     func(t *testing.T, body io.Reader)
+	}{
+		{
+			name:       "Prometheus text by default",
+			accept:     "",
+			formatType: expfmt.TypeTextPlain,
+			assert: func(t *testing.T, body io.Reader) {
+				var parser expfmt.TextParser
+				mf, err := parser.TextToMetricFamilies(body)
+				require.NoError(t, err)
+				require.Contains(t, mf, "DCGM_FI_DEV_POWER_USAGE")
+				require.Contains(t, mf, "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION")
+			},
+		},
+		{
+			name:       "OpenMetrics text",
+			accept:     "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5",
+			formatType: expfmt.TypeOpenMetrics,
+			assert: func(t *testing.T, body io.Reader) {
+				b, err := io.ReadAll(body)
+				require.NoError(t, err)
+				out := string(b)
+				assert.Contains(t, out, "# TYPE DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION counter\n")
+				assert.Contains(t, out, "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION_total{")
+				assert.Contains(t, out, "# UNIT DCGM_FI_DEV_POWER_USAGE_watts watts\n")
+				assert.Contains(t, out, "DCGM_FI_DEV_POWER_USAGE_watts{")
+				assert.Regexp(t, "# EOF\n$", out)
+			},
+		},
+		{
+			name:       "Protobuf",
+			accept:     "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited",
+			formatType: expfmt.TypeProtoDelim,
+			assert: func(t *testing.T, body io.Reader) {
+				dec := expfmt.NewDecoder(body, expfmt.NewFormat(expfmt.TypeProtoDelim))
+				var names []string
+				for {
+					var mf dto.MetricFamily
+					err := dec.Decode(&mf)
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					require.NoError(t, err)
+					names = append(names, mf.GetName())
+				}
+				require.GreaterOrEqual(t, len(names), 2)
+				assert.Equal(t, []string{"DCGM_FI_DEV_POWER_USAGE", "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION"}, names[:2])
+				assert.Contains(t, names, "dcgm_exporter_scrapes_total")
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+
+			s.Metrics(rec, req)
+
+			require.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tc.formatType, expfmt.Format(rec.Header().Get("Content-Type")).FormatType())
+			tc.assert(t, rec.Body)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// sharedPodsCollector exposes the pods sharing a GPU, through time-slicing or MPS, as an info metric with a
+// constant '1' value, one per GPU and pod. The metrics of the shared GPUs are emitted without pod with the
+// SharedGPUsInfo mode.
+type sharedPodsCollector struct {
+	counter   Counter
+	hostname  string
+	config    *Config
+	sysInfo   SystemInfo
+	podMapper *PodMapper
+}
+
+func NewSharedPodsCollector(
+	counters []Counter, hostname string, config *Config, fieldEntityGroupTypeSystemInfo FieldEntityGroupTypeSystemInfoItem,
+) (Collector, error) {
+	if !IsDCGMExpGPUSharedPodsEnabled(counters) {
+		return nil, fmt.Errorf("%s collector is disabled", dcgmExpGPUSharedPods)
+	}
+	if !config.Kubernetes {
+		return nil, fmt.Errorf("%s collector requires the Kubernetes mode", dcgmExpGPUSharedPods)
+	}
+
+	podMapper, err := NewPodMapper(config)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := slices.IndexFunc(counters, func(c Counter) bool {
+		return c.FieldName == dcgmExpGPUSharedPods
+	})
+
+	return &sharedPodsCollector{
+		counter:   counters[idx],
+		hostname:  hostname,
+		config:    config,
+		sysInfo:   fieldEntityGroupTypeSystemInfo.SystemInfo,
+		podMapper: podMapper,
+	}, nil
+}
+
+// IsDCGMExpGPUSharedPodsEnabled returns whether the shared pods metric is enabled.
+func IsDCGMExpGPUSharedPodsEnabled(counters []Counter) bool {
+	return slices.ContainsFunc(counters, func(c Counter) bool {
+		return c.FieldName == dcgmExpGPUSharedPods
+	})
+}
+
+// GetMetrics returns the pods of the GPUs allocated to more than one pod.
+func (c *sharedPodsCollector) GetMetrics() (MetricsByCounter, error) {
+	pods, migDevices := c.podMapper.podResources.get()
+	deviceToPods := c.podMapper.toDeviceToPod(pods, migDevices, c.sysInfo)
+
+	uuid := "UUID"
+	if c.config.UseOldNamespace {
+		uuid = "uuid"
+	}
+
+	metrics := MetricsByCounter{}
+	for _, mi := range GetMonitoredEntities(c.sysInfo) {
+		m := Metric{
+			Counter:      c.counter,
+			Value:        "1",
+			UUID:         uuid,
+			GPU:          fmt.Sprint(mi.DeviceInfo.GPU),
+			GPUUUID:      mi.DeviceInfo.UUID,
+			GPUDevice:    fmt.Sprintf("nvidia%d", mi.DeviceInfo.GPU),
+			GPUModelName: getGPUModel(mi.DeviceInfo, c.config.ReplaceBlanksInModelName),
+			GPUPCIBusID:  mi.DeviceInfo.PCI.BusID,
+			Hostname:     c.hostname,
+		}
+		if mi.InstanceInfo != nil {
+			m.MigProfile = mi.InstanceInfo.ProfileName
+			m.GPUInstanceID = fmt.Sprint(mi.InstanceInfo.Info.NvmlInstanceId)
+		}
+
+		deviceID, err := m.getIDOfType(c.config.KubernetesGPUIdType)
+		if err != nil {
+			return nil, err
+		}
+
+		podInfos := deviceToPods[deviceID]
+		if len(podInfos) < 2 {
+			continue
+		}
+		for _, podInfo := range podInfos {
+			podMetric := m
+			podMetric.Attributes = map[string]string{}
+			c.podMapper.setPodAttributes(podMetric.Attributes, podInfo)
+			metrics[c.counter] = append(metrics[c.counter], podMetric)
+		}
+	}
+
+	return metrics, nil
+}
+
+func (c *sharedPodsCollector) Cleanup() {}
+
+// Describe sends no descriptors, which makes the collector an unchecked collector.
+func (c *sharedPodsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect collects the pods sharing the GPUs.
+func (c *sharedPodsCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics, err := c.GetMetrics()
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to collect the %s metric", dcgmExpGPUSharedPods)
+		return
+	}
+	collectMetrics(ch, metrics, gpuMetricLabels)
+}
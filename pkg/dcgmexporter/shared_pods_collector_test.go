@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"testing"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedPodsCollector_GetMetrics(t *testing.T) {
+	podResources := testPodResources(t, "GPU-1::0", "GPU-1::1", "GPU-2")
+
+	counter := Counter{FieldName: dcgmExpGPUSharedPods, PromType: "gauge"}
+	config := &Config{Kubernetes: true, KubernetesGPUIdType: GPUUID, KubernetesSharedGPUs: SharedGPUsInfo}
+	sysInfo := SystemInfo{
+		GPUCount: 2,
+		gOpt:     DeviceOptions{MajorRange: []int{-1}},
+	}
+	sysInfo.GPUs[0].DeviceInfo = dcgm.Device{GPU: 0, UUID: "GPU-1"}
+	sysInfo.GPUs[1].DeviceInfo = dcgm.Device{GPU: 1, UUID: "GPU-2"}
+
+	c := &sharedPodsCollector{
+		counter:   counter,
+		hostname:  "testhost",
+		config:    config,
+		sysInfo:   sysInfo,
+		podMapper: &PodMapper{Config: config, podResources: podResources},
+	}
+
+	metrics, err := c.GetMetrics()
+	require.NoError(t, err)
+	require.Len(t, metrics[counter], 2, "only the shared GPU is exported, once per pod")
+	for i, metric := range metrics[counter] {
+		assert.Equal(t, "1", metric.Value)
+		assert.Equal(t, "0", metric.GPU)
+		assert.Equal(t, "GPU-1", metric.GPUUUID)
+		assert.Equal(t, "nvidia0", metric.GPUDevice)
+		assert.Equal(t, "testhost", metric.Hostname)
+		assert.Equal(t, map[string]string{
+			podAttribute:       []string{"gpu-pod-0", "gpu-pod-1"}[i],
+			namespaceAttribute: "default",
+			containerAttribute: "default",
+		}, metric.Attributes)
+	}
+}
+
+func TestNewSharedPodsCollector(t *testing.T) {
+	counters := []Counter{{FieldName: dcgmExpGPUSharedPods, PromType: "gauge"}}
+
+	_, err := NewSharedPodsCollector(nil, "", &Config{Kubernetes: true}, FieldEntityGroupTypeSystemInfoItem{})
+	assert.Error(t, err, "the counter is disabled")
+
+	_, err = NewSharedPodsCollector(counters, "", &Config{}, FieldEntityGroupTypeSystemInfoItem{})
+	assert.Error(t, err, "the Kubernetes mode is disabled")
+}
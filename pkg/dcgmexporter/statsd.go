@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Sizes of the datagrams, small enough to avoid the IP fragmentation of UDP packets
+	statsdUDPPacketSize  = 1432
+	statsdUnixPacketSize = 8192
+
+	statsdWriteTimeout = 100 * time.Millisecond
+
+	// Number of datagrams waiting to be written, beyond which the oldest ones are dropped
+	statsdQueueSize = 1024
+)
+
+// statsdTagReplacer replaces the characters that delimit the tags of the DogStatsD format.
+var statsdTagReplacer = strings.NewReplacer(",", "_", "|", "_", "\n", "_")
+
+// StatsDSink writes the metrics collected by the pipeline as DogStatsD gauges and counts, over UDP or
+// a unix datagram socket. The labels and attributes of the metrics are written as tags. The datagrams are
+// queued, and written in the background by Run, so that a slow agent doesn't delay the collection.
+type StatsDSink struct {
+	network    string
+	address    string
+	packetSize int
+	conn       net.Conn
+	queue      *requestQueue[[]byte]
+
+	// Last values of the counters per series, to write the increments since the previous collection
+	counters map[string]float64
+}
+
+// NewStatsDSink creates a StatsDSink writing to the address, either host:port, udp://host:port
+// or unixgram:///path/to/socket.
+func NewStatsDSink(address string) (*StatsDSink, error) {
+	s := &StatsDSink{
+		network:    "udp",
+		address:    address,
+		packetSize: statsdUDPPacketSize,
+		queue:      newRequestQueue[[]byte]("statsd", statsdQueueSize),
+		counters:   map[string]float64{},
+	}
+
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid StatsD address '%s'; err: %w", address, err)
+		}
+		switch u.Scheme {
+		case "udp":
+			s.address = u.Host
+		case "unixgram":
+			s.network, s.address, s.packetSize = "unixgram", u.Path, statsdUnixPacketSize
+		default:
+			return nil, fmt.Errorf("invalid StatsD address '%s'; expected a udp or unixgram URL", address)
+		}
+	}
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *StatsDSink) connect() error {
+	conn, err := net.Dial(s.network, s.address)
+	if err != nil {
+		return fmt.Errorf("could not connect to StatsD at '%s'; err: %w", s.address, err)
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *StatsDSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// Run writes the queued datagrams until stop is closed, and closes the socket.
+func (s *StatsDSink) Run(stop chan interface{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer func() {
+		_ = s.Close()
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.queue.ready:
+		}
+
+		for packet, ok := s.queue.pop(); ok; packet, ok = s.queue.pop() {
+			s.writePacket(packet)
+		}
+	}
+}
+
+// Write queues the metrics in datagrams of at most packetSize bytes. When the queue is full, the oldest
+// datagrams are dropped.
+func (s *StatsDSink) Write(metrics []EntityMetrics) {
+	var packet bytes.Buffer
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		s.queue.push(bytes.Clone(bytes.TrimSuffix(packet.Bytes(), []byte("\n"))))
+		packet.Reset()
+	}
+
+	for _, line := range s.lines(metrics) {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > s.packetSize {
+			flush()
+		}
+		packet.WriteString(line)
+		packet.WriteByte('\n')
+	}
+	flush()
+}
+
+// writePacket writes a datagram. Datagrams that can't be written are dropped, and the socket is reconnected
+// for the next one.
+func (s *StatsDSink) writePacket(packet []byte) {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			pushRequests.WithLabelValues("statsd", "failure").Inc()
+			logrus.WithError(err).Debug("Failed to write the metrics to StatsD")
+			return
+		}
+	}
+
+	// The unix datagram sockets block when the agent doesn't keep up
+	_ = s.conn.SetWriteDeadline(time.Now().Add(statsdWriteTimeout))
+	if _, err := s.conn.Write(packet); err != nil {
+		pushRequests.WithLabelValues("statsd", "failure").Inc()
+		logrus.WithError(err).Debug("Failed to write the metrics to StatsD")
+
+		// The agent may have restarted, which invalidates the unix socket
+		_ = s.conn.Close()
+		s.conn = nil
+		return
+	}
+	pushRequests.WithLabelValues("statsd", "success").Inc()
+}
+
+// lines returns the DogStatsD lines of the metrics. Counters are written as the increments since the previous
+// collection; their first value, and distributions, aren't written.
+func (s *StatsDSink) lines(metrics []EntityMetrics) []string {
+	var res []string
+	counters := map[string]float64{}
+
+	for _, em := range metrics {
+		for counter, values := range em.Metrics {
+			if counter.PromType == "label" || counter.isDistribution() {
+				continue
+			}
+
+			staticLabels := counter.StaticLabels()
+			for _, m := range values {
+				value, err := strconv.ParseFloat(m.Value, 64)
+				if err != nil {
+					continue
+				}
+				if counter.Scale != 0 {
+					value *= counter.Scale
+				}
+
+				tags := statsdTags(metricLabelPairs(m, staticLabels, em.identity))
+				metricType := "g"
+				if counter.PromType == "counter" {
+					series := counter.Name() + "|" + tags
+					previous, seen := s.counters[series]
+					counters[series] = value
+					if !seen {
+						continue
+					}
+					// A counter reset restarts from zero
+					if value >= previous {
+						value -= previous
+					}
+					metricType = "c"
+				}
+
+				line := counter.Name() + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + metricType
+				if tags != "" {
+					line += "|#" + tags
+				}
+				res = append(res, line)
+			}
+		}
+	}
+
+	// The series that disappeared are forgotten
+	s.counters = counters
+	return res
+}
+
+func statsdTags(labels []*dto.LabelPair) string {
+	var tags []string
+	for _, l := range labels {
+		if l.GetValue() == "" {
+			continue
+		}
+		tags = append(tags, statsdTagReplacer.Replace(l.GetName()+":"+l.GetValue()))
+	}
+	return strings.Join(tags, ",")
+}
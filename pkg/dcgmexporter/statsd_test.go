@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readStatsDLines reads the lines of the next datagrams received by conn, until it receives no more.
+func readStatsDLines(t *testing.T, conn net.PacketConn) []string {
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// runStatsDSink runs the sink until the returned function is called.
+func runStatsDSink(sink *StatsDSink) func() {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	stop := make(chan interface{})
+	go sink.Run(stop, &wg)
+
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestStatsDSink_Write(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	sink, err := NewStatsDSink("udp://" + listener.LocalAddr().String())
+	require.NoError(t, err)
+	defer runStatsDSink(sink)()
+
+	power := Counter{FieldID: 155, FieldName: "DCGM_FI_DEV_POWER_USAGE", PromType: "gauge"}
+	energy := Counter{FieldID: 156, FieldName: "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION", PromType: "counter"}
+	entityMetrics := func(energyValue string) []EntityMetrics {
+		return []EntityMetrics{{
+			Entity: "gpu",
+			Metrics: MetricsByCounter{
+				power: {{
+					Counter: power, Value: "42.5", GPU: "0", UUID: "UUID", GPUUUID: "GPU-0",
+					Attributes: map[string]string{"pod": "trainer", "namespace": "ml,prod"},
+				}},
+				energy: {{Counter: energy, Value: energyValue, GPU: "0", UUID: "UUID", GPUUUID: "GPU-0"}},
+			},
+			identity: gpuMetricLabels,
+		}}
+	}
+
+	// The first value of a counter is only recorded
+	sink.Write(entityMetrics("1000"))
+	assert.Equal(t, []string{
+		"DCGM_FI_DEV_POWER_USAGE:42.5|g|#UUID:GPU-0,gpu:0,namespace:ml_prod,pod:trainer",
+	}, readStatsDLines(t, listener))
+
+	sink.Write(entityMetrics("1250"))
+	assert.Equal(t, []string{
+		"DCGM_FI_DEV_POWER_USAGE:42.5|g|#UUID:GPU-0,gpu:0,namespace:ml_prod,pod:trainer",
+		"DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION:250|c|#UUID:GPU-0,gpu:0",
+	}, readStatsDLines(t, listener))
+
+	// A counter reset counts from zero
+	sink.Write(entityMetrics("100"))
+	assert.Contains(t, readStatsDLines(t, listener), "DCGM_FI_DEV_TOTAL_ENERGY_CONSUMPTION:100|c|#UUID:GPU-0,gpu:0")
+}
+
+func TestStatsDSink_WriteExporterMetrics(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	sink, err := NewStatsDSink("udp://" + listener.LocalAddr().String())
+	require.NoError(t, err)
+	defer runStatsDSink(sink)()
+
+	xidCounter := Counter{FieldName: "DCGM_EXP_XID_ERRORS_COUNT", PromType: "gauge"}
+	sink.Write([]EntityMetrics{{
+		Entity: "exporter",
+		Metrics: MetricsByCounter{xidCounter: {{
+			Counter: xidCounter, Value: "2", GPU: "0", UUID: "UUID", GPUUUID: "GPU-0",
+			Attributes: map[string]string{"xid_error": "43"},
+		}}},
+		identity: exporterMetricLabels,
+	}})
+	assert.Equal(t, []string{
+		"DCGM_EXP_XID_ERRORS_COUNT:2|g|#UUID:GPU-0,gpu:0,xid_error:43",
+	}, readStatsDLines(t, listener))
+}
+
+func TestStatsDSink_PacketSize(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	sink, err := NewStatsDSink(listener.LocalAddr().String())
+	require.NoError(t, err)
+	defer runStatsDSink(sink)()
+	sink.packetSize = 100
+
+	temp := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	var values []Metric
+	for _, gpu := range []string{"0", "1", "2", "3"} {
+		values = append(values, Metric{Counter: temp, Value: "50", GPU: gpu, UUID: "UUID", GPUUUID: "GPU-" + gpu})
+	}
+	sink.Write([]EntityMetrics{{Entity: "gpu", Metrics: MetricsByCounter{temp: values}, identity: gpuMetricLabels}})
+
+	var packets []string
+	buf := make([]byte, 65536)
+	for {
+		require.NoError(t, listener.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		assert.LessOrEqual(t, n, 100)
+		packets = append(packets, string(buf[:n]))
+	}
+	assert.Len(t, packets, 2)
+	assert.Len(t, strings.Split(strings.Join(packets, "\n"), "\n"), 4)
+}
+
+func TestStatsDSink_QueueFull(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// Without Run, the datagrams stay queued
+	sink, err := NewStatsDSink(listener.LocalAddr().String())
+	require.NoError(t, err)
+	defer sink.Close()
+	sink.packetSize = 40
+	sink.queue = newRequestQueue[[]byte]("statsd", 1)
+
+	dropped := testutil.ToFloat64(pushDroppedRequests.WithLabelValues("statsd", "queue_full"))
+
+	temp := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	values := []Metric{
+		{Counter: temp, Value: "50", GPU: "0", UUID: "UUID", GPUUUID: "GPU-0"},
+		{Counter: temp, Value: "60", GPU: "1", UUID: "UUID", GPUUUID: "GPU-1"},
+	}
+	sink.Write([]EntityMetrics{{Entity: "gpu", Metrics: MetricsByCounter{temp: values}, identity: gpuMetricLabels}})
+
+	assert.Equal(t, dropped+1, testutil.ToFloat64(pushDroppedRequests.WithLabelValues("statsd", "queue_full")))
+	packet, ok := sink.queue.pop()
+	require.True(t, ok)
+	assert.Equal(t, "DCGM_FI_DEV_GPU_TEMP:60|g|#UUID:GPU-1,gpu:1", string(packet))
+}
+
+func TestNewStatsDSink_InvalidAddress(t *testing.T) {
+	_, err := NewStatsDSink("tcp://localhost:8125")
+	assert.ErrorContains(t, err, "invalid StatsD address")
+}
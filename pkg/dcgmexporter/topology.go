@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/sirupsen/logrus"
+)
+
+// Topology is the hierarchy of the entities discovered by DCGM: the GPUs with their MIG GPU instances and
+// compute instances, the NvSwitches with their NvLinks, and the CPUs with their cores.
+type Topology struct {
+	GPUs     []TopologyGPU    `json:"gpus"`
+	Switches []TopologySwitch `json:"nvswitches"`
+	CPUs     []TopologyCPU    `json:"cpus"`
+}
+
+type TopologyGPU struct {
+	GPU          uint                  `json:"gpu"`
+	UUID         string                `json:"uuid"`
+	PCIBusID     string                `json:"pciBusId"`
+	Device       string                `json:"device"`
+	ModelName    string                `json:"modelName"`
+	MigEnabled   bool                  `json:"migEnabled"`
+	GPUInstances []TopologyGPUInstance `json:"gpuInstances"`
+}
+
+type TopologyGPUInstance struct {
+	ID               uint                      `json:"id"`
+	EntityID         uint                      `json:"entityId"`
+	Profile          string                    `json:"profile"`
+	ComputeInstances []TopologyComputeInstance `json:"computeInstances"`
+}
+
+type TopologyComputeInstance struct {
+	ID       uint   `json:"id"`
+	EntityID uint   `json:"entityId"`
+	Profile  string `json:"profile"`
+}
+
+type TopologySwitch struct {
+	Switch  uint             `json:"nvswitch"`
+	NvLinks []TopologyNvLink `json:"nvlinks"`
+}
+
+type TopologyNvLink struct {
+	Link  uint   `json:"nvlink"`
+	State string `json:"state"`
+}
+
+type TopologyCPU struct {
+	CPU   uint   `json:"cpu"`
+	Cores []uint `json:"cores"`
+}
+
+var linkStateNames = map[dcgm.Link_State]string{
+	dcgm.LS_NOT_SUPPORTED: "not_supported",
+	dcgm.LS_DISABLED:      "disabled",
+	dcgm.LS_DOWN:          "down",
+	dcgm.LS_UP:            "up",
+}
+
+// DiscoverTopology discovers the entities of every type, within the devices of the config.
+// The NvSwitches and CPUs that aren't present are left empty. It fails when the GPUs can't be discovered, or
+// when the hostengine is unreachable.
+func DiscoverTopology(c *Config) (Topology, error) {
+	var errs []error
+	discover := func(entityType dcgm.Field_Entity_Group) *SystemInfo {
+		sysInfo, err := GetSystemInfo(c, entityType)
+		if err != nil {
+			if entityType == dcgm.FE_GPU || isConnectionError(err) {
+				errs = append(errs, fmt.Errorf("failed to discover the %s entities; err: %w", entityType.String(), err))
+			} else {
+				logrus.Debugf("No %s entities discovered; err: %v", entityType.String(), err)
+			}
+			return nil
+		}
+		return sysInfo
+	}
+
+	topology := NewTopology(discover(dcgm.FE_GPU), discover(dcgm.FE_SWITCH), discover(dcgm.FE_CPU))
+	if err := errors.Join(errs...); err != nil {
+		return Topology{}, err
+	}
+
+	return topology, nil
+}
+
+// topologyCache discovers the topology served by /topology at most once per interval, so that requests don't
+// call DCGM more often than the collections, while MIG reconfigurations are still reflected.
+type topologyCache struct {
+	config   *Config
+	interval time.Duration
+	discover func(c *Config) (Topology, error)
+
+	mtx        sync.Mutex
+	topology   Topology
+	discovered time.Time // Zero until the first successful discovery
+}
+
+func newTopologyCache(c *Config) *topologyCache {
+	return &topologyCache{
+		config:   c,
+		interval: time.Duration(c.CollectInterval) * time.Millisecond,
+		discover: DiscoverTopology,
+	}
+}
+
+// get returns the cached topology, discovered again when older than the interval.
+func (t *topologyCache) get() (Topology, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if !t.discovered.IsZero() && time.Since(t.discovered) < t.interval {
+		return t.topology, nil
+	}
+
+	var topology Topology
+	err := WithDCGMConnection(func() error {
+		var err error
+		topology, err = t.discover(t.config)
+		return err
+	})
+	if err != nil {
+		return Topology{}, err
+	}
+
+	t.topology, t.discovered = topology, time.Now()
+	return topology, nil
+}
+
+// NewTopology returns the topology of the GPU, NvSwitch and CPU system info, any of which can be nil.
+func NewTopology(gpus, switches, cpus *SystemInfo) Topology {
+	t := Topology{
+		GPUs:     []TopologyGPU{},
+		Switches: []TopologySwitch{},
+		CPUs:     []TopologyCPU{},
+	}
+
+	if gpus != nil {
+		for i := uint(0); i < gpus.GPUCount; i++ {
+			info := gpus.GPUs[i]
+			d := info.DeviceInfo
+			gpu := TopologyGPU{
+				GPU:          d.GPU,
+				UUID:         d.UUID,
+				PCIBusID:     d.PCI.BusID,
+				Device:       fmt.Sprintf("nvidia%d", d.GPU),
+				ModelName:    d.Identifiers.Model,
+				MigEnabled:   info.MigEnabled,
+				GPUInstances: []TopologyGPUInstance{},
+			}
+
+			for _, gi := range info.GPUInstances {
+				instance := TopologyGPUInstance{
+					ID:               gi.Info.NvmlInstanceId,
+					EntityID:         gi.EntityId,
+					Profile:          gi.ProfileName,
+					ComputeInstances: []TopologyComputeInstance{},
+				}
+				for _, ci := range gi.ComputeInstances {
+					instance.ComputeInstances = append(instance.ComputeInstances, TopologyComputeInstance{
+						ID:       ci.InstanceInfo.NvmlComputeInstanceId,
+						EntityID: ci.EntityId,
+						Profile:  ci.ProfileName,
+					})
+				}
+				gpu.GPUInstances = append(gpu.GPUInstances, instance)
+			}
+
+			t.GPUs = append(t.GPUs, gpu)
+		}
+	}
+
+	if switches != nil {
+		for _, sw := range switches.Switches {
+			s := TopologySwitch{Switch: sw.EntityId, NvLinks: []TopologyNvLink{}}
+			for _, link := range sw.NvLinks {
+				s.NvLinks = append(s.NvLinks, TopologyNvLink{Link: link.Index, State: linkStateNames[link.State]})
+			}
+			t.Switches = append(t.Switches, s)
+		}
+	}
+
+	if cpus != nil {
+		for _, cpu := range cpus.CPUs {
+			t.CPUs = append(t.CPUs, TopologyCPU{CPU: cpu.EntityId, Cores: append([]uint{}, cpu.Cores...)})
+		}
+	}
+
+	return t
+}
+
+// WriteJSON writes the topology as indented JSON.
+func (t Topology) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t)
+}
+
+// WriteTree writes the topology as a tree, for humans.
+func (t Topology) WriteTree(w io.Writer) error {
+	var sb strings.Builder
+
+	for _, gpu := range t.GPUs {
+		fmt.Fprintf(&sb, "GPU %d: %s (%s, %s)\n", gpu.GPU, gpu.ModelName, gpu.UUID, gpu.PCIBusID)
+		for i, gi := range gpu.GPUInstances {
+			branch, indent := treeBranch(i, len(gpu.GPUInstances))
+			fmt.Fprintf(&sb, "%sGPU instance %d: %s (entity %d)\n", branch, gi.ID, gi.Profile, gi.EntityID)
+			for j, ci := range gi.ComputeInstances {
+				branch, _ := treeBranch(j, len(gi.ComputeInstances))
+				fmt.Fprintf(&sb, "%s%sCompute instance %d: %s (entity %d)\n", indent, branch, ci.ID, ci.Profile,
+					ci.EntityID)
+			}
+		}
+	}
+
+	for _, sw := range t.Switches {
+		fmt.Fprintf(&sb, "NvSwitch %d\n", sw.Switch)
+		for i, link := range sw.NvLinks {
+			branch, _ := treeBranch(i, len(sw.NvLinks))
+			fmt.Fprintf(&sb, "%sNvLink %d: %s\n", branch, link.Link, link.State)
+		}
+	}
+
+	for _, cpu := range t.CPUs {
+		fmt.Fprintf(&sb, "CPU %d\n", cpu.CPU)
+		if len(cpu.Cores) > 0 {
+			fmt.Fprintf(&sb, "└── Cores: %s\n", formatRanges(cpu.Cores))
+		}
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// treeBranch returns the branch of the i-th of n children, and the indent of its own children.
+func treeBranch(i, n int) (string, string) {
+	if i == n-1 {
+		return "└── ", "    "
+	}
+	return "├── ", "│   "
+}
+
+// formatRanges formats sorted numbers as comma-separated ranges, e.g. 0-3,8,10-11.
+func formatRanges(numbers []uint) string {
+	var ranges []string
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprint(numbers[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", numbers[i], numbers[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// serveTopology writes the topology as JSON, or as a tree when the format query parameter is tree.
+func serveTopology(w http.ResponseWriter, r *http.Request, t Topology) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, http.StatusOK, t)
+	case "tree":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusOK)
+		if err := t.WriteTree(w); err != nil {
+			logrus.WithError(err).Error("Failed to write response.")
+		}
+	default:
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid format '%s'; expected json or tree", format))
+	}
+}
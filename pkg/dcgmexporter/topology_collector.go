@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// topologyInfoCollector exposes the relationships of the topology as info metrics with a constant '1' value:
+// the GPU instances with their parent GPU, and the NvLinks with their parent NvSwitch.
+type topologyInfoCollector struct {
+	metrics MetricsByCounter
+}
+
+func NewTopologyInfoCollector(counters []Counter, hostname string, config *Config, topology Topology) (Collector, error) {
+	if !IsDCGMExpTopologyInfoEnabled(counters) {
+		return nil, fmt.Errorf("%s and %s collectors are disabled", dcgmExpGPUInstanceInfo, dcgmExpNvLinkInfo)
+	}
+
+	uuid := "UUID"
+	if config.UseOldNamespace {
+		uuid = "uuid"
+	}
+
+	metrics := MetricsByCounter{}
+	for _, counter := range counters {
+		switch counter.FieldName {
+		case dcgmExpGPUInstanceInfo:
+			for _, gpu := range topology.GPUs {
+				for _, gi := range gpu.GPUInstances {
+					metrics[counter] = append(metrics[counter], Metric{
+						Counter:       counter,
+						Value:         "1",
+						UUID:          uuid,
+						GPU:           fmt.Sprint(gpu.GPU),
+						GPUUUID:       gpu.UUID,
+						GPUDevice:     gpu.Device,
+						GPUModelName:  normalizeModelName(gpu.ModelName, config.ReplaceBlanksInModelName),
+						GPUPCIBusID:   gpu.PCIBusID,
+						MigProfile:    gi.Profile,
+						GPUInstanceID: fmt.Sprint(gi.ID),
+						Hostname:      hostname,
+						Labels: map[string]string{
+							"entity_id":         fmt.Sprint(gi.EntityID),
+							"compute_instances": fmt.Sprint(len(gi.ComputeInstances)),
+						},
+					})
+				}
+			}
+		case dcgmExpNvLinkInfo:
+			for _, sw := range topology.Switches {
+				for _, link := range sw.NvLinks {
+					metrics[counter] = append(metrics[counter], Metric{
+						Counter:   counter,
+						Value:     "1",
+						GPU:       fmt.Sprint(link.Link),
+						GPUDevice: fmt.Sprintf("nvswitch%d", sw.Switch),
+						Hostname:  hostname,
+						Labels:    map[string]string{"state": link.State},
+					})
+				}
+			}
+		}
+	}
+
+	return &topologyInfoCollector{metrics: metrics}, nil
+}
+
+// IsDCGMExpTopologyInfoEnabled returns whether any of the topology info metrics is enabled.
+func IsDCGMExpTopologyInfoEnabled(counters []Counter) bool {
+	return slices.ContainsFunc(counters, func(c Counter) bool {
+		return c.FieldName == dcgmExpGPUInstanceInfo || c.FieldName == dcgmExpNvLinkInfo
+	})
+}
+
+// GetMetrics returns the info metrics of the topology discovered when the collector was created.
+func (c *topologyInfoCollector) GetMetrics() (MetricsByCounter, error) {
+	return c.metrics, nil
+}
+
+func (c *topologyInfoCollector) Cleanup() {}
+
+// Describe sends no descriptors, which makes the collector an unchecked collector.
+func (c *topologyInfoCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect collects the info metrics of the topology.
+func (c *topologyInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	collectMetrics(ch, c.metrics, exporterMetricLabels)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopologyInfoCollector(t *testing.T) {
+	giInfo := Counter{FieldName: dcgmExpGPUInstanceInfo, PromType: "gauge"}
+	linkInfo := Counter{FieldName: dcgmExpNvLinkInfo, PromType: "gauge"}
+	config := &Config{ReplaceBlanksInModelName: true}
+
+	c, err := NewTopologyInfoCollector([]Counter{giInfo, linkInfo}, "node1", config, testTopology())
+	require.NoError(t, err)
+
+	metrics, err := c.GetMetrics()
+	require.NoError(t, err)
+	require.Len(t, metrics[giInfo], 2)
+	require.Len(t, metrics[linkInfo], 2)
+
+	builder := newMetricFamilyBuilder()
+	builder.add(metrics, exporterMetricLabels)
+	families := builder.build()
+	require.Len(t, families, 2)
+
+	gi := families[0]
+	assert.Equal(t, dcgmExpGPUInstanceInfo, gi.GetName())
+	assert.Equal(t, 1.0, gi.Metric[0].GetGauge().GetValue())
+	assert.Equal(t, map[string]string{
+		"gpu":               "1",
+		"UUID":              "GPU-1",
+		"pci_bus_id":        "00000000:02:00.0",
+		"device":            "nvidia1",
+		"modelName":         "NVIDIA-H100-80GB-HBM3",
+		"GPU_I_PROFILE":     "1g.10gb",
+		"GPU_I_ID":          "3",
+		"Hostname":          "node1",
+		"entity_id":         "12",
+		"compute_instances": "1",
+	}, labelValues(gi.Metric[0].GetLabel()))
+
+	link := families[1]
+	assert.Equal(t, dcgmExpNvLinkInfo, link.GetName())
+	assert.Equal(t, map[string]string{
+		"nvlink":   "5",
+		"nvswitch": "nvswitch0",
+		"Hostname": "node1",
+		"state":    "down",
+	}, labelValues(link.Metric[1].GetLabel()))
+
+	ch := make(chan prometheus.Metric, 10)
+	c.(prometheus.Collector).Collect(ch)
+	close(ch)
+	assert.Len(t, ch, 4)
+}
+
+func TestNewTopologyInfoCollector_Disabled(t *testing.T) {
+	counter := Counter{FieldID: 150, FieldName: "DCGM_FI_DEV_GPU_TEMP", PromType: "gauge"}
+	_, err := NewTopologyInfoCollector([]Counter{counter}, "", &Config{}, testTopology())
+	assert.Error(t, err)
+}
+
+func labelValues(labels []*dto.LabelPair) map[string]string {
+	values := map[string]string{}
+	for _, l := range labels {
+		values[l.GetName()] = l.GetValue()
+	}
+	return values
+}
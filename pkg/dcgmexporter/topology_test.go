@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTopology() Topology {
+	gpus := &SystemInfo{GPUCount: 2, InfoType: dcgm.FE_GPU}
+	gpus.GPUs[0] = GPUInfo{
+		DeviceInfo: dcgm.Device{GPU: 0, UUID: "GPU-0", PCI: dcgm.PCIInfo{BusID: "00000000:01:00.0"},
+			Identifiers: dcgm.DeviceIdentifiers{Model: "NVIDIA H100 80GB HBM3"}},
+	}
+	gpus.GPUs[1] = GPUInfo{
+		DeviceInfo: dcgm.Device{GPU: 1, UUID: "GPU-1", PCI: dcgm.PCIInfo{BusID: "00000000:02:00.0"},
+			Identifiers: dcgm.DeviceIdentifiers{Model: "NVIDIA H100 80GB HBM3"}},
+		MigEnabled: true,
+		GPUInstances: []GPUInstanceInfo{
+			{
+				Info:        dcgm.MigEntityInfo{NvmlInstanceId: 3},
+				ProfileName: "1g.10gb",
+				EntityId:    12,
+				ComputeInstances: []ComputeInstanceInfo{
+					{InstanceInfo: dcgm.MigEntityInfo{NvmlComputeInstanceId: 0}, ProfileName: "1c.1g.10gb", EntityId: 20},
+				},
+			},
+			{
+				Info:        dcgm.MigEntityInfo{NvmlInstanceId: 5},
+				ProfileName: "3g.40gb",
+				EntityId:    13,
+			},
+		},
+	}
+	switches := &SystemInfo{InfoType: dcgm.FE_SWITCH, Switches: []SwitchInfo{{
+		EntityId: 0,
+		NvLinks: []dcgm.NvLinkStatus{
+			{ParentId: 0, ParentType: dcgm.FE_SWITCH, State: dcgm.LS_UP, Index: 4},
+			{ParentId: 0, ParentType: dcgm.FE_SWITCH, State: dcgm.LS_DOWN, Index: 5},
+		},
+	}}}
+	cpus := &SystemInfo{InfoType: dcgm.FE_CPU, CPUs: []CPUInfo{{EntityId: 0, Cores: []uint{0, 1, 2, 3, 8, 10, 11}}}}
+
+	return NewTopology(gpus, switches, cpus)
+}
+
+func TestNewTopology(t *testing.T) {
+	topology := testTopology()
+
+	require.Len(t, topology.GPUs, 2)
+	assert.Equal(t, TopologyGPU{
+		GPU:          0,
+		UUID:         "GPU-0",
+		PCIBusID:     "00000000:01:00.0",
+		Device:       "nvidia0",
+		ModelName:    "NVIDIA H100 80GB HBM3",
+		GPUInstances: []TopologyGPUInstance{},
+	}, topology.GPUs[0])
+	assert.True(t, topology.GPUs[1].MigEnabled)
+	assert.Equal(t, []TopologyGPUInstance{
+		{
+			ID:       3,
+			EntityID: 12,
+			Profile:  "1g.10gb",
+			ComputeInstances: []TopologyComputeInstance{
+				{ID: 0, EntityID: 20, Profile: "1c.1g.10gb"},
+			},
+		},
+		{ID: 5, EntityID: 13, Profile: "3g.40gb", ComputeInstances: []TopologyComputeInstance{}},
+	}, topology.GPUs[1].GPUInstances)
+
+	assert.Equal(t, []TopologySwitch{{Switch: 0, NvLinks: []TopologyNvLink{
+		{Link: 4, State: "up"},
+		{Link: 5, State: "down"},
+	}}}, topology.Switches)
+	assert.Equal(t, []TopologyCPU{{CPU: 0, Cores: []uint{0, 1, 2, 3, 8, 10, 11}}}, topology.CPUs)
+}
+
+func TestNewTopology_NoEntities(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, NewTopology(nil, nil, nil).WriteJSON(&buf))
+	assert.JSONEq(t, `{"gpus": [], "nvswitches": [], "cpus": []}`, buf.String())
+}
+
+func TestTopology_WriteTree(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, testTopology().WriteTree(&buf))
+
+	expected := `GPU 0: NVIDIA H100 80GB HBM3 (GPU-0, 00000000:01:00.0)
+GPU 1: NVIDIA H100 80GB HBM3 (GPU-1, 00000000:02:00.0)
+├── GPU instance 3: 1g.10gb (entity 12)
+│   └── Compute instance 0: 1c.1g.10gb (entity 20)
+└── GPU instance 5: 3g.40gb (entity 13)
+NvSwitch 0
+├── NvLink 4: up
+└── NvLink 5: down
+CPU 0
+└── Cores: 0-3,8,10-11
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestFormatRanges(t *testing.T) {
+	assert.Equal(t, "", formatRanges(nil))
+	assert.Equal(t, "7", formatRanges([]uint{7}))
+	assert.Equal(t, "0-3,8,10-11", formatRanges([]uint{0, 1, 2, 3, 8, 10, 11}))
+}
+
+func TestServeTopology(t *testing.T) {
+	serve := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		serveTopology(rec, httptest.NewRequest(http.MethodGet, "/topology"+query, nil), testTopology())
+		return rec
+	}
+
+	rec := serve("")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var topology Topology
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &topology))
+	assert.Equal(t, testTopology(), topology)
+
+	rec = serve("?format=tree")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "└── Cores: 0-3,8,10-11")
+
+	rec = serve("?format=yaml")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestTopologyCache(t *testing.T) {
+	var discoveries int
+	var discoveryErr error
+	cache := newTopologyCache(&Config{CollectInterval: 60000})
+	cache.discover = func(c *Config) (Topology, error) {
+		discoveries++
+		if discoveryErr != nil {
+			return Topology{}, discoveryErr
+		}
+		return testTopology(), nil
+	}
+
+	// Failed discoveries aren't cached
+	discoveryErr = errors.New("connection not valid")
+	_, err := cache.get()
+	assert.Error(t, err)
+
+	discoveryErr = nil
+	topology, err := cache.get()
+	require.NoError(t, err)
+	assert.Equal(t, testTopology(), topology)
+
+	// The topology is cached for the interval, and discovered again after
+	_, err = cache.get()
+	require.NoError(t, err)
+	assert.Equal(t, 2, discoveries)
+
+	cache.discovered = time.Now().Add(-time.Minute)
+	_, err = cache.get()
+	require.NoError(t, err)
+	assert.Equal(t, 3, discoveries)
+}
+
+func TestMetricsServer_TopologyMultiTarget(t *testing.T) {
+	s, _, err := NewMetricsServer(&Config{Probe: true}, nil, NewRegistry())
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/topology", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -20,9 +20,12 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
-	"text/template"
+	"time"
 
 	"github.com/NVIDIA/go-dcgm/pkg/dcgm"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/exporter-toolkit/web"
 )
 
@@ -48,6 +51,14 @@ var (
 	undefinedConfigMapData = "none"
 )
 
+const (
+	// SharedGPUsSeries emits the metrics of a GPU shared by several pods once per pod. It's the default.
+	SharedGPUsSeries = "series"
+	// SharedGPUsInfo emits the metrics of a GPU shared by several pods without pod, and the pods in the
+	// DCGM_EXP_GPU_SHARED_PODS metric.
+	SharedGPUsInfo = "info"
+)
+
 type Transform interface {
 	Process(metrics MetricsByCounter, sysInfo SystemInfo) error
 	Name() string
@@ -56,19 +67,29 @@ type Transform interface {
 type MetricsPipeline struct {
 	config *Config
 
-	transformations      []Transform
-	migMetricsFormat     *template.Template
-	switchMetricsFormat  *template.Template
-	linkMetricsFormat    *template.Template
-	cpuMetricsFormat     *template.Template
-	cpuCoreMetricsFormat *template.Template
+	transformations []Transform
+	hostname        string
 
+	collectorsMtx   sync.RWMutex // Guards the counters and the collectors, which are swapped on reload
 	counters        []Counter
 	gpuCollector    *DCGMCollector
 	switchCollector *DCGMCollector
 	linkCollector   *DCGMCollector
 	cpuCollector    *DCGMCollector
 	coreCollector   *DCGMCollector
+	cleanups        []func()
+
+	lastGoodMtx sync.Mutex
+	lastGood    map[string]MetricsByCounter // Last good metrics per entity type
+
+	sinks    []MetricsSink
+	registry *Registry // Collectors of the DCGM_EXP metrics, written to the sinks along with the DCGM metrics
+
+	healthMtx      sync.Mutex
+	periodic       bool      // Whether Run collects the metrics every collect interval
+	runStart       time.Time // When Run started
+	lastCollection time.Time // End of the last collection, failed or not
+	lastSuccess    time.Time // End of the last successful collection
 }
 
 type DCGMCollector struct {
@@ -79,18 +100,40 @@ type DCGMCollector struct {
 	SysInfo                  SystemInfo
 	Hostname                 string
 	ReplaceBlanksInModelName bool
+	sampleSources            []watchedFieldGroup // Field groups of the counters computed from the samples
+	collectInterval          time.Duration
+	distributionsMtx         sync.Mutex
+	distributions            map[distributionKey]*distribution
 }
 
 type Counter struct {
-	FieldID   dcgm.Short
-	FieldName string
-	PromType  string
-	Help      string
+	FieldID       dcgm.Short
+	FieldName     string
+	PromType      string
+	Help          string
+	Unit          string        // Exposed as the OpenMetrics unit of the metric, when set
+	MetricName    string        // Name of the exposed metric, FieldName when empty
+	Scale         float64       // Factor applied to the values, when not zero
+	EntityTypes   EntityTypes   // Entity types the counter is collected for, all of them when empty
+	WatchInterval time.Duration // Watch frequency of the field, the collect interval when zero
+	KeepAge       time.Duration // How long DCGM keeps the samples of the field, only the latest one when zero
+	Aggregate     bool          // Export the min, max and average of the samples over the collect interval
+
+	// Native histogram bucket factor of a histogram, only classic buckets are exposed when zero
+	NativeHistogramBucketFactor float64
+
+	// Static labels added to the metrics, and bucket upper bounds and quantiles of a histogram or
+	// a summary. They are encoded as strings to keep Counter comparable, as it is the key of MetricsByCounter,
+	// and decoded once when the counter is loaded, see StaticLabels.
+	staticLabels string
+	buckets      string
+	quantiles    string
 }
 
 type Metric struct {
-	Counter Counter
-	Value   string
+	Counter   Counter
+	Value     string
+	Timestamp time.Time // Time at which DCGM sampled the value; zero when the value isn't a DCGM sample
 
 	GPU          string
 	GPUUUID      string
@@ -106,6 +149,10 @@ type Metric struct {
 
 	Labels     map[string]string
 	Attributes map[string]string
+
+	// Distribution of the samples of a histogram or a summary counter, instead of Value
+	Histogram *dto.Histogram
+	Summary   *dto.Summary
 }
 
 func (m Metric) getIDOfType(idType KubernetesGPUIDType) (string, error) {
@@ -134,20 +181,29 @@ type MetricsServer struct {
 	sync.Mutex
 
 	server      *http.Server
+	router      *mux.Router
 	webConfig   *web.FlagConfig
-	metrics     string
-	metricsChan chan string
+	metrics     []*dto.MetricFamily
+	metricsChan chan []*dto.MetricFamily
 	registry    *Registry
+	gatherer    prometheus.Gatherer // Set in the native mode, where metrics are collected on every scrape
+	openMetrics bool                // Whether the OpenMetrics format is served to the scrapers asking for it
+	collected   bool                // Whether the last collection collected an entity type, for /health
+	collections chan struct{}       // Receives a value after each collection of the cached mode
 }
 
 type PodMapper struct {
-	Config *Config
+	Config       *Config
+	podResources *podResourcesCache
+	podMetadata  *podMetadataCache // Nil unless pod labels, annotations or workloads are added
+	workloads    *workloadResolver // Nil unless workloads are added
 }
 
 type PodInfo struct {
-	Name      string
-	Namespace string
-	Container string
+	Name       string
+	Namespace  string
+	Container  string
+	Attributes map[string]string // Allow-listed labels and annotations of the pod
 }
 
 // MetricsByCounter represents a map where each Counter is associated with a slice of Metric objects
@@ -0,0 +1,265 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+const (
+	workloadKindAttribute = "workload_kind"
+	workloadNameAttribute = "workload_name"
+
+	maxOwnerDepth      = 5               // Longest owner chain followed, like Pod→Job→CronJob
+	workloadQueueSize  = 256             // Controllers waiting to be resolved
+	workloadCacheTTL   = 1 * time.Hour   // Workloads of controllers without pods anymore are forgotten after
+	workloadRetryDelay = 1 * time.Minute // Failed resolutions are retried after
+)
+
+var (
+	workloadResolverMtx sync.Mutex
+	podWorkloadResolver *workloadResolver
+)
+
+// workload is the top-level owner of a pod, like a Deployment, a CronJob or a Kubeflow PyTorchJob.
+type workload struct {
+	Kind string
+	Name string
+}
+
+type workloadEntry struct {
+	workload workload
+	resolved bool      // False while resolving, or after a failure
+	updated  time.Time // When resolved or failed
+	used     time.Time
+}
+
+// workloadResolver resolves the workloads of the pods by following the controller owner references up to the
+// top-level owner: ReplicaSet→Deployment, Job→CronJob, and the custom resources of Kubeflow, Ray or Volcano. The
+// workloads are resolved in the background and cached by controller, so the collections never wait for the API
+// server.
+type workloadResolver struct {
+	client metadata.Interface
+	mapper meta.RESTMapper
+
+	start sync.Once
+	queue chan ownerOf
+	stop  chan struct{}
+
+	mtx       sync.Mutex
+	workloads map[types.UID]*workloadEntry // By UID of the controller of the pods
+}
+
+// ownerOf is a controller owner reference of an object of the namespace.
+type ownerOf struct {
+	namespace string
+	owner     metav1.OwnerReference
+}
+
+// getWorkloadResolver returns the workload resolver shared by the pod mappers of the pipeline and of all the
+// collectors.
+func getWorkloadResolver() (*workloadResolver, error) {
+	workloadResolverMtx.Lock()
+	defer workloadResolverMtx.Unlock()
+
+	if podWorkloadResolver != nil {
+		return podWorkloadResolver, nil
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := metadata.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the Kubernetes metadata client; err: %w", err)
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the Kubernetes discovery client; err: %w", err)
+	}
+
+	// The discovered resources are refreshed when an owner has an unknown kind, like a newly installed CRD
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+
+	podWorkloadResolver = newWorkloadResolver(client, mapper)
+	return podWorkloadResolver, nil
+}
+
+// closeWorkloadResolver stops the resolutions of the shared resolver, and forgets it.
+func closeWorkloadResolver() {
+	workloadResolverMtx.Lock()
+	defer workloadResolverMtx.Unlock()
+
+	if podWorkloadResolver != nil {
+		podWorkloadResolver.close()
+		podWorkloadResolver = nil
+	}
+}
+
+func newWorkloadResolver(client metadata.Interface, mapper meta.RESTMapper) *workloadResolver {
+	return &workloadResolver{
+		client:    client,
+		mapper:    mapper,
+		queue:     make(chan ownerOf, workloadQueueSize),
+		stop:      make(chan struct{}),
+		workloads: map[types.UID]*workloadEntry{},
+	}
+}
+
+// get returns the workload of the pod, and whether it's resolved. The workload of a pod without controller is the
+// pod itself. Unknown workloads are resolved in the background, for the next collections.
+func (r *workloadResolver) get(pod *corev1.Pod) (workload, bool) {
+	controller := metav1.GetControllerOfNoCopy(pod)
+	if controller == nil {
+		return workload{Kind: "Pod", Name: pod.Name}, true
+	}
+
+	r.start.Do(func() {
+		go r.run()
+	})
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := time.Now()
+	entry, exists := r.workloads[controller.UID]
+	if exists {
+		entry.used = now
+		if entry.resolved || now.Sub(entry.updated) < workloadRetryDelay {
+			return entry.workload, entry.resolved
+		}
+	}
+
+	select {
+	case r.queue <- ownerOf{namespace: pod.Namespace, owner: *controller}:
+		// Not queued again before the retry delay
+		r.workloads[controller.UID] = &workloadEntry{updated: now, used: now}
+	default:
+		logrus.Debugf("Too many workloads to resolve; the workload of the pod '%s/%s' will be resolved later",
+			pod.Namespace, pod.Name)
+	}
+
+	return workload{}, false
+}
+
+// run resolves the queued workloads until the resolver is closed, and forgets the unused workloads.
+func (r *workloadResolver) run() {
+	prune := time.NewTicker(workloadCacheTTL)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-prune.C:
+			r.prune()
+		case owner := <-r.queue:
+			w, err := r.resolve(owner)
+			if err != nil {
+				logrus.WithError(err).Warnf("Failed to resolve the workload of the %s '%s/%s'; retrying in %s",
+					owner.owner.Kind, owner.namespace, owner.owner.Name, workloadRetryDelay)
+			}
+
+			r.mtx.Lock()
+			r.workloads[owner.owner.UID] = &workloadEntry{
+				workload: w,
+				resolved: err == nil,
+				updated:  time.Now(),
+				used:     time.Now(),
+			}
+			r.mtx.Unlock()
+		}
+	}
+}
+
+// resolve follows the controller owner references up to the top-level owner. The owners that can't be read,
+// because they are deleted, of an unknown kind, or not allowed by RBAC, are considered top-level.
+func (r *workloadResolver) resolve(owner ownerOf) (workload, error) {
+	ref := owner.owner
+	for depth := 0; depth < maxOwnerDepth; depth++ {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil {
+			return workload{}, fmt.Errorf("invalid API version '%s'; err: %w", ref.APIVersion, err)
+		}
+
+		mapping, err := r.mapper.RESTMapping(gv.WithKind(ref.Kind).GroupKind(), gv.Version)
+		if meta.IsNoMatchError(err) {
+			logrus.WithError(err).Debugf("Unknown owner kind '%s'", ref.Kind)
+			break
+		} else if err != nil {
+			return workload{}, fmt.Errorf("cannot map the kind '%s'; err: %w", ref.Kind, err)
+		}
+
+		resource := r.client.Resource(mapping.Resource)
+		ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+		var obj *metav1.PartialObjectMetadata
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			obj, err = resource.Namespace(owner.namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		} else {
+			obj, err = resource.Get(ctx, ref.Name, metav1.GetOptions{})
+		}
+		cancel()
+		if apierrors.IsNotFound(err) || apierrors.IsForbidden(err) {
+			logrus.WithError(err).Debugf("Cannot read the owner of the %s '%s'", ref.Kind, ref.Name)
+			break
+		} else if err != nil {
+			return workload{}, fmt.Errorf("cannot read the %s '%s'; err: %w", ref.Kind, ref.Name, err)
+		}
+
+		next := metav1.GetControllerOfNoCopy(obj)
+		if next == nil {
+			break
+		}
+		ref = *next
+	}
+
+	return workload{Kind: ref.Kind, Name: ref.Name}, nil
+}
+
+// prune forgets the workloads of the controllers without pods for workloadCacheTTL.
+func (r *workloadResolver) prune() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for uid, entry := range r.workloads {
+		if time.Since(entry.used) > workloadCacheTTL {
+			delete(r.workloads, uid)
+		}
+	}
+}
+
+// close stops the resolutions.
+func (r *workloadResolver) close() {
+	close(r.stop)
+}
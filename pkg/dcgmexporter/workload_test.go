@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2024, NVIDIA CORPORATION.  All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dcgmexporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/utils/ptr"
+)
+
+func controllerRef(apiVersion, kind, name string) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Name:       name,
+		UID:        types.UID(kind + "/" + name),
+		Controller: ptr.To(true),
+	}
+}
+
+func ownedObject(ref metav1.OwnerReference, owners ...metav1.OwnerReference) *metav1.PartialObjectMetadata {
+	return &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: ref.APIVersion, Kind: ref.Kind},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            ref.Name,
+			Namespace:       "default",
+			UID:             ref.UID,
+			OwnerReferences: owners,
+		},
+	}
+}
+
+func testWorkloadResolver(t *testing.T) *workloadResolver {
+	deployment := controllerRef("apps/v1", "Deployment", "trainer")
+	replicaSet := controllerRef("apps/v1", "ReplicaSet", "trainer-5d8f7")
+	cronJob := controllerRef("batch/v1", "CronJob", "nightly")
+	job := controllerRef("batch/v1", "Job", "nightly-28735")
+	rayJob := controllerRef("ray.io/v1", "RayJob", "tune")
+	rayCluster := controllerRef("ray.io/v1", "RayCluster", "tune-raycluster")
+
+	scheme := metadatafake.NewTestScheme()
+	require.NoError(t, metav1.AddMetaToScheme(scheme))
+	client := metadatafake.NewSimpleMetadataClient(scheme, []runtime.Object{
+		ownedObject(deployment),
+		ownedObject(replicaSet, deployment),
+		ownedObject(cronJob),
+		ownedObject(job, cronJob),
+		ownedObject(controllerRef("batch/v1", "Job", "standalone")),
+		ownedObject(controllerRef("kubeflow.org/v1", "PyTorchJob", "bert")),
+		ownedObject(rayJob),
+		ownedObject(rayCluster, rayJob),
+	}...)
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for _, gvk := range []schema.GroupVersionKind{
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+		{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+		{Group: "batch", Version: "v1", Kind: "CronJob"},
+		{Group: "batch", Version: "v1", Kind: "Job"},
+		{Group: "kubeflow.org", Version: "v1", Kind: "PyTorchJob"},
+		{Group: "ray.io", Version: "v1", Kind: "RayJob"},
+		{Group: "ray.io", Version: "v1", Kind: "RayCluster"},
+	} {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+
+	return newWorkloadResolver(client, mapper)
+}
+
+func TestWorkloadResolver_Get(t *testing.T) {
+	resolver := testWorkloadResolver(t)
+	defer resolver.close()
+
+	tests := []struct {
+		name  string
+		owner *metav1.OwnerReference
+		want  workload
+	}{
+		{
+			name:  "Deployment",
+			owner: ptr.To(controllerRef("apps/v1", "ReplicaSet", "trainer-5d8f7")),
+			want:  workload{Kind: "Deployment", Name: "trainer"},
+		},
+		{
+			name:  "CronJob",
+			owner: ptr.To(controllerRef("batch/v1", "Job", "nightly-28735")),
+			want:  workload{Kind: "CronJob", Name: "nightly"},
+		},
+		{
+			name:  "Job",
+			owner: ptr.To(controllerRef("batch/v1", "Job", "standalone")),
+			want:  workload{Kind: "Job", Name: "standalone"},
+		},
+		{
+			name:  "Kubeflow custom resource",
+			owner: ptr.To(controllerRef("kubeflow.org/v1", "PyTorchJob", "bert")),
+			want:  workload{Kind: "PyTorchJob", Name: "bert"},
+		},
+		{
+			name:  "Ray custom resources",
+			owner: ptr.To(controllerRef("ray.io/v1", "RayCluster", "tune-raycluster")),
+			want:  workload{Kind: "RayJob", Name: "tune"},
+		},
+		{
+			name:  "unknown kind",
+			owner: ptr.To(controllerRef("batch.volcano.sh/v1alpha1", "Job", "mpi")),
+			want:  workload{Kind: "Job", Name: "mpi"},
+		},
+		{
+			name:  "deleted owner",
+			owner: ptr.To(controllerRef("apps/v1", "ReplicaSet", "trainer-deleted")),
+			want:  workload{Kind: "ReplicaSet", Name: "trainer-deleted"},
+		},
+		{
+			name: "pod without controller",
+			want: workload{Kind: "Pod", Name: "gpu-pod"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("gpu-pod", nil, nil)
+			if tt.owner != nil {
+				pod.OwnerReferences = []metav1.OwnerReference{*tt.owner}
+
+				// The workloads are resolved in the background
+				_, resolved := resolver.get(pod)
+				assert.False(t, resolved)
+			}
+
+			var got workload
+			require.Eventually(t, func() bool {
+				var resolved bool
+				got, resolved = resolver.get(pod)
+				return resolved
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWorkloadResolver_Prune(t *testing.T) {
+	resolver := testWorkloadResolver(t)
+	defer resolver.close()
+
+	resolver.workloads["used"] = &workloadEntry{resolved: true, used: time.Now()}
+	resolver.workloads["unused"] = &workloadEntry{resolved: true, used: time.Now().Add(-2 * workloadCacheTTL)}
+
+	resolver.prune()
+	assert.Contains(t, resolver.workloads, types.UID("used"))
+	assert.NotContains(t, resolver.workloads, types.UID("unused"))
+}
+
+func TestPodMapper_ProcessWorkload(t *testing.T) {
+	pod := testPod("gpu-pod-0", nil, nil)
+	pod.OwnerReferences = []metav1.OwnerReference{controllerRef("apps/v1", "ReplicaSet", "trainer-5d8f7")}
+
+	podMetadata := startTestPodMetadataCache(t, newAPIServerPodMetadataCache(fakeClientset(pod), "node-a"))
+	defer podMetadata.close()
+	workloads := testWorkloadResolver(t)
+	defer workloads.close()
+	podMapper := &PodMapper{
+		Config:       &Config{KubernetesGPUIdType: GPUUID, KubernetesWorkloads: true},
+		podResources: testPodResources(t, "GPU-1"),
+		podMetadata:  podMetadata,
+		workloads:    workloads,
+	}
+
+	process := func() map[string]string {
+		return processTestMetrics(t, podMapper, "GPU-1")[0].Attributes
+	}
+
+	// The collection doesn't wait for the workload
+	assert.NotContains(t, process(), workloadKindAttribute)
+
+	require.Eventually(t, func() bool {
+		return process()[workloadKindAttribute] == "Deployment"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "trainer", process()[workloadNameAttribute])
+	assert.Equal(t, "gpu-pod-0", process()[podAttribute])
+}
+
+func fakeClientset(pods ...*corev1.Pod) *fake.Clientset {
+	objs := make([]runtime.Object, 0, len(pods))
+	for _, pod := range pods {
+		objs = append(objs, pod)
+	}
+	return fake.NewSimpleClientset(objs...)
+}
@@ -42,11 +42,15 @@ func NewXIDCollector(counters []Counter,
 	}
 
 	collector := xidCollector{}
-	collector.expCollector = newExpCollector(counters,
+	var err error
+	collector.expCollector, err = newExpCollector(counters,
 		hostname,
 		[]dcgm.Short{dcgm.DCGM_FI_DEV_XID_ERRORS},
 		config,
 		fieldEntityGroupTypeSystemInfo)
+	if err != nil {
+		return nil, err
+	}
 
 	collector.counter = counters[slices.IndexFunc(counters, func(c Counter) bool {
 		return c.FieldName == dcgmExpXIDErrorsCount